@@ -0,0 +1,437 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FHIRAuth authorizes requests to the FHIR server
+type FHIRAuth interface {
+	// Authorize adds the credentials to the request
+	Authorize(r *http.Request) error
+	// Invalidate discards any cached credentials after the FHIR server rejects them
+	Invalidate()
+}
+
+// AuthTransport is an http.RoundTripper that authorizes every request before sending it.  If the server responds with
+// HTTP 401, the cached credentials are invalidated so the next request gets new ones.
+type AuthTransport struct {
+	Base http.RoundTripper
+	Auth FHIRAuth
+}
+
+// RoundTrip authorizes and sends the request
+func (t *AuthTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the original request, so authorize a copy
+	authorized := new(http.Request)
+	*authorized = *r
+	authorized.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		authorized.Header[k] = v
+	}
+	if err := t.Auth.Authorize(authorized); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, fmt.Errorf("Couldn't authorize FHIR request: %s", err)
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(authorized)
+	if err == nil && res.StatusCode == http.StatusUnauthorized {
+		t.Auth.Invalidate()
+	}
+	return res, err
+}
+
+// NewAuthClient creates an HTTP client that authorizes every request, using the base client's transport
+func NewAuthClient(base *http.Client, auth FHIRAuth) *http.Client {
+	return &http.Client{
+		Transport: &AuthTransport{Base: base.Transport, Auth: auth},
+		Timeout:   base.Timeout,
+	}
+}
+
+// BearerTokenAuth authorizes requests with a static bearer token, or with a token read from a (watched) file
+type BearerTokenAuth struct {
+	Token     string
+	TokenFile *SecretFile
+}
+
+// Authorize sets the Authorization header to the bearer token
+func (a *BearerTokenAuth) Authorize(r *http.Request) error {
+	token := a.Token
+	if a.TokenFile != nil {
+		token = a.TokenFile.Value()
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Invalidate does nothing, since a static token can't be refreshed
+func (a *BearerTokenAuth) Invalidate() {}
+
+// SMARTBackendAuth authorizes requests using SMART Backend Services: access tokens are requested with the OAuth2
+// client_credentials grant, authenticating with a JWT assertion signed by the client's private key.  Access tokens
+// are cached and requested again shortly before they expire.
+type SMARTBackendAuth struct {
+	// TokenURL is the authorization server's token endpoint.  If empty, it is discovered from FHIREndpoint's SMART
+	// configuration when the first access token is requested.
+	TokenURL     string
+	FHIREndpoint string
+	ClientID     string
+	// Scope is the space-separated list of scopes requested (e.g., "system/Patient.read system/RiskAssessment.write")
+	Scope string
+	// Key signs the JWT assertions: an RSA key signs with RS384, and an ECDSA key signs with ES256, ES384, or ES512
+	// for the P-256, P-384, or P-521 curve
+	Key crypto.Signer
+	// KeyID identifies the key in the client's JWK set, if set
+	KeyID string
+	// Client is used to request access tokens
+	Client *http.Client
+
+	token   string
+	expires time.Time
+	mutex   sync.Mutex
+}
+
+// tokenExpiryMargin is how long before an access token expires that it is replaced
+const tokenExpiryMargin = time.Minute
+
+// Authorize sets the Authorization header to a valid access token, requesting a new one if needed
+func (a *SMARTBackendAuth) Authorize(r *http.Request) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.token == "" || time.Now().Add(tokenExpiryMargin).After(a.expires) {
+		if err := a.requestToken(); err != nil {
+			return err
+		}
+	}
+	r.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+// Invalidate discards the cached access token
+func (a *SMARTBackendAuth) Invalidate() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.token = ""
+}
+
+func (a *SMARTBackendAuth) requestToken() error {
+	c := a.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	if a.TokenURL == "" {
+		tokenURL, err := DiscoverTokenURL(c, a.FHIREndpoint)
+		if err != nil {
+			return err
+		}
+		a.TokenURL = tokenURL
+	}
+
+	assertion, err := a.signAssertion()
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", a.Scope)
+	form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	form.Set("client_assertion", assertion)
+
+	res, err := c.PostForm(a.TokenURL, form)
+	if err != nil {
+		return fmt.Errorf("Couldn't request access token: %s", err)
+	}
+	defer res.Body.Close()
+
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil && res.StatusCode == http.StatusOK {
+		return fmt.Errorf("Couldn't decode access token response: %s", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Received HTTP %d from token endpoint: %s %s", res.StatusCode, token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" || !strings.EqualFold(token.TokenType, "bearer") {
+		return errors.New("Token endpoint did not return a bearer access token")
+	}
+	RegisterSecret(token.AccessToken)
+
+	a.token = token.AccessToken
+	if token.ExpiresIn <= 0 {
+		// SMART recommends tokens last no longer than five minutes, so assume that if no expiration is given
+		token.ExpiresIn = 300
+	}
+	a.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return nil
+}
+
+// signAssertion creates the JWT used to authenticate to the token endpoint
+func (a *SMARTBackendAuth) signAssertion() (string, error) {
+	alg, hashed, err := signingAlgorithm(a.Key)
+	if err != nil {
+		return "", err
+	}
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if a.KeyID != "" {
+		header["kid"] = a.KeyID
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{
+		"iss": a.ClientID,
+		"sub": a.ClientID,
+		"aud": a.TokenURL,
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+		"jti": hex.EncodeToString(jti),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	h := hashed.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+	var sig []byte
+	switch key := a.Key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, hashed, digest)
+	case *ecdsa.PrivateKey:
+		// JWS uses the fixed-length concatenation of r and s rather than the ASN.1 encoding
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, digest); err == nil {
+			size := (key.Curve.Params().BitSize + 7) / 8
+			sig = make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// signingAlgorithm returns the JWS algorithm and hash used to sign with the key.  ECDSA keys must use one of the
+// curves JWS defines an algorithm for.
+func signingAlgorithm(key crypto.Signer) (string, crypto.Hash, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return "RS384", crypto.SHA384, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return "ES256", crypto.SHA256, nil
+		case elliptic.P384():
+			return "ES384", crypto.SHA384, nil
+		case elliptic.P521():
+			return "ES512", crypto.SHA512, nil
+		}
+		return "", 0, fmt.Errorf("Unsupported ECDSA curve %s: SMART backend services keys must use P-256, P-384, or P-521", key.Curve.Params().Name)
+	}
+	return "", 0, errors.New("SMART backend services keys must be RSA or ECDSA keys")
+}
+
+// LoadPrivateKey loads an RSA or ECDSA private key from a PEM file in PKCS #1, PKCS #8, or SEC 1 form.  Keys that
+// can't sign SMART backend services assertions are rejected.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+	var signer crypto.Signer
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		signer = key
+	} else if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		signer = key
+	} else {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse private key in %s: %s", path, err)
+		}
+		if signer, _ = key.(crypto.Signer); signer == nil {
+			return nil, fmt.Errorf("Unsupported private key type in %s", path)
+		}
+	}
+	if _, _, err := signingAlgorithm(signer); err != nil {
+		return nil, fmt.Errorf("Unsupported private key in %s: %s", path, err)
+	}
+	return signer, nil
+}
+
+// DiscoverTokenURL looks up the token endpoint in the FHIR server's SMART configuration
+// (/.well-known/smart-configuration)
+func DiscoverTokenURL(c *http.Client, fhirEndpoint string) (string, error) {
+	r, err := http.NewRequest("GET", strings.TrimSuffix(fhirEndpoint, "/")+"/.well-known/smart-configuration", nil)
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Accept", "application/json")
+	res, err := c.Do(r)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't get SMART configuration: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Received HTTP %d when getting SMART configuration", res.StatusCode)
+	}
+	var config struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&config); err != nil {
+		return "", fmt.Errorf("Couldn't decode SMART configuration: %s", err)
+	}
+	if config.TokenEndpoint == "" {
+		return "", errors.New("SMART configuration does not include a token endpoint")
+	}
+	return config.TokenEndpoint, nil
+}
+
+// FHIRAuthOptions configures authentication to the FHIR server.  Only one of a bearer token, a bearer token file, or a
+// SMART backend services client ID may be set.
+type FHIRAuthOptions struct {
+	Token     string
+	TokenFile string
+	// SMARTClientID enables SMART backend services, which also requires SMARTKeyFile
+	SMARTClientID string
+	SMARTKeyFile  string
+	SMARTKeyID    string
+	// SMARTTokenURL is the token endpoint.  If empty, it is discovered from the FHIR server's SMART configuration.
+	SMARTTokenURL string
+	SMARTScope    string
+}
+
+// NewFHIRAuth creates the FHIR auth for the options, using the client to discover and request tokens.  The FHIR server
+// isn't contacted until the first request is authorized.  If no options are set, it returns nil.
+func NewFHIRAuth(o FHIRAuthOptions, c *http.Client, fhirEndpoint string) (FHIRAuth, error) {
+	set := 0
+	for _, s := range []string{o.Token, o.TokenFile, o.SMARTClientID} {
+		if s != "" {
+			set++
+		}
+	}
+	switch {
+	case set == 0:
+		return nil, nil
+	case set > 1:
+		return nil, errors.New("Only one of a FHIR bearer token, token file, or SMART client ID may be configured")
+	case o.Token != "":
+		RegisterSecret(o.Token)
+		return &BearerTokenAuth{Token: o.Token}, nil
+	case o.TokenFile != "":
+		tokenFile, err := NewSecretFile(o.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return &BearerTokenAuth{TokenFile: tokenFile}, nil
+	}
+
+	if o.SMARTKeyFile == "" {
+		return nil, errors.New("SMART backend services requires a private key")
+	}
+	key, err := LoadPrivateKey(o.SMARTKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &SMARTBackendAuth{
+		TokenURL:     o.SMARTTokenURL,
+		FHIREndpoint: fhirEndpoint,
+		ClientID:     o.SMARTClientID,
+		Scope:        o.SMARTScope,
+		Key:          key,
+		KeyID:        o.SMARTKeyID,
+		Client:       c,
+	}, nil
+}
+
+// FHIRAuthFlags holds the command line args used to configure authorization to the FHIR server
+type FHIRAuthFlags struct {
+	token, tokenFile, smartClientID, smartKey, smartKeyID, smartTokenURL, smartScope *string
+}
+
+// BindFHIRAuthFlags defines the args used to configure authorization to the FHIR server in the flag set
+func BindFHIRAuthFlags(fs *flag.FlagSet) *FHIRAuthFlags {
+	return &FHIRAuthFlags{
+		token:         fs.String("fhir-token", "", "Static bearer token for the FHIR server, visible in process listings so -fhir-token-file is preferred (env: FHIR_TOKEN)"),
+		tokenFile:     fs.String("fhir-token-file", "", "Path to a file containing a bearer token for the FHIR server, reloaded when rotated (env: FHIR_TOKEN_FILE)"),
+		smartClientID: fs.String("fhir-smart-client-id", "", "Client ID for SMART backend services authorization to the FHIR server (env: FHIR_SMART_CLIENT_ID)"),
+		smartKey:      fs.String("fhir-smart-key", "", "Path to the PEM RSA or ECDSA (P-256, P-384, or P-521) private key signing SMART backend services assertions (env: FHIR_SMART_KEY_FILE)"),
+		smartKeyID:    fs.String("fhir-smart-key-id", "", "Key ID of the SMART backend services key in the client's JWK set (env: FHIR_SMART_KEY_ID)"),
+		smartTokenURL: fs.String("fhir-smart-token-url", "", "SMART backend services token endpoint (env: FHIR_SMART_TOKEN_URL, default: discovered from the FHIR server's SMART configuration)"),
+		smartScope:    fs.String("fhir-smart-scope", "", "Scopes requested with SMART backend services (env: FHIR_SMART_SCOPE, default: \"system/Patient.read system/RiskAssessment.write\")"),
+	}
+}
+
+// Options returns the FHIR auth options from the args, falling back to env, falling back to defaults
+func (af *FHIRAuthFlags) Options() FHIRAuthOptions {
+	if *af.token != "" {
+		slog.Warn("The FHIR bearer token was passed as an argument, which exposes it in process listings.  Use -fhir-token-file or FHIR_TOKEN instead.")
+	}
+	return FHIRAuthOptions{
+		Token:         flagOrEnv(af.token, "FHIR_TOKEN", ""),
+		TokenFile:     flagOrEnv(af.tokenFile, "FHIR_TOKEN_FILE", ""),
+		SMARTClientID: flagOrEnv(af.smartClientID, "FHIR_SMART_CLIENT_ID", ""),
+		SMARTKeyFile:  flagOrEnv(af.smartKey, "FHIR_SMART_KEY_FILE", ""),
+		SMARTKeyID:    flagOrEnv(af.smartKeyID, "FHIR_SMART_KEY_ID", ""),
+		SMARTTokenURL: flagOrEnv(af.smartTokenURL, "FHIR_SMART_TOKEN_URL", ""),
+		SMARTScope:    flagOrEnv(af.smartScope, "FHIR_SMART_SCOPE", "system/Patient.read system/RiskAssessment.write"),
+	}
+}
+
+func flagOrEnv(parsedFlag *string, envVar string, defaultVal string) string {
+	val := *parsedFlag
+	if val == "" {
+		val = os.Getenv(envVar)
+		if val == "" {
+			val = defaultVal
+		}
+	}
+	return val
+}
@@ -0,0 +1,286 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestFHIRAuthSuite(t *testing.T) {
+	suite.Run(t, new(FHIRAuthSuite))
+}
+
+type FHIRAuthSuite struct {
+	suite.Suite
+	Key         *rsa.PrivateKey
+	AuthServer  *httptest.Server
+	FHIRServer  *httptest.Server
+	TokenCount  int32
+	ExpiresIn   int
+	Assertions  []string
+	ValidTokens map[string]bool
+}
+
+func (suite *FHIRAuthSuite) SetupTest() {
+	require := suite.Require()
+
+	var err error
+	suite.Key, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	suite.TokenCount = 0
+	suite.ExpiresIn = 300
+	suite.Assertions = nil
+	suite.ValidTokens = map[string]bool{"static-token-123": true}
+
+	suite.AuthServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_request"}`))
+			return
+		}
+		suite.Assertions = append(suite.Assertions, r.FormValue("client_assertion"))
+		n := atomic.AddInt32(&suite.TokenCount, 1)
+		token := "access-token-" + strconv.Itoa(int(n))
+		suite.ValidTokens[token] = true
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "token_type": "bearer", "expires_in": suite.ExpiresIn})
+	}))
+
+	suite.FHIRServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/smart-configuration" {
+			w.Write([]byte(`{"token_endpoint": "` + suite.AuthServer.URL + `/token"}`))
+			return
+		}
+		if !suite.ValidTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func (suite *FHIRAuthSuite) TearDownTest() {
+	suite.AuthServer.Close()
+	suite.FHIRServer.Close()
+}
+
+func (suite *FHIRAuthSuite) get(c *http.Client) int {
+	res, err := c.Get(suite.FHIRServer.URL + "/Patient")
+	suite.Require().NoError(err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func (suite *FHIRAuthSuite) TestUnauthenticated() {
+	suite.Equal(http.StatusUnauthorized, suite.get(http.DefaultClient))
+}
+
+func (suite *FHIRAuthSuite) TestBearerToken() {
+	c := NewAuthClient(http.DefaultClient, &BearerTokenAuth{Token: "static-token-123"})
+	suite.Equal(http.StatusOK, suite.get(c))
+}
+
+func (suite *FHIRAuthSuite) TestBearerTokenFile() {
+	require := suite.Require()
+
+	f, err := ioutil.TempFile("", "fhir-token")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	f.WriteString("static-token-123\n")
+	f.Close()
+
+	auth, err := NewFHIRAuth(FHIRAuthOptions{TokenFile: f.Name()}, http.DefaultClient, suite.FHIRServer.URL)
+	require.NoError(err)
+	suite.Equal(http.StatusOK, suite.get(NewAuthClient(http.DefaultClient, auth)))
+}
+
+func (suite *FHIRAuthSuite) TestSMARTBackendServices() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	auth := &SMARTBackendAuth{TokenURL: suite.AuthServer.URL + "/token", ClientID: "risk-service", Scope: "system/Patient.read", Key: suite.Key, KeyID: "key-1"}
+	c := NewAuthClient(http.DefaultClient, auth)
+	assert.Equal(http.StatusOK, suite.get(c))
+	assert.Equal(http.StatusOK, suite.get(c))
+	assert.EqualValues(1, suite.TokenCount)
+
+	// Verify the assertion is a valid RS384 JWT with the expected claims
+	require.Len(suite.Assertions, 1)
+	parts := strings.Split(suite.Assertions[0], ".")
+	require.Len(parts, 3)
+	var header, claims map[string]interface{}
+	suite.decodeSegment(parts[0], &header)
+	suite.decodeSegment(parts[1], &claims)
+	assert.Equal("RS384", header["alg"])
+	assert.Equal("key-1", header["kid"])
+	assert.Equal("risk-service", claims["iss"])
+	assert.Equal("risk-service", claims["sub"])
+	assert.Equal(suite.AuthServer.URL+"/token", claims["aud"])
+	assert.NotEmpty(claims["jti"])
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(err)
+	digest := sha512.Sum384([]byte(parts[0] + "." + parts[1]))
+	assert.NoError(rsa.VerifyPKCS1v15(&suite.Key.PublicKey, crypto.SHA384, digest[:], sig))
+
+	// A rejected token is replaced on the next request
+	delete(suite.ValidTokens, "access-token-1")
+	assert.Equal(http.StatusUnauthorized, suite.get(c))
+	assert.Equal(http.StatusOK, suite.get(c))
+	assert.EqualValues(2, suite.TokenCount)
+}
+
+func (suite *FHIRAuthSuite) TestSMARTTokenRefreshedBeforeExpiry() {
+	assert := suite.Assert()
+
+	// Tokens expiring within the margin are replaced on every request
+	suite.ExpiresIn = 30
+	c := NewAuthClient(http.DefaultClient, &SMARTBackendAuth{TokenURL: suite.AuthServer.URL + "/token", ClientID: "risk-service", Key: suite.Key})
+	assert.Equal(http.StatusOK, suite.get(c))
+	assert.Equal(http.StatusOK, suite.get(c))
+	assert.EqualValues(2, suite.TokenCount)
+}
+
+func (suite *FHIRAuthSuite) TestSMARTWithECDSAKey() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	curves := []struct {
+		curve elliptic.Curve
+		alg   string
+		hash  crypto.Hash
+		size  int
+	}{
+		{elliptic.P256(), "ES256", crypto.SHA256, 32},
+		{elliptic.P384(), "ES384", crypto.SHA384, 48},
+		{elliptic.P521(), "ES512", crypto.SHA512, 66},
+	}
+	for i, c := range curves {
+		key, err := ecdsa.GenerateKey(c.curve, rand.Reader)
+		require.NoError(err)
+		auth := &SMARTBackendAuth{TokenURL: suite.AuthServer.URL + "/token", ClientID: "risk-service", Key: key}
+		assert.Equal(http.StatusOK, suite.get(NewAuthClient(http.DefaultClient, auth)))
+
+		parts := strings.Split(suite.Assertions[i], ".")
+		var header map[string]interface{}
+		suite.decodeSegment(parts[0], &header)
+		assert.Equal(c.alg, header["alg"])
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(err)
+		require.Len(sig, 2*c.size)
+		h := c.hash.New()
+		h.Write([]byte(parts[0] + "." + parts[1]))
+		assert.True(ecdsa.Verify(&key.PublicKey, h.Sum(nil), new(big.Int).SetBytes(sig[:c.size]), new(big.Int).SetBytes(sig[c.size:])), c.alg)
+	}
+}
+
+func (suite *FHIRAuthSuite) TestLoadPrivateKeyRejectsUnsupportedCurve() {
+	require := suite.Require()
+
+	key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	require.NoError(err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(err)
+	f, err := ioutil.TempFile("", "smart-key")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	f.Close()
+
+	_, err = LoadPrivateKey(f.Name())
+	require.Error(err)
+	suite.Assert().Contains(err.Error(), "P-224")
+}
+
+func (suite *FHIRAuthSuite) TestNewFHIRAuthDiscoversTokenURL() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	f, err := ioutil.TempFile("", "smart-key")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(suite.Key)})
+	f.Close()
+
+	// The token URL isn't discovered until the first token is requested, so an unavailable FHIR server is fine
+	_, err = NewFHIRAuth(FHIRAuthOptions{SMARTClientID: "risk-service", SMARTKeyFile: f.Name()}, http.DefaultClient, "http://127.0.0.1:1")
+	require.NoError(err)
+
+	auth, err := NewFHIRAuth(FHIRAuthOptions{SMARTClientID: "risk-service", SMARTKeyFile: f.Name()}, http.DefaultClient, suite.FHIRServer.URL)
+	require.NoError(err)
+	smart, ok := auth.(*SMARTBackendAuth)
+	require.True(ok)
+	assert.Empty(smart.TokenURL)
+	assert.Equal(http.StatusOK, suite.get(NewAuthClient(http.DefaultClient, auth)))
+	assert.Equal(suite.AuthServer.URL+"/token", smart.TokenURL)
+}
+
+func (suite *FHIRAuthSuite) TestNewFHIRAuthInvalidOptions() {
+	assert := suite.Assert()
+
+	auth, err := NewFHIRAuth(FHIRAuthOptions{}, http.DefaultClient, suite.FHIRServer.URL)
+	assert.NoError(err)
+	assert.Nil(auth)
+	_, err = NewFHIRAuth(FHIRAuthOptions{Token: "abc", SMARTClientID: "risk-service"}, http.DefaultClient, suite.FHIRServer.URL)
+	assert.Error(err)
+	_, err = NewFHIRAuth(FHIRAuthOptions{SMARTClientID: "risk-service"}, http.DefaultClient, suite.FHIRServer.URL)
+	assert.Error(err)
+}
+
+func (suite *FHIRAuthSuite) TestFHIRAuthFlags() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	defer os.Unsetenv("FHIR_SMART_KEY_ID")
+	os.Setenv("FHIR_SMART_KEY_ID", "key-from-env")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	af := BindFHIRAuthFlags(fs)
+	require.NoError(fs.Parse([]string{"-fhir-smart-client-id", "risk-service", "-fhir-smart-key", "key.pem"}))
+	assert.Equal(FHIRAuthOptions{
+		SMARTClientID: "risk-service",
+		SMARTKeyFile:  "key.pem",
+		SMARTKeyID:    "key-from-env",
+		SMARTScope:    "system/Patient.read system/RiskAssessment.write",
+	}, af.Options())
+}
+
+func (suite *FHIRAuthSuite) TestPatientLookupIsAuthorized() {
+	assert := suite.Assert()
+
+	defer func(c *http.Client) { FHIRClient = c }(FHIRClient)
+	FHIRClient = NewAuthClient(http.DefaultClient, &BearerTokenAuth{Token: "wrong-token-456"})
+	failures := patientMatchFailures.Value(MatchQueryFailed)
+	errors := fhirRequestErrors.Value("patient_search")
+	_, err := findPatientID(context.Background(), suite.FHIRServer.URL, "", "1")
+	assert.Error(err)
+	assert.Contains(err.Error(), "HTTP 401")
+	assert.Equal(failures+1, patientMatchFailures.Value(MatchQueryFailed))
+	assert.Equal(errors+1, fhirRequestErrors.Value("patient_search"))
+}
+
+func (suite *FHIRAuthSuite) decodeSegment(segment string, v interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	suite.Require().NoError(err)
+	suite.Require().NoError(json.Unmarshal(data, v))
+}
@@ -1,136 +1,554 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
 	"sync"
 
 	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/logging"
 	"github.com/intervention-engine/multifactorriskservice/models"
-	"github.com/intervention-engine/riskservice/service"
+	"github.com/intervention-engine/riskservice/plugin"
 )
 
 var m sync.Mutex
 
-// RefreshRiskAssessments pulls the risk assessment data from REDCap and posts it to the FHIR server, replacing older
-// risk assessments and storing pie representations.
-func RefreshRiskAssessments(fhirEndpoint string, redcapEndpoint string, redcapToken string, pieCollection *mgo.Collection, basisPieURL string) ([]Result, error) {
+// RefreshRiskAssessments pulls the risk assessment data from each REDCap project and posts it to the FHIR server,
+// replacing older risk assessments and storing pie representations.  If any records are passed in, only those REDCap
+// records are refreshed.  Records not allowed by a project's filter or failing its validation rules are not imported.
+// Log lines and outbound requests carry the correlation IDs from the context.
+func RefreshRiskAssessments(ctx context.Context, fhirEndpoint string, projects []REDCapProject, pieCollection *mgo.Collection, basisPieURL string, recordIDs ...string) ([]Result, error) {
+	return RefreshRiskAssessmentsWithOptions(ctx, fhirEndpoint, projects, pieCollection, basisPieURL, RefreshOptions{RecordIDs: recordIDs})
+}
+
+// RefreshOptions customizes a refresh
+type RefreshOptions struct {
+	// RecordIDs limits the refresh to the given REDCap records.  If empty, every record is refreshed.
+	RecordIDs []string
+	// Records, if not nil, holds records exported from REDCap (e.g., to a file), which are imported instead of
+	// querying REDCap.  The records are imported as if they were pulled from each project, so Source should name the
+	// project they were exported from if more than one project is refreshed.
+	Records []models.Record
+	// Exclude lists the studies to leave out of the refresh, such as the studies a resumed refresh already processed
+	Exclude []string
+	// Source, if not empty, limits the refresh to the records (RecordIDs or Records) of the project with that name.
+	// The other projects are only queried for the other studies of the patients being refreshed.
+	Source string
+	// Checkpoint, if not nil, is called with the results of the studies as they are processed, so that progress can
+	// be saved before the refresh finishes.  Every result returned from the refresh is passed to Checkpoint once.
+	Checkpoint func([]Result)
+}
+
+// RefreshRiskAssessmentsWithOptions refreshes the risk assessments like RefreshRiskAssessments, using the options to
+// limit the studies refreshed and to checkpoint the refresh's progress.  Since posting replaces all of a patient's risk
+// assessments and pies, a refresh limited by the options still posts every study of the patients it refreshes, from
+// every project.
+func RefreshRiskAssessmentsWithOptions(ctx context.Context, fhirEndpoint string, projects []REDCapProject, pieCollection *mgo.Collection, basisPieURL string, opts RefreshOptions) ([]Result, error) {
 	m.Lock()
 	defer m.Unlock()
-	studies, err := GetREDCapData(redcapEndpoint, redcapToken)
+	data := make([]ProjectData, len(projects))
+	for i := range projects {
+		if opts.Source != "" && projects[i].Name != opts.Source {
+			data[i] = ProjectData{Project: projects[i], Studies: models.StudyMap{}}
+			continue
+		}
+		var studies models.StudyMap
+		var err error
+		if opts.Records != nil {
+			studies, err = projects[i].ToStudies(opts.Records)
+		} else {
+			studies, err = GetProjectData(ctx, projects[i], opts.RecordIDs...)
+		}
+		if err != nil && ctx.Err() != nil {
+			return nil, &InterruptedError{Err: ctx.Err()}
+		} else if err != nil {
+			if projects[i].Name != "" {
+				return nil, fmt.Errorf("Couldn't get data from REDCap project %s: %s", projects[i].Name, err)
+			}
+			return nil, err
+		}
+		for _, id := range opts.Exclude {
+			delete(studies, id)
+		}
+		data[i] = ProjectData{Project: projects[i], Studies: studies}
+	}
+	var complete []REDCapProject
+	if len(opts.RecordIDs) > 0 || opts.Records != nil || len(opts.Exclude) > 0 || opts.Source != "" {
+		complete = projects
+	}
+	results, pending := postProjectRiskAssessments(ctx, fhirEndpoint, data, complete, pieCollection, basisPieURL, opts.Checkpoint)
+	if len(pending) > 0 {
+		return results, &InterruptedError{Pending: pending, Err: ctx.Err()}
+	}
+	return results, nil
+}
+
+// InterruptedError is returned when a refresh is cancelled (e.g., at shutdown) before every study was processed.
+// Studies are never interrupted partway, so the results returned with the error cover the studies that were
+// processed, and Pending lists the IDs of the studies that weren't.  If Pending is empty, nothing was processed.
+type InterruptedError struct {
+	Pending []string
+	Err     error
+}
+
+func (e *InterruptedError) Error() string {
+	if len(e.Pending) > 0 {
+		return fmt.Sprintf("Refresh interrupted with %d studies pending: %s", len(e.Pending), e.Err)
+	}
+	return fmt.Sprintf("Refresh interrupted: %s", e.Err)
+}
+
+// GetREDCapData queries REDCap at the specified endpoint with the specifed token, returning a StudyMap containing
+// the resulting data.  If any records are passed in, only those REDCap records are requested.
+func GetREDCapData(endpoint string, token string, recordIDs ...string) (models.StudyMap, error) {
+	records, err := getREDCapRecords(context.Background(), REDCapProject{Endpoint: endpoint, Token: token}, recordIDs...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(models.StudyMap)
+	if err := m.AddRecords(records); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// GetProjectData queries the REDCap project, returning a StudyMap containing the resulting data.  Records not allowed
+// by the project's filter or failing its validation rules are noted in the studies instead.  If any records are passed
+// in, only those REDCap records are requested.
+func GetProjectData(ctx context.Context, project REDCapProject, recordIDs ...string) (models.StudyMap, error) {
+	records, err := getREDCapRecords(ctx, project, recordIDs...)
 	if err != nil {
 		return nil, err
 	}
-	return PostRiskAssessments(fhirEndpoint, studies, pieCollection, basisPieURL), nil
+	return project.ToStudies(records)
 }
 
-// GetREDCapData queries REDCap at the specified endpoint with the specifed token, returning a StudyMap containing
-// the resulting data.
-func GetREDCapData(endpoint string, token string) (models.StudyMap, error) {
+func getREDCapRecords(ctx context.Context, project REDCapProject, recordIDs ...string) ([]models.Record, error) {
 	form := url.Values{}
-	form.Set("token", token)
 	form.Set("content", "record")
 	form.Set("format", "json")
 	form.Set("returnFormat", "json")
 	form.Set("type", "flat")
-	form.Set("fields", "study_id, redcap_event_name, rf_date, rf_cmc_risk_cat, rf_func_risk_cat, rf_sb_risk_cat, rf_util_risk_cat, rf_risk_predicted")
-
-	if !strings.HasSuffix(endpoint, "/") {
-		endpoint += "/"
+	form.Set("fields", strings.Join(project.Fields.ProjectFields(), ", "))
+	for i, id := range recordIDs {
+		form.Set(fmt.Sprintf("records[%d]", i), id)
 	}
-	res, err := http.DefaultClient.PostForm(endpoint, form)
+
+	res, err := postREDCap(ctx, project, form)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
-	var records []models.Record
-	decoder := json.NewDecoder(res.Body)
-	if err := decoder.Decode(&records); err != nil {
+	records, err := project.Fields.DecodeRecords(res.Body)
+	return records, RedactError(err)
+}
+
+// REDCapProjectInfo represents the project information returned by the REDCap API
+type REDCapProjectInfo struct {
+	ProjectID    json.Number `json:"project_id"`
+	ProjectTitle string      `json:"project_title"`
+	InProduction json.Number `json:"in_production"`
+}
+
+// GetREDCapProjectInfo requests the project information from REDCap, which verifies that the project's current token
+// is valid
+func GetREDCapProjectInfo(project REDCapProject) (*REDCapProjectInfo, error) {
+	form := url.Values{}
+	form.Set("content", "project")
+	form.Set("format", "json")
+	form.Set("returnFormat", "json")
+
+	res, err := postREDCap(context.Background(), project, form)
+	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
-	m := make(models.StudyMap)
-	if err := m.AddRecords(records); err != nil {
-		return nil, err
+	info := new(REDCapProjectInfo)
+	if err := json.NewDecoder(res.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("Couldn't decode REDCap project information: %s", RedactError(err))
 	}
+	return info, nil
+}
 
-	return m, nil
+// GetREDCapVersion requests the REDCap version, which verifies that REDCap is reachable and accepts the project's
+// current token
+func GetREDCapVersion(project REDCapProject) (string, error) {
+	form := url.Values{}
+	form.Set("content", "version")
+	form.Set("format", "json")
+
+	res, err := postREDCap(context.Background(), project, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	version, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", RedactError(err)
+	}
+	return strings.TrimSpace(string(version)), nil
+}
+
+// postREDCap posts the form to the project's REDCap API using the project's current token.  Errors never contain the
+// token, and if REDCap responds with an error status, the error message returned by REDCap is included.  The refresh
+// job ID in the context is sent as the correlation ID.
+func postREDCap(ctx context.Context, project REDCapProject, form url.Values) (*http.Response, error) {
+	endpoint := project.Endpoint
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+	form.Set("token", project.APIToken())
+	content := form.Get("content")
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, RedactError(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id := logging.JobID(ctx); id != "" {
+		req.Header.Set(logging.CorrelationIDHeader, id)
+	}
+	start := time.Now()
+	res, err := REDCapClient.Do(req)
+	redcapRequestDuration.Observe(time.Since(start).Seconds(), content)
+	if err != nil || res.StatusCode != http.StatusOK {
+		redcapRequestErrors.Inc(content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't post %s to REDCap: %s", RedactValues(form).Encode(), RedactError(err))
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		var redcapErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&redcapErr)
+		if redcapErr.Error == "" {
+			redcapErr.Error = res.Status
+		}
+		return nil, fmt.Errorf("Received HTTP %d from REDCap: %s", res.StatusCode, Redact(redcapErr.Error))
+	}
+	return res, nil
+}
+
+// ProjectData holds the studies imported from a REDCap project
+type ProjectData struct {
+	Project REDCapProject
+	Studies models.StudyMap
 }
 
 // PostRiskAssessments posts the risk assessments from the studies to the FHIR server and also stores the risk pies
 // to the local Mongo database
 func PostRiskAssessments(fhirEndpoint string, studies models.StudyMap, pieCollection *mgo.Collection, basisPieURL string) []Result {
-	results := make([]Result, 0, len(studies))
-	for _, study := range studies {
-		result := Result{
-			StudyID: study.ID,
+	return PostProjectRiskAssessments(context.Background(), fhirEndpoint, []ProjectData{{Studies: studies}}, pieCollection, basisPieURL)
+}
+
+// PostProjectRiskAssessments posts the risk assessments from the studies of each project to the FHIR server and also
+// stores the risk pies to the local Mongo database.  Since posting replaces all of a patient's risk assessments and
+// pies, the assessments for a patient found in more than one project are combined and posted together.
+func PostProjectRiskAssessments(ctx context.Context, fhirEndpoint string, data []ProjectData, pieCollection *mgo.Collection, basisPieURL string) []Result {
+	results, _ := postProjectRiskAssessments(ctx, fhirEndpoint, data, nil, pieCollection, basisPieURL, nil)
+	return results
+}
+
+// postProjectRiskAssessments posts the risk assessments like PostProjectRiskAssessments, but stops if the context is
+// cancelled, returning the IDs of the studies that weren't processed.  The study or patient being processed when the
+// context is cancelled is finished first, so a patient is never left with its old risk assessments deleted and its new
+// pies missing.  If complete is not nil, the data only holds some of the studies, so the other studies of each patient
+// are found in the complete projects and posted along with them.  If checkpoint is not nil, it is called with the
+// results of each study that couldn't be matched to a patient, and with the results of each patient's studies once
+// they are posted.
+func postProjectRiskAssessments(ctx context.Context, fhirEndpoint string, data []ProjectData, complete []REDCapProject, pieCollection *mgo.Collection, basisPieURL string, checkpoint func([]Result)) ([]Result, []string) {
+	var results []Result
+	var pending []string
+	updates := make(map[string]*patientUpdate)
+	var patientIDs []string
+
+	// add gets the risk assessments from the study's records, to be posted once all of the patient's studies are
+	// known.  The record each pie came from is kept so that it can be stored with the pie.
+	add := func(project REDCapProject, study *models.Study, result Result, patientID string) {
+		update, ok := updates[patientID]
+		if !ok {
+			update = &patientUpdate{sources: make(map[bson.ObjectId]PieSource), studies: make(map[string]bool)}
+			updates[patientID] = update
+			patientIDs = append(patientIDs, patientID)
 		}
-		// Query the FHIR server to find the patient ID by the Study ID (often the MRN)
-		r, err := http.NewRequest("GET", fhirEndpoint+"/Patient?identifier="+study.ID, nil)
-		if err != nil {
-			result.Error = fmt.Errorf("Couldn't create HTTP request for querying patient with Study ID: %s.  Error: %s", study.ID, err.Error())
-			results = append(results, result)
+		update.studies[project.Name+"|"+study.ID] = true
+		result.FHIRPatientID = patientID
+		for i := range study.Records {
+			calcResult, err := study.Records[i].ToRiskServiceCalculationResult(fhirEndpoint + "/Patient/" + patientID)
+			if err != nil {
+				continue
+			}
+			update.calcResults = append(update.calcResults, *calcResult)
+			source := PieSource{StudyID: study.ID, Event: study.Records[i].EventName, Source: project.Name}
+			if perceived, err := strconv.Atoi(study.Records[i].PerceivedRisk); err == nil {
+				source.PerceivedRisk = &perceived
+			}
+			update.sources[calcResult.Pie.Id] = source
+			result.RiskAssessmentCount++
+		}
+		update.resultIndexes = append(update.resultIndexes, len(results))
+		results = append(results, result)
+	}
+
+	for _, d := range data {
+		for _, study := range d.Studies {
+			if ctx.Err() != nil {
+				pending = append(pending, study.ID)
+				continue
+			}
+			studiesProcessed.Inc(d.Project.Name)
+			result := Result{
+				StudyID: study.ID,
+				Source:  d.Project.Name,
+				Skipped: study.SkippedCounts(),
+				Invalid: study.Invalid,
+			}
+			// Query the FHIR server to find the patient ID by the Study ID (often the MRN)
+			studyCtx := logging.WithStudyID(context.WithoutCancel(ctx), study.ID)
+			for _, invalid := range study.Invalid {
+				slog.WarnContext(studyCtx, "Dropped invalid REDCap record", "source", d.Project.Name,
+					"event", invalid.Record.EventName, "errors", fmt.Sprint(invalid.Errors))
+			}
+			patientID, err := findPatientID(studyCtx, fhirEndpoint, d.Project.IdentifierSystem, study.ID)
+			if err != nil {
+				slog.WarnContext(studyCtx, "Couldn't match study to a FHIR patient", "source", d.Project.Name, "error", err)
+				result.Error = err
+				results = append(results, result)
+				if checkpoint != nil {
+					checkpoint([]Result{result})
+				}
+				continue
+			}
+			add(d.Project, study, result, patientID)
+		}
+	}
+	if complete != nil && ctx.Err() == nil {
+		completeStudies(ctx, fhirEndpoint, complete, updates, patientIDs, add)
+	}
+
+	// Post the risk assessments to the FHIR server and update pies in Mongo
+	unposted := make(map[int]bool)
+	for _, patientID := range patientIDs {
+		update := updates[patientID]
+		if ctx.Err() != nil {
+			for _, i := range update.resultIndexes {
+				unposted[i] = true
+				pending = append(pending, results[i].StudyID)
+			}
 			continue
 		}
-		r.Header.Set("Accept", "application/json")
-		res, err := http.DefaultClient.Do(r)
+		plugin.SortResultsByAsOfDate(update.calcResults)
+		patientCtx := logging.WithPatientID(context.WithoutCancel(ctx), patientID)
+		err := update.err
+		if err == nil {
+			err = updateRiskAssessmentsAndPies(patientCtx, fhirEndpoint, patientID, update.calcResults, update.sources, pieCollection, basisPieURL, REDCapRiskServiceConfig)
+		}
+		for _, i := range update.resultIndexes {
+			studyCtx := logging.WithStudyID(patientCtx, results[i].StudyID)
+			if err != nil {
+				slog.ErrorContext(studyCtx, "Couldn't post risk assessments", "source", results[i].Source, "error", err)
+				results[i].Error = err
+				results[i].RiskAssessmentCount = 0
+			} else {
+				slog.DebugContext(studyCtx, "Posted risk assessments", "source", results[i].Source, "risk_assessments", results[i].RiskAssessmentCount)
+			}
+		}
+		if checkpoint != nil {
+			posted := make([]Result, len(update.resultIndexes))
+			for j, i := range update.resultIndexes {
+				posted[j] = results[i]
+			}
+			checkpoint(posted)
+		}
+	}
+
+	if len(unposted) > 0 {
+		posted := make([]Result, 0, len(results)-len(unposted))
+		for i := range results {
+			if !unposted[i] {
+				posted = append(posted, results[i])
+			}
+		}
+		results = posted
+	}
+	return results, pending
+}
+
+// patientUpdate collects the risk assessments to post for a patient, along with the results they belong to and the
+// records their pies came from
+type patientUpdate struct {
+	resultIndexes []int
+	calcResults   []plugin.RiskServiceCalculationResult
+	sources       map[bson.ObjectId]PieSource
+	// studies holds the project name and ID of each of the patient's studies, separated by "|"
+	studies map[string]bool
+	// err, if not nil, prevents the update from being posted, since the patient's other studies couldn't be found
+	err error
+}
+
+// completeStudies adds the studies in the projects that belong to the patients being updated, but aren't among their
+// studies yet, so that posting the updates doesn't delete the risk assessments and pies from those studies.  A
+// patient's other studies are found by the identifiers on the FHIR patient matching each project's identifier system
+// (or by every identifier, for a project without one), and must be matched back to the patient.  If a patient's other
+// studies can't be looked up, its update fails instead.
+func completeStudies(ctx context.Context, fhirEndpoint string, projects []REDCapProject, updates map[string]*patientUpdate, patientIDs []string, add func(REDCapProject, *models.Study, Result, string)) {
+	// The candidate study IDs in each project, along with the patients they may belong to
+	candidates := make([]map[string][]string, len(projects))
+	for i := range projects {
+		candidates[i] = make(map[string][]string)
+	}
+	for _, patientID := range patientIDs {
+		update := updates[patientID]
+		identifiers, err := getPatientIdentifiers(logging.WithPatientID(ctx, patientID), fhirEndpoint, patientID)
 		if err != nil {
-			result.Error = fmt.Errorf("Couldn't query FHIR server for patient with Study ID: %s.  Error: %s", study.ID, err.Error())
-			results = append(results, result)
+			update.err = fmt.Errorf("Couldn't look up the patient's studies in other projects: %s", err)
 			continue
 		}
-		defer res.Body.Close()
-		if res.StatusCode != http.StatusOK {
-			result.Error = fmt.Errorf("Received HTTP %d %s from FHIR server when querying patient with Study ID: %s.", res.StatusCode, res.Status, study.ID)
-			results = append(results, result)
-			continue
+		for i, project := range projects {
+			for _, identifier := range identifiers {
+				if identifier.Value == "" || (project.IdentifierSystem != "" && identifier.System != project.IdentifierSystem) {
+					continue
+				}
+				if !update.studies[project.Name+"|"+identifier.Value] {
+					candidates[i][identifier.Value] = append(candidates[i][identifier.Value], patientID)
+				}
+			}
 		}
-		var patients fhir.Bundle
-		decoder := json.NewDecoder(res.Body)
-		if err := decoder.Decode(&patients); err != nil {
-			result.Error = fmt.Errorf("Couldn't properly decode results from patient query with Study ID: %s.  Error: %s", study.ID, err.Error())
-			results = append(results, result)
+	}
+
+	for i, project := range projects {
+		if len(candidates[i]) == 0 {
 			continue
 		}
-		if len(patients.Entry) == 0 {
-			result.Error = fmt.Errorf("Couldn't find patient with Study ID %s", study.ID)
-			results = append(results, result)
-			continue
-		} else if len(patients.Entry) > 1 {
-			result.Error = fmt.Errorf("Found too many patients (%d) with Study ID %s", len(patients.Entry), study.ID)
-			results = append(results, result)
-			continue
+		recordIDs := make([]string, 0, len(candidates[i]))
+		for id := range candidates[i] {
+			recordIDs = append(recordIDs, id)
 		}
-		patientID := patients.Entry[0].Resource.(*fhir.Patient).Id
-		result.FHIRPatientID = patientID
-
-		// Get the risk assessments from the records, post to FHIR server, and update pies in Mongo
-		calcResults := study.ToRiskServiceCalculationResults(fhirEndpoint + "/Patient/" + patientID)
-		err = service.UpdateRiskAssessmentsAndPies(fhirEndpoint, patientID, calcResults, pieCollection, basisPieURL, REDCapRiskServiceConfig)
+		sort.Strings(recordIDs)
+		studies, err := GetProjectData(ctx, project, recordIDs...)
 		if err != nil {
-			result.Error = err
-		} else {
-			result.RiskAssessmentCount = len(calcResults)
+			for _, owners := range candidates[i] {
+				for _, patientID := range owners {
+					updates[patientID].err = fmt.Errorf("Couldn't get the patient's studies from REDCap project %s: %s", project.Name, err)
+				}
+			}
+			continue
+		}
+		for _, id := range recordIDs {
+			study, ok := studies[id]
+			if !ok {
+				continue
+			}
+			studyCtx := logging.WithStudyID(context.WithoutCancel(ctx), study.ID)
+			patientID, err := findPatientID(studyCtx, fhirEndpoint, project.IdentifierSystem, study.ID)
+			if err != nil {
+				// A full refresh couldn't post the study either, so the patient's update is still complete without it
+				slog.WarnContext(studyCtx, "Couldn't match study to a FHIR patient", "source", project.Name, "error", err)
+				continue
+			}
+			update, ok := updates[patientID]
+			if !ok || update.studies[project.Name+"|"+study.ID] {
+				continue
+			}
+			studiesProcessed.Inc(project.Name)
+			add(project, study, Result{
+				StudyID: study.ID,
+				Source:  project.Name,
+				Skipped: study.SkippedCounts(),
+				Invalid: study.Invalid,
+			}, patientID)
 		}
-		results = append(results, result)
 	}
+}
 
-	return results
+// getPatientIdentifiers reads the patient from the FHIR server, returning its identifiers
+func getPatientIdentifiers(ctx context.Context, fhirEndpoint, patientID string) ([]fhir.Identifier, error) {
+	r, err := http.NewRequest("GET", fhirEndpoint+"/Patient/"+url.PathEscape(patientID), nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Accept", "application/json")
+	res, err := doFHIR(ctx, "patient_read", r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received HTTP %d from FHIR server when reading patient %s", res.StatusCode, patientID)
+	}
+	var patient fhir.Patient
+	if err := json.NewDecoder(res.Body).Decode(&patient); err != nil {
+		return nil, fmt.Errorf("Couldn't decode patient %s: %s", patientID, err)
+	}
+	return patient.Identifier, nil
+}
+
+// findPatientID queries the FHIR server for the ID of the patient with an identifier matching the study ID.  If the
+// identifier system is not empty, the identifier must also have that system.
+func findPatientID(ctx context.Context, fhirEndpoint, identifierSystem, studyID string) (string, error) {
+	identifier := studyID
+	if identifierSystem != "" {
+		identifier = identifierSystem + "|" + studyID
+	}
+	r, err := http.NewRequest("GET", fhirEndpoint+"/Patient?identifier="+url.QueryEscape(identifier), nil)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create HTTP request for querying patient with Study ID: %s.  Error: %s", studyID, err.Error())
+	}
+	r.Header.Set("Accept", "application/json")
+	res, err := doFHIR(ctx, "patient_search", r)
+	if err != nil {
+		patientMatchFailures.Inc(MatchQueryFailed)
+		return "", fmt.Errorf("Couldn't query FHIR server for patient with Study ID: %s.  Error: %s", studyID, err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		patientMatchFailures.Inc(MatchQueryFailed)
+		return "", fmt.Errorf("Received HTTP %d %s from FHIR server when querying patient with Study ID: %s.", res.StatusCode, res.Status, studyID)
+	}
+	var patients fhir.Bundle
+	decoder := json.NewDecoder(res.Body)
+	if err := decoder.Decode(&patients); err != nil {
+		patientMatchFailures.Inc(MatchQueryFailed)
+		return "", fmt.Errorf("Couldn't properly decode results from patient query with Study ID: %s.  Error: %s", studyID, err.Error())
+	}
+	if len(patients.Entry) == 0 {
+		patientMatchFailures.Inc(MatchNotFound)
+		return "", fmt.Errorf("Couldn't find patient with Study ID %s", studyID)
+	} else if len(patients.Entry) > 1 {
+		patientMatchFailures.Inc(MatchMultiple)
+		return "", fmt.Errorf("Found too many patients (%d) with Study ID %s", len(patients.Entry), studyID)
+	}
+	return patients.Entry[0].Resource.(*fhir.Patient).Id, nil
 }
 
 // Result represents the result (successful or not) of posting REDCap risk assessments to a FHIR server
 type Result struct {
 	StudyID             string
+	Source              string
 	FHIRPatientID       string
 	RiskAssessmentCount int
+	Skipped             map[string]int
+	Invalid             []models.InvalidRecord
 	Error               error
 }
 
@@ -141,28 +559,39 @@ func (r *Result) MarshalJSON() ([]byte, error) {
 		errString = r.Error.Error()
 	}
 	return json.Marshal(&struct {
-		StudyID             string `json:"studyID,omitempty"`
-		FHIRPatientID       string `json:"fhirPatientID,omitempty"`
-		RiskAssessmentCount int    `json:"riskAssessmentCount"`
-		Error               string `json:"error,omitempty"`
+		StudyID             string                 `json:"studyID,omitempty"`
+		Source              string                 `json:"source,omitempty"`
+		FHIRPatientID       string                 `json:"fhirPatientID,omitempty"`
+		RiskAssessmentCount int                    `json:"riskAssessmentCount"`
+		Skipped             map[string]int         `json:"skipped,omitempty"`
+		Invalid             []models.InvalidRecord `json:"invalid,omitempty"`
+		Error               string                 `json:"error,omitempty"`
 	}{
 		StudyID:             r.StudyID,
+		Source:              r.Source,
 		FHIRPatientID:       r.FHIRPatientID,
 		RiskAssessmentCount: r.RiskAssessmentCount,
+		Skipped:             r.Skipped,
+		Invalid:             r.Invalid,
 		Error:               errString,
 	})
 }
 
-// LogResultSummary prints out a log of the result summary (# patients, # errors, # assessments)
-func LogResultSummary(results []Result) {
+// LogResultSummary prints out a log of the result summary (# patients, # errors, # assessments, # skipped records,
+// # invalid records)
+func LogResultSummary(ctx context.Context, results []Result) {
 	// Log out some information
-	var numErrors, numAssessments int
+	var numErrors, numAssessments, numSkipped, numInvalid int
 	for _, result := range results {
 		if result.Error != nil {
 			numErrors++
 		}
 		numAssessments += result.RiskAssessmentCount
+		for _, count := range result.Skipped {
+			numSkipped += count
+		}
+		numInvalid += len(result.Invalid)
 	}
-	log.Printf("Refreshed risk assessments for %d patients: %d errors, %d risk assessments.",
-		len(results), numErrors, numAssessments)
+	slog.InfoContext(ctx, "Refreshed risk assessments", "patients", len(results), "errors", numErrors,
+		"risk_assessments", numAssessments, "skipped_records", numSkipped, "invalid_records", numInvalid)
 }
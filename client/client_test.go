@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestClientSuite(t *testing.T) {
+	suite.Run(t, new(ClientSuite))
+}
+
+type ClientSuite struct {
+	suite.Suite
+}
+
+func (suite *ClientSuite) TestRefreshInterruptedBeforeREDCap() {
+	require := suite.Require()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Fail("REDCap shouldn't be queried after the refresh is cancelled")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := RefreshRiskAssessments(ctx, "http://fhir", []REDCapProject{{Endpoint: server.URL, Token: "123456789"}}, nil, "http://example.org/pies")
+	require.IsType(&InterruptedError{}, err)
+	suite.Empty(err.(*InterruptedError).Pending)
+	suite.Empty(results)
+}
+
+func (suite *ClientSuite) TestPostInterruptedAfterStudy() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// The refresh is cancelled while the first study's patient is being looked up
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var searches int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searches++
+		cancel()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"resourceType": "Bundle", "entry": [{"resource": {"resourceType": "Patient", "id": "p1"}}]}`))
+	}))
+	defer server.Close()
+
+	studies := models.StudyMap{
+		"1": &models.Study{ID: "1"},
+		"2": &models.Study{ID: "2"},
+		"3": &models.Study{ID: "3"},
+	}
+	results, pending := postProjectRiskAssessments(ctx, server.URL, []ProjectData{{Studies: studies}}, nil, nil, "http://example.org/pies", nil)
+
+	// The first study's lookup finished, but its patient wasn't posted, so every study is still pending
+	assert.Equal(1, searches)
+	assert.Empty(results)
+	sort.Strings(pending)
+	require.Equal([]string{"1", "2", "3"}, pending)
+}
+
+func (suite *ClientSuite) TestRefreshImportedRecords() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	redcap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Fail("REDCap shouldn't be queried when importing records")
+	}))
+	defer redcap.Close()
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"resourceType": "Bundle", "entry": []}`))
+	}))
+	defer fhirServer.Close()
+
+	// The incomplete record is dropped by the project's filter, just as if it were pulled from REDCap
+	project := REDCapProject{Name: "A", Endpoint: redcap.URL, Filter: models.RecordFilter{MinFormStatus: models.FormComplete}}
+	records := []models.Record{
+		{StudyID: "1", EventName: "initial_arm_1", RiskFactorDate: "2016-01-01", ClinicalRisk: "1", FunctionalRisk: "1",
+			PsychosocialRisk: "1", UtilizationRisk: "1", PerceivedRisk: "1", RiskFactorsComplete: "2"},
+		{StudyID: "1", EventName: "visit1_arm_1", RiskFactorDate: "2016-02-01", RiskFactorsComplete: "0"},
+	}
+	results, err := RefreshRiskAssessmentsWithOptions(context.Background(), fhirServer.URL, []REDCapProject{project}, nil, "http://example.org/pies", RefreshOptions{Records: records})
+	require.NoError(err)
+	require.Len(results, 1)
+	assert.Equal("1", results[0].StudyID)
+	assert.Equal("A", results[0].Source)
+	assert.Equal(map[string]int{models.SkipFormStatus: 1}, results[0].Skipped)
+	assert.Error(results[0].Error)
+}
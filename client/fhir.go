@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CheckFHIRServer requests the FHIR server's capability statement (/metadata), returning an error if the server
+// doesn't respond successfully
+func CheckFHIRServer(fhirEndpoint string) error {
+	req, err := http.NewRequest("GET", fhirEndpoint+"/metadata", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := doFHIR(context.Background(), "metadata", req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Received HTTP %d %s from FHIR server metadata", res.StatusCode, res.Status)
+	}
+	return nil
+}
+
+// UpdateRiskAssessmentsAndPies removes the patient's existing risk assessments from the FHIR server and replaces them
+// with new ones, then replaces the patient's pies in the Mongo database.  It follows the riskservice package's
+// UpdateRiskAssessmentsAndPies, but posts using the FHIRClient so that its TLS and auth configuration is honored, and
+// sends the refresh job ID in the context as the correlation ID.
+func UpdateRiskAssessmentsAndPies(ctx context.Context, fhirEndpoint string, patientID string, results []plugin.RiskServiceCalculationResult, pieCollection *mgo.Collection, basisPieURL string, config plugin.RiskServicePluginConfig) error {
+	return updateRiskAssessmentsAndPies(ctx, fhirEndpoint, patientID, results, nil, pieCollection, basisPieURL, config)
+}
+
+// PieSource describes the REDCap record a pie was created from, including the record's perceived risk (which isn't
+// one of the pie's slices).  It is stored with the pie, along with the pie's assessment date, so that pies can be
+// reported on and exported by date, event, and source project.
+type PieSource struct {
+	StudyID       string `bson:"studyID,omitempty"`
+	Event         string `bson:"event,omitempty"`
+	Source        string `bson:"source,omitempty"`
+	PerceivedRisk *int   `bson:"perceivedRisk,omitempty"`
+}
+
+// updateRiskAssessmentsAndPies updates the risk assessments and pies like UpdateRiskAssessmentsAndPies, storing each
+// pie with its source record, looked up by pie ID
+func updateRiskAssessmentsAndPies(ctx context.Context, fhirEndpoint string, patientID string, results []plugin.RiskServiceCalculationResult, sources map[bson.ObjectId]PieSource, pieCollection *mgo.Collection, basisPieURL string, config plugin.RiskServicePluginConfig) error {
+	// Submit the bundle deleting the old risk assessments and adding the new ones
+	data, err := json.Marshal(buildRiskAssessmentBundle(patientID, results, basisPieURL, config))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fhirEndpoint, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := doFHIR(ctx, "transaction", req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Risk assessments did not post properly.  Received response code: %d", res.StatusCode)
+	}
+	riskAssessmentsPosted.Add(float64(len(results)))
+
+	// Delete the old pies
+	method := config.Method.Coding[0]
+	pieCollection.RemoveAll(bson.M{
+		"patient":       fhirEndpoint + "/Patient/" + patientID,
+		"method.coding": bson.M{"$elemMatch": bson.M{"system": method.System, "code": method.Code}},
+	})
+
+	// Store the new pies along with their method (to identify by patient and method), assessment date, and source
+	for i := range results {
+		pieWithMethod := struct {
+			plugin.Pie `bson:",inline"`
+			Method     *fhir.CodeableConcept `bson:"method"`
+			AsOf       time.Time             `bson:"asOf"`
+			PieSource  `bson:",inline"`
+		}{
+			*results[i].Pie,
+			&config.Method,
+			results[i].AsOf,
+			sources[results[i].Pie.Id],
+		}
+		if err = pieCollection.Insert(&pieWithMethod); err != nil {
+			return err
+		}
+		piesStored.Inc()
+	}
+	return nil
+}
+
+// buildRiskAssessmentBundle builds the transaction bundle deleting all of the patient's risk assessments using the
+// config's method and adding the new ones, with the most recent one tagged as such
+func buildRiskAssessmentBundle(patientID string, results []plugin.RiskServiceCalculationResult, basisPieURL string, config plugin.RiskServicePluginConfig) *fhir.Bundle {
+	params := url.Values{}
+	params.Set("method", config.Method.Coding[0].System+"|"+config.Method.Coding[0].Code)
+	params.Set("patient", patientID)
+
+	bundle := &fhir.Bundle{}
+	bundle.Type = "transaction"
+	bundle.Entry = make([]fhir.BundleEntryComponent, len(results)+1)
+	bundle.Entry[0].Request = &fhir.BundleEntryRequestComponent{
+		Method: "DELETE",
+		Url:    "RiskAssessment?" + params.Encode(),
+	}
+	for i := range results {
+		bundle.Entry[i+1].Request = &fhir.BundleEntryRequestComponent{
+			Method: "POST",
+			Url:    "RiskAssessment",
+		}
+		ra := results[i].ToRiskAssessment(patientID, basisPieURL, config)
+		if i+1 == len(results) {
+			ra.Meta = &fhir.Meta{
+				Tag: []fhir.Coding{{System: "http://interventionengine.org/tags/", Code: "MOST_RECENT"}},
+			}
+		}
+		bundle.Entry[i+1].Resource = ra
+	}
+	return bundle
+}
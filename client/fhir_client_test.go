@@ -130,6 +130,11 @@ func (suite *FHIRClientSuite) TestPostRiskAssessments() {
 	require.NoError(err)
 	assert.Equal(count, 3)
 
+	// Check the pies are stored with their assessment date and source record
+	count, err = piesCollection.Find(bson.M{"studyID": "1", "event": "visit1_arm_1", "asOf": bson.M{"$exists": true}}).Count()
+	require.NoError(err)
+	assert.Equal(1, count)
+
 	// Get the risk assessments
 	var ras []fhir.RiskAssessment
 	err = raCollection.Find(bson.M{"method.coding.code": "MultiFactor"}).Sort("date.time").All(&ras)
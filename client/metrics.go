@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/metrics"
+)
+
+// Reasons a study could not be matched to a FHIR patient
+const (
+	MatchNotFound    = "not_found"
+	MatchMultiple    = "multiple_patients"
+	MatchQueryFailed = "query_failed"
+)
+
+var (
+	redcapRequestDuration = metrics.NewHistogramVec("riskservice_redcap_request_duration_seconds",
+		"Latency of REDCap API requests by content type.", nil, "content")
+	redcapRequestErrors = metrics.NewCounterVec("riskservice_redcap_request_errors_total",
+		"REDCap API requests that failed or returned an error status, by content type.", "content")
+	fhirRequestDuration = metrics.NewHistogramVec("riskservice_fhir_request_duration_seconds",
+		"Latency of FHIR server requests by operation.", nil, "operation")
+	fhirRequestErrors = metrics.NewCounterVec("riskservice_fhir_request_errors_total",
+		"FHIR server requests that failed or returned an error status, by operation.", "operation")
+	studiesProcessed = metrics.NewCounterVec("riskservice_studies_processed_total",
+		"Studies imported from REDCap, by project.", "source")
+	patientMatchFailures = metrics.NewCounterVec("riskservice_patient_match_failures_total",
+		"Studies that couldn't be matched to a FHIR patient, by reason.", "reason")
+	riskAssessmentsPosted = metrics.NewCounterVec("riskservice_risk_assessments_posted_total",
+		"Risk assessments posted to the FHIR server.")
+	piesStored = metrics.NewCounterVec("riskservice_pies_stored_total",
+		"Risk pies stored in Mongo.")
+)
+
+// doFHIR sends the request using the FHIRClient with the refresh job ID in the context as the correlation ID, recording
+// its latency and whether it failed
+func doFHIR(ctx context.Context, operation string, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	if id := logging.JobID(ctx); id != "" {
+		req.Header.Set(logging.CorrelationIDHeader, id)
+	}
+	start := time.Now()
+	res, err := FHIRClient.Do(req)
+	fhirRequestDuration.Observe(time.Since(start).Seconds(), operation)
+	if err != nil || res.StatusCode >= http.StatusBadRequest {
+		fhirRequestErrors.Inc(operation)
+	}
+	return res, err
+}
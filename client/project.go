@@ -0,0 +1,215 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// REDCapProject describes a REDCap project that risk assessments are imported from, along with the configuration
+// determining which of its records are imported and how they are matched to FHIR patients
+type REDCapProject struct {
+	// Name identifies the project in results and logs
+	Name string
+	// ProjectID is the REDCap project ID, sent by REDCap with data entry triggers
+	ProjectID string
+	Endpoint  string
+	// Token is the REDCap API token.  It is ignored if TokenFile is set.
+	Token string
+	// TokenFile, if set, holds the REDCap API token, which is reloaded when the file is rotated
+	TokenFile *SecretFile
+	// TriggerToken is the shared secret REDCap must pass as the token query parameter of the data entry trigger URL.
+	// Data entry triggers are rejected if neither it nor TriggerTokenFile is set.  It is ignored if TriggerTokenFile is
+	// set.
+	TriggerToken string
+	// TriggerTokenFile, if set, holds the data entry trigger token, which is reloaded when the file is rotated
+	TriggerTokenFile *SecretFile
+	// IdentifierSystem is the system of the patient identifier matching the study ID.  If empty, patients are matched
+	// on the identifier value alone.
+	IdentifierSystem string
+	Fields           models.FieldMapping
+	Filter           models.RecordFilter
+	Rules            models.ValidationRules
+}
+
+// APIToken returns the current REDCap API token
+func (p *REDCapProject) APIToken() string {
+	if p.TokenFile != nil {
+		return p.TokenFile.Value()
+	}
+	return p.Token
+}
+
+// DataEntryTriggerToken returns the current data entry trigger token, or an empty string if none is configured
+func (p *REDCapProject) DataEntryTriggerToken() string {
+	if p.TriggerTokenFile != nil {
+		return p.TriggerTokenFile.Value()
+	}
+	return p.TriggerToken
+}
+
+// AcceptsTriggerToken indicates if the token matches the project's data entry trigger token.  No token is accepted if
+// the project doesn't have one configured.
+func (p *REDCapProject) AcceptsTriggerToken(token string) bool {
+	expected := p.DataEntryTriggerToken()
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// ToStudies groups the records into studies, removing (and noting) the records that are not allowed by the project's
+// filter or that fail its validation rules.  Validation errors refer to the project's field names.
+func (p *REDCapProject) ToStudies(records []models.Record) (models.StudyMap, error) {
+	studies := make(models.StudyMap)
+	if err := studies.AddRecords(records); err != nil {
+		return nil, err
+	}
+	studies.Filter(p.Filter)
+	studies.Validate(p.Rules)
+	if len(p.Fields) > 0 {
+		for _, study := range studies {
+			for i := range study.Invalid {
+				for j := range study.Invalid[i].Errors {
+					study.Invalid[i].Errors[j].Field = p.Fields.Field(study.Invalid[i].Errors[j].Field)
+				}
+			}
+		}
+	}
+	return studies, nil
+}
+
+// FindProject returns the project with the given name or REDCap project ID.  If the name is empty, the only project is
+// returned, and an error is returned if there's more than one.
+func FindProject(projects []REDCapProject, name string) (*REDCapProject, error) {
+	if name == "" {
+		if len(projects) != 1 {
+			return nil, errors.New("A project must be named since more than one is configured")
+		}
+		return &projects[0], nil
+	}
+	for i := range projects {
+		if projects[i].Name == name || projects[i].ProjectID == name {
+			return &projects[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No project named %s is configured", name)
+}
+
+// projectConfig represents a project in the JSON configuration file
+type projectConfig struct {
+	Name             string                       `json:"name"`
+	ProjectID        string                       `json:"projectID"`
+	URL              string                       `json:"url"`
+	Token            string                       `json:"token"`
+	TokenFile        string                       `json:"tokenFile"`
+	DETToken         string                       `json:"detToken"`
+	DETTokenFile     string                       `json:"detTokenFile"`
+	IdentifierSystem string                       `json:"identifierSystem"`
+	Fields           models.FieldMapping          `json:"fields"`
+	Arms             []string                     `json:"arms"`
+	Events           []string                     `json:"events"`
+	ExcludeEvents    []string                     `json:"excludeEvents"`
+	MinStatus        *int                         `json:"minStatus"`
+	ScoreRanges      map[string]models.ScoreRange `json:"scoreRanges"`
+	EarliestDate     string                       `json:"earliestDate"`
+	FutureTolerance  string                       `json:"futureTolerance"`
+}
+
+// LoadProjects loads the REDCap projects from a JSON configuration file in the form:
+// {"projects": [{"name": "clinic-a", "url": "http://redcapsrv:80", "tokenFile": "/run/secrets/clinic-a-token", ...}]}.
+// Each project must have either a token or a tokenFile, which is preferred since it keeps the token out of the
+// configuration.  Projects accepting data entry triggers (i.e., with a projectID) also need a detToken or detTokenFile,
+// the shared secret passed in the token query parameter of the trigger URL.  Projects without a minStatus only import records with complete risk factors forms, and projects
+// without an earliestDate reject risk factor dates before models.DefaultEarliestDate.
+func LoadProjects(path string) ([]REDCapProject, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config struct {
+		Projects []projectConfig `json:"projects"`
+	}
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, fmt.Errorf("Couldn't parse project configuration file %s: %s", path, err)
+	}
+	if len(config.Projects) == 0 {
+		return nil, fmt.Errorf("No projects configured in %s", path)
+	}
+
+	projects := make([]REDCapProject, len(config.Projects))
+	names := make(map[string]bool)
+	for i, pc := range config.Projects {
+		if pc.Name == "" || pc.URL == "" || (pc.Token == "") == (pc.TokenFile == "") {
+			return nil, errors.New("Every project must have a name, url, and either a token or a tokenFile")
+		}
+		if names[pc.Name] {
+			return nil, fmt.Errorf("Duplicate project name: %s", pc.Name)
+		}
+		names[pc.Name] = true
+
+		p := REDCapProject{
+			Name:             pc.Name,
+			ProjectID:        pc.ProjectID,
+			Endpoint:         pc.URL,
+			Token:            pc.Token,
+			IdentifierSystem: pc.IdentifierSystem,
+			Fields:           pc.Fields,
+			Filter: models.RecordFilter{
+				Arms:          pc.Arms,
+				IncludeEvents: pc.Events,
+				ExcludeEvents: pc.ExcludeEvents,
+				MinFormStatus: models.FormComplete,
+			},
+		}
+		if pc.TokenFile != "" {
+			if p.TokenFile, err = NewSecretFile(pc.TokenFile); err != nil {
+				return nil, fmt.Errorf("Couldn't read token file for project %s: %s", pc.Name, err)
+			}
+		} else {
+			RegisterSecret(pc.Token)
+		}
+		if pc.DETToken != "" && pc.DETTokenFile != "" {
+			return nil, fmt.Errorf("Project %s must have either a detToken or a detTokenFile, not both", pc.Name)
+		}
+		if pc.DETTokenFile != "" {
+			if p.TriggerTokenFile, err = NewSecretFile(pc.DETTokenFile); err != nil {
+				return nil, fmt.Errorf("Couldn't read data entry trigger token file for project %s: %s", pc.Name, err)
+			}
+		} else {
+			p.TriggerToken = pc.DETToken
+			RegisterSecret(pc.DETToken)
+		}
+		if pc.MinStatus != nil {
+			if *pc.MinStatus < models.FormIncomplete || *pc.MinStatus > models.FormComplete {
+				return nil, fmt.Errorf("Minimum form status for project %s must be 0, 1, or 2", pc.Name)
+			}
+			p.Filter.MinFormStatus = *pc.MinStatus
+		}
+		for field, r := range pc.ScoreRanges {
+			if r.Min > r.Max || r.Min < models.MinRiskScore || r.Max > models.MaxRiskScore {
+				return nil, fmt.Errorf("Score range for %s in project %s must be within %d-%d", field, pc.Name, models.MinRiskScore, models.MaxRiskScore)
+			}
+		}
+		if p.Rules.ScoreRanges, err = pc.Fields.StandardScoreRanges(pc.ScoreRanges); err != nil {
+			return nil, fmt.Errorf("Invalid score ranges for project %s: %s", pc.Name, err)
+		}
+		if pc.EarliestDate == "" {
+			pc.EarliestDate = models.DefaultEarliestDate
+		}
+		if p.Rules.EarliestDate, err = time.ParseInLocation("2006-01-02", pc.EarliestDate, time.Local); err != nil {
+			return nil, fmt.Errorf("Invalid earliest date for project %s: %s", pc.Name, err)
+		}
+		if pc.FutureTolerance != "" {
+			if p.Rules.FutureTolerance, err = time.ParseDuration(pc.FutureTolerance); err != nil {
+				return nil, fmt.Errorf("Invalid future tolerance for project %s: %s", pc.Name, err)
+			}
+		}
+		projects[i] = p
+	}
+	return projects, nil
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestProjectSuite(t *testing.T) {
+	suite.Run(t, new(ProjectSuite))
+}
+
+type ProjectSuite struct {
+	suite.Suite
+}
+
+func (suite *ProjectSuite) TestLoadProjects() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	path := suite.writeConfig(`{"projects": [
+		{"name": "clinic-a", "projectID": "42", "url": "http://redcap-a", "token": "abc", "detToken": "det-secret", "arms": ["1"]},
+		{"name": "clinic-b", "url": "http://redcap-b", "token": "def", "identifierSystem": "urn:clinic-b",
+		 "fields": {"study_id": "record_id"}, "minStatus": 1, "scoreRanges": {"rf_cmc_risk_cat": {"min": 1, "max": 3}},
+		 "earliestDate": "2014-01-01", "futureTolerance": "48h"}
+	]}`)
+	defer os.Remove(path)
+
+	projects, err := LoadProjects(path)
+	require.NoError(err)
+	require.Len(projects, 2)
+
+	assert.Equal("clinic-a", projects[0].Name)
+	assert.Equal("42", projects[0].ProjectID)
+	assert.Equal("http://redcap-a", projects[0].Endpoint)
+	assert.Equal("abc", projects[0].Token)
+	assert.True(projects[0].AcceptsTriggerToken("det-secret"))
+	assert.False(projects[0].AcceptsTriggerToken("det-secre"))
+	assert.Equal([]string{"1"}, projects[0].Filter.Arms)
+	assert.Equal(models.FormComplete, projects[0].Filter.MinFormStatus)
+	assert.Equal(time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local), projects[0].Rules.EarliestDate)
+
+	assert.Equal("clinic-b", projects[1].Name)
+	assert.False(projects[1].AcceptsTriggerToken(""), "Projects without a trigger token shouldn't accept any")
+	assert.Equal("urn:clinic-b", projects[1].IdentifierSystem)
+	assert.Equal("record_id", projects[1].Fields.Field("study_id"))
+	assert.Equal(models.FormUnverified, projects[1].Filter.MinFormStatus)
+	assert.Equal(models.ScoreRange{Min: 1, Max: 3}, projects[1].Rules.ScoreRange("rf_cmc_risk_cat"))
+	assert.Equal(2014, projects[1].Rules.EarliestDate.Year())
+	assert.Equal("48h0m0s", projects[1].Rules.FutureTolerance.String())
+}
+
+func (suite *ProjectSuite) TestLoadProjectsMapsScoreRanges() {
+	require := suite.Require()
+
+	path := suite.writeConfig(`{"projects": [{"name": "a", "url": "http://a", "token": "1", "fields": {"rf_cmc_risk_cat": "cmc"},
+		"scoreRanges": {"cmc": {"min": 1, "max": 3}}}]}`)
+	defer os.Remove(path)
+
+	projects, err := LoadProjects(path)
+	require.NoError(err)
+	require.Len(projects, 1)
+	suite.Equal(map[string]models.ScoreRange{"rf_cmc_risk_cat": {Min: 1, Max: 3}}, projects[0].Rules.ScoreRanges)
+}
+
+func (suite *ProjectSuite) TestLoadProjectsInvalid() {
+	assert := suite.Assert()
+
+	configs := []string{
+		`{"projects": []}`,
+		`{"projects": [{"name": "clinic-a", "url": "http://redcap-a"}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1"}, {"name": "a", "url": "http://b", "token": "2"}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1", "tokenFile": "token.txt"}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "tokenFile": "does-not-exist.txt"}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1", "detToken": "2", "detTokenFile": "det.txt"}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1", "detTokenFile": "does-not-exist.txt"}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1", "minStatus": 3}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1", "scoreRanges": {"rf_date": {"min": 0, "max": 4}}}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1", "scoreRanges": {"rf_date": {"min": 1, "max": 4}}}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1", "fields": {"rf_cmc_risk_cat": "cmc"}, "scoreRanges": {"rf_cmc_risk_cat": {"min": 1, "max": 3}}}]}`,
+		`{"projects": [{"name": "a", "url": "http://a", "token": "1", "earliestDate": "01/01/2014"}]}`,
+		`{"projects": [`,
+	}
+	for _, config := range configs {
+		path := suite.writeConfig(config)
+		_, err := LoadProjects(path)
+		assert.Error(err, config)
+		os.Remove(path)
+	}
+
+	_, err := LoadProjects("does-not-exist.json")
+	assert.Error(err)
+}
+
+func (suite *ProjectSuite) TestToStudiesUsesProjectFieldNames() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	p := REDCapProject{Name: "clinic-a", Fields: models.FieldMapping{"rf_cmc_risk_cat": "cmc"}}
+	records := []models.Record{
+		{StudyID: "1", EventName: "initial_arm_1", RiskFactorDate: "2016-01-01", ClinicalRisk: "9", FunctionalRisk: "1",
+			PsychosocialRisk: "1", UtilizationRisk: "1", PerceivedRisk: "1", RiskFactorsComplete: "2"},
+	}
+	studies, err := p.ToStudies(records)
+	require.NoError(err)
+	require.Len(studies["1"].Invalid, 1)
+	require.Len(studies["1"].Invalid[0].Errors, 1)
+	assert.Equal("cmc", studies["1"].Invalid[0].Errors[0].Field)
+	assert.Equal(models.InvalidOutOfRange, studies["1"].Invalid[0].Errors[0].Reason)
+}
+
+func (suite *ProjectSuite) TestFindProject() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	projects := []REDCapProject{{Name: "clinic-a", ProjectID: "42"}, {Name: "clinic-b"}}
+	project, err := FindProject(projects, "clinic-b")
+	require.NoError(err)
+	assert.Equal("clinic-b", project.Name)
+	project, err = FindProject(projects, "42")
+	require.NoError(err)
+	assert.Equal("clinic-a", project.Name)
+	_, err = FindProject(projects, "clinic-c")
+	assert.Error(err)
+	_, err = FindProject(projects, "")
+	assert.Error(err)
+
+	project, err = FindProject(projects[:1], "")
+	require.NoError(err)
+	assert.Equal("clinic-a", project.Name)
+}
+
+func (suite *ProjectSuite) writeConfig(config string) string {
+	f, err := ioutil.TempFile("", "projects")
+	suite.Require().NoError(err)
+	defer f.Close()
+	_, err = f.WriteString(config)
+	suite.Require().NoError(err)
+	return f.Name()
+}
@@ -1,12 +1,14 @@
 package client
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
 
+	"github.com/intervention-engine/multifactorriskservice/logging"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -33,8 +35,14 @@ func (suite *REDCapClientSuite) SetupTest() {
 		assert.Equal("record", r.FormValue("content"))
 		assert.Equal("json", r.FormValue("format"))
 		assert.Equal("flat", r.FormValue("type"))
-		assert.Equal("study_id, redcap_event_name, rf_date, rf_cmc_risk_cat, rf_func_risk_cat, rf_sb_risk_cat, rf_util_risk_cat, rf_risk_predicted", r.FormValue("fields"))
+		assert.Equal("study_id, redcap_event_name, rf_date, rf_cmc_risk_cat, rf_func_risk_cat, rf_sb_risk_cat, rf_util_risk_cat, rf_risk_predicted, risk_factors_complete", r.FormValue("fields"))
 		assert.Equal("json", r.FormValue("returnFormat"))
+		if r.FormValue("records[0]") != "" {
+			assert.Equal("a", r.FormValue("records[0]"))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`[{"study_id": "a", "redcap_event_name": "initial_arm_1", "rf_date": "2016-02-21", "rf_cmc_risk_cat": "1", "rf_func_risk_cat": "1", "rf_sb_risk_cat": "2", "rf_util_risk_cat": "1", "rf_risk_predicted": "2"}]`))
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		io.Copy(w, f)
@@ -65,3 +73,90 @@ func (suite *REDCapClientSuite) TestGetREDCapData() {
 	assert.Equal("a", s.ID)
 	require.Len(s.Records, 1)
 }
+
+func (suite *REDCapClientSuite) TestGetREDCapDataForRecord() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	m, err := GetREDCapData(suite.Server.URL, "123456789", "a")
+	require.NoError(err)
+	require.Len(m, 1)
+
+	s, ok := m["a"]
+	require.True(ok)
+	assert.Equal("a", s.ID)
+	require.Len(s.Records, 1)
+}
+
+func (suite *REDCapClientSuite) TestGetREDCapProjectInfo() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("project", r.FormValue("content"))
+		if r.FormValue("token") != "123456789" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "You do not have permissions to use the API"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"project_id": 42, "project_title": "Risk Stratification", "in_production": 1}`))
+	}))
+	defer server.Close()
+
+	info, err := GetREDCapProjectInfo(REDCapProject{Endpoint: server.URL, Token: "123456789"})
+	require.NoError(err)
+	assert.Equal("42", info.ProjectID.String())
+	assert.Equal("Risk Stratification", info.ProjectTitle)
+
+	RegisterSecret("BADTOKEN")
+	_, err = GetREDCapProjectInfo(REDCapProject{Endpoint: server.URL, Token: "BADTOKEN"})
+	require.Error(err)
+	assert.Equal("Received HTTP 403 from REDCap: You do not have permissions to use the API", err.Error())
+
+	_, err = GetREDCapProjectInfo(REDCapProject{Endpoint: "http://localhost:0", Token: "BADTOKEN"})
+	require.Error(err)
+	assert.NotContains(err.Error(), "BADTOKEN")
+}
+
+func (suite *REDCapClientSuite) TestGetProjectDataSendsCorrelationID() {
+	require := suite.Require()
+
+	var correlationID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		correlationID = r.Header.Get(logging.CorrelationIDHeader)
+		suite.Equal("123456789", r.FormValue("token"))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	ctx := logging.WithJobID(context.Background(), "job1")
+	_, err := GetProjectData(ctx, REDCapProject{Endpoint: server.URL, Token: "123456789"})
+	require.NoError(err)
+	suite.Equal("job1", correlationID)
+}
+
+func (suite *REDCapClientSuite) TestRefreshWithOptions() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// No patients match the studies, so each study's result is an error
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"resourceType": "Bundle", "entry": []}`))
+	}))
+	defer fhirServer.Close()
+
+	var checkpoints [][]Result
+	results, err := RefreshRiskAssessmentsWithOptions(context.Background(), fhirServer.URL, []REDCapProject{{Endpoint: suite.Server.URL, Token: "123456789"}}, nil, "http://example.org/pies", RefreshOptions{
+		Exclude:    []string{"1"},
+		Checkpoint: func(r []Result) { checkpoints = append(checkpoints, r) },
+	})
+	require.NoError(err)
+	require.Len(results, 1)
+	assert.Equal("a", results[0].StudyID)
+	assert.Error(results[0].Error)
+	require.Len(checkpoints, 1)
+	assert.Equal(results, checkpoints[0])
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+// ValidationReportHeader is the header row of the validation report CSV
+var ValidationReportHeader = []string{"source", "study_id", "fhir_patient_id", "redcap_event_name", "redcap_repeat_instrument",
+	"redcap_repeat_instance", "field", "value", "reason"}
+
+// WriteValidationReportCSV writes a CSV containing one row for every problem found with the invalid records in the
+// results, so data managers can correct the records in REDCap
+func WriteValidationReportCSV(w io.Writer, results []Result) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(ValidationReportHeader); err != nil {
+		return err
+	}
+	for _, result := range results {
+		for _, invalid := range result.Invalid {
+			for _, e := range invalid.Errors {
+				row := []string{
+					result.Source,
+					invalid.Record.StudyIDString(),
+					result.FHIRPatientID,
+					invalid.Record.EventName,
+					invalid.Record.RepeatInstrument,
+					invalid.Record.RepeatInstanceString(),
+					e.Field,
+					e.Value,
+					e.Reason,
+				}
+				if err := writer.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
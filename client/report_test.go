@@ -0,0 +1,54 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestReportSuite(t *testing.T) {
+	suite.Run(t, new(ReportSuite))
+}
+
+type ReportSuite struct {
+	suite.Suite
+}
+
+func (suite *ReportSuite) TestWriteValidationReportCSV() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	results := []Result{
+		{
+			StudyID:             "1",
+			Source:              "clinic-a",
+			FHIRPatientID:       "56fd63cdac1c5d77f6f695a1",
+			RiskAssessmentCount: 1,
+			Invalid: []models.InvalidRecord{
+				{
+					Record: models.Record{StudyID: float64(1), EventName: "visit1_arm_1", RepeatInstrument: "risk_factors", RepeatInstance: float64(2)},
+					Errors: []models.ValidationError{
+						{Reason: models.InvalidMissingField, Field: "rf_date"},
+						{Reason: models.InvalidOutOfRange, Field: "rf_cmc_risk_cat", Value: "44"},
+					},
+				},
+			},
+		},
+		{
+			StudyID:             "a",
+			FHIRPatientID:       "56fd63cdac1c5d77f6f695a2",
+			RiskAssessmentCount: 1,
+		},
+	}
+
+	var buf bytes.Buffer
+	err := WriteValidationReportCSV(&buf, results)
+	require.NoError(err)
+	assert.Equal("source,study_id,fhir_patient_id,redcap_event_name,redcap_repeat_instrument,redcap_repeat_instance,field,value,reason\n"+
+		"clinic-a,1,56fd63cdac1c5d77f6f695a1,visit1_arm_1,risk_factors,2,rf_date,,missing field\n"+
+		"clinic-a,1,56fd63cdac1c5d77f6f695a1,visit1_arm_1,risk_factors,2,rf_cmc_risk_cat,44,value out of range\n", buf.String())
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redacted replaces secret values in logs and error messages
+const Redacted = "[REDACTED]"
+
+// secrets holds every secret value that must never appear in logs or error messages
+var secrets = struct {
+	sync.RWMutex
+	values map[string]bool
+}{values: make(map[string]bool)}
+
+// minSecretLength is the length below which values are not redacted, since redacting them would mangle unrelated
+// text.  REDCap API tokens are 32 characters.
+const minSecretLength = 8
+
+// RegisterSecret registers a secret value (e.g., a REDCap API token) to be redacted by Redact.  Values that were
+// rotated out remain registered.
+func RegisterSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.values[value] = true
+}
+
+// Redact replaces every registered secret value in the string, longest first in case one contains another
+func Redact(s string) string {
+	secrets.RLock()
+	values := make([]string, 0, len(secrets.values))
+	for value := range secrets.values {
+		values = append(values, value)
+	}
+	secrets.RUnlock()
+	sort.Sort(sort.Reverse(byLength(values)))
+	for _, value := range values {
+		s = strings.Replace(s, value, Redacted, -1)
+	}
+	return s
+}
+
+type byLength []string
+
+func (b byLength) Len() int           { return len(b) }
+func (b byLength) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLength) Less(i, j int) bool { return len(b[i]) < len(b[j]) }
+
+// RedactError returns an error with every registered secret value redacted from the message
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if msg := Redact(err.Error()); msg != err.Error() {
+		return errors.New(msg)
+	}
+	return err
+}
+
+// RedactValues returns a copy of the form values with the token and any registered secret values redacted, so that
+// the values can be safely logged
+func RedactValues(values url.Values) url.Values {
+	redacted := make(url.Values, len(values))
+	for k, vals := range values {
+		for _, v := range vals {
+			if k == "token" {
+				v = Redacted
+			}
+			redacted.Add(k, Redact(v))
+		}
+	}
+	return redacted
+}
+
+// RedactingWriter redacts registered secret values from everything written to the underlying writer.  It is intended
+// to wrap log output, where each write is a complete log line.
+type RedactingWriter struct {
+	Writer io.Writer
+}
+
+func (w RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.Writer, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SecretFile holds a secret read from a file (e.g., a mounted Kubernetes or Docker secret).  When watched, the
+// secret is reloaded whenever the file changes, so it can be rotated without restarting the service.
+type SecretFile struct {
+	Path    string
+	value   string
+	modTime time.Time
+	stop    chan struct{}
+	mutex   sync.RWMutex
+}
+
+// NewSecretFile reads the secret from the file at the given path
+func NewSecretFile(path string) (*SecretFile, error) {
+	s := &SecretFile{Path: path}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Value returns the current secret
+func (s *SecretFile) Value() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.value
+}
+
+// Reload reads the secret from the file if it has been modified since it was last read, returning true if the secret
+// changed.  Leading and trailing whitespace is ignored, and an empty file is an error.
+func (s *SecretFile) Reload() (bool, error) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return false, err
+	}
+	s.mutex.RLock()
+	unmodified := s.value != "" && info.ModTime().Equal(s.modTime)
+	s.mutex.RUnlock()
+	if unmodified {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return false, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return false, fmt.Errorf("Secret file %s is empty", s.Path)
+	}
+	RegisterSecret(value)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := value != s.value
+	s.value = value
+	s.modTime = info.ModTime()
+	return changed, nil
+}
+
+// Watch checks the file for changes at the given interval, reloading the secret when it is rotated.  If the file
+// can't be read, the previous secret continues to be used.
+func (s *SecretFile) Watch(interval time.Duration) {
+	s.mutex.Lock()
+	if s.stop != nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.stop = make(chan struct{})
+	stop := s.stop
+	s.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if changed, err := s.Reload(); err != nil {
+					slog.Warn("Couldn't reload secret, continuing to use the previous value", "path", s.Path, "error", RedactError(err))
+				} else if changed {
+					slog.Info("Reloaded rotated secret", "path", s.Path)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopWatching stops checking the file for changes
+func (s *SecretFile) StopWatching() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
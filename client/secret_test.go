@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestSecretSuite(t *testing.T) {
+	suite.Run(t, new(SecretSuite))
+}
+
+type SecretSuite struct {
+	suite.Suite
+}
+
+func (suite *SecretSuite) TestRedact() {
+	assert := suite.Assert()
+
+	RegisterSecret("F65EBA22DCB728FEC5ADFAD42378CA40")
+	assert.Equal("token=[REDACTED]&content=record", Redact("token=F65EBA22DCB728FEC5ADFAD42378CA40&content=record"))
+	assert.Equal("nothing to hide", Redact("nothing to hide"))
+
+	err := RedactError(errors.New("bad token: F65EBA22DCB728FEC5ADFAD42378CA40"))
+	assert.Equal("bad token: [REDACTED]", err.Error())
+	assert.Nil(RedactError(nil))
+}
+
+func (suite *SecretSuite) TestRedactValues() {
+	assert := suite.Assert()
+
+	values := url.Values{"token": {"not-registered"}, "content": {"record"}}
+	redacted := RedactValues(values)
+	assert.Equal("content=record&token=%5BREDACTED%5D", redacted.Encode())
+	assert.Equal("not-registered", values.Get("token"))
+}
+
+func (suite *SecretSuite) TestRedactingWriter() {
+	assert := suite.Assert()
+
+	RegisterSecret("0123456789ABCDEF")
+	var buf bytes.Buffer
+	w := RedactingWriter{Writer: &buf}
+	n, err := w.Write([]byte("posting token 0123456789ABCDEF\n"))
+	assert.NoError(err)
+	assert.Equal(31, n)
+	assert.Equal("posting token [REDACTED]\n", buf.String())
+}
+
+func (suite *SecretSuite) TestSecretFileRotation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	f, err := ioutil.TempFile("", "token")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	f.WriteString("first-token-value\n")
+	f.Close()
+
+	s, err := NewSecretFile(f.Name())
+	require.NoError(err)
+	assert.Equal("first-token-value", s.Value())
+	assert.Equal(Redacted, Redact("first-token-value"))
+
+	changed, err := s.Reload()
+	require.NoError(err)
+	assert.False(changed)
+
+	require.NoError(ioutil.WriteFile(f.Name(), []byte("second-token-value"), 0600))
+	require.NoError(os.Chtimes(f.Name(), time.Now(), time.Now().Add(time.Minute)))
+	s.Watch(5 * time.Millisecond)
+	defer s.StopWatching()
+	for i := 0; i < 100 && s.Value() != "second-token-value"; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal("second-token-value", s.Value())
+	assert.Equal(Redacted, Redact("second-token-value"))
+	assert.Equal(Redacted, Redact("first-token-value"))
+
+	// An empty file keeps the previous token
+	require.NoError(ioutil.WriteFile(f.Name(), []byte(""), 0600))
+	require.NoError(os.Chtimes(f.Name(), time.Now(), time.Now().Add(2*time.Minute)))
+	_, err = s.Reload()
+	assert.Error(err)
+	assert.Equal("second-token-value", s.Value())
+}
+
+func (suite *SecretSuite) TestMissingSecretFile() {
+	_, err := NewSecretFile("does-not-exist")
+	suite.Error(err)
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// REDCapClient is the HTTP client used for all requests to REDCap
+var REDCapClient = http.DefaultClient
+
+// FHIRClient is the HTTP client used for all requests to the FHIR server
+var FHIRClient = http.DefaultClient
+
+// TLSOptions configures the TLS connections to a server.  The zero value uses the system's root CAs, no client
+// certificate, and Go's default minimum TLS version.
+type TLSOptions struct {
+	// CAFile is the path to a PEM bundle of CA certificates trusted in addition to the system's root CAs
+	CAFile string
+	// CertFile and KeyFile are the paths to the PEM client certificate and key used for mutual TLS
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum TLS version: "1.0", "1.1", "1.2", or "1.3"
+	MinVersion string
+}
+
+// IsZero indicates if no TLS options are set
+func (o TLSOptions) IsZero() bool {
+	return o == TLSOptions{}
+}
+
+// Config builds the TLS configuration for the options
+func (o TLSOptions) Config() (*tls.Config, error) {
+	config := new(tls.Config)
+
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA bundle: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("Both a client certificate and key are required for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.MinVersion != "" {
+		version, err := ParseTLSVersion(o.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		config.MinVersion = version
+	}
+
+	return config, nil
+}
+
+// ParseTLSVersion converts a TLS version in the form "1.2" to its crypto/tls constant
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unsupported TLS version: %s (must be 1.0, 1.1, 1.2, or 1.3)", version)
+}
+
+// NewHTTPClient creates an HTTP client using the TLS options.  If no options are set, it returns the default client.
+func NewHTTPClient(o TLSOptions) (*http.Client, error) {
+	if o.IsZero() {
+		return http.DefaultClient, nil
+	}
+	config, err := o.Config()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     config,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 10,
+		},
+	}, nil
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTLSSuite(t *testing.T) {
+	suite.Run(t, new(TLSSuite))
+}
+
+type TLSSuite struct {
+	suite.Suite
+	Server   *httptest.Server
+	Dir      string
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+func (suite *TLSSuite) SetupTest() {
+	require := suite.Require()
+
+	suite.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	suite.Server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	suite.Server.StartTLS()
+
+	var err error
+	suite.Dir, err = ioutil.TempDir("", "tls")
+	require.NoError(err)
+
+	// The test server's certificate doubles as the CA and the client certificate
+	cert := suite.Server.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(err)
+	suite.CAFile = filepath.Join(suite.Dir, "ca.pem")
+	suite.CertFile = suite.CAFile
+	suite.KeyFile = filepath.Join(suite.Dir, "key.pem")
+	require.NoError(ioutil.WriteFile(suite.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	require.NoError(ioutil.WriteFile(suite.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+}
+
+func (suite *TLSSuite) TearDownTest() {
+	suite.Server.Close()
+	os.RemoveAll(suite.Dir)
+}
+
+func (suite *TLSSuite) TestDefaultClient() {
+	assert := suite.Assert()
+
+	c, err := NewHTTPClient(TLSOptions{})
+	assert.NoError(err)
+	assert.Equal(http.DefaultClient, c)
+
+	// The test server's certificate isn't trusted by default
+	_, err = c.Get(suite.Server.URL)
+	assert.Error(err)
+}
+
+func (suite *TLSSuite) TestCABundle() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	c, err := NewHTTPClient(TLSOptions{CAFile: suite.CAFile})
+	require.NoError(err)
+	res, err := c.Get(suite.Server.URL)
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+}
+
+func (suite *TLSSuite) TestClientCertificate() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	c, err := NewHTTPClient(TLSOptions{CAFile: suite.CAFile, CertFile: suite.CertFile, KeyFile: suite.KeyFile, MinVersion: "1.2"})
+	require.NoError(err)
+	res, err := c.Get(suite.Server.URL)
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+}
+
+func (suite *TLSSuite) TestInvalidOptions() {
+	assert := suite.Assert()
+
+	_, err := NewHTTPClient(TLSOptions{CAFile: "does-not-exist.pem"})
+	assert.Error(err)
+	_, err = NewHTTPClient(TLSOptions{CAFile: suite.KeyFile})
+	assert.Error(err)
+	_, err = NewHTTPClient(TLSOptions{CertFile: suite.CertFile})
+	assert.Error(err)
+	_, err = NewHTTPClient(TLSOptions{MinVersion: "1.4"})
+	assert.Error(err)
+}
+
+func (suite *TLSSuite) TestParseTLSVersion() {
+	assert := suite.Assert()
+
+	version, err := ParseTLSVersion("1.2")
+	assert.NoError(err)
+	assert.Equal(uint16(tls.VersionTLS12), version)
+	_, err = ParseTLSVersion("TLS1.2")
+	assert.Error(err)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robfig/cron"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/server"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
+)
+
+// command describes one of the commands run by the binary
+type command struct {
+	name, args, description string
+}
+
+// commands lists the commands in the order they're shown in the usage.  Every command shares the flags configuring the
+// service.
+var commands = []command{
+	{"serve", "", "Serve the API and refresh risk assessments on the schedule (the default command)"},
+	{"refresh", "[RECORD_ID...]", "Refresh the risk assessments (or only those for the REDCap records) once"},
+	{"import", "[flags] FILE", "Import a REDCap CSV or JSON export file instead of querying REDCap"},
+	{"validate", "", "Validate the configuration without connecting to anything"},
+	{"check", "", "Check that Mongo, the FHIR server, and each REDCap project can be reached"},
+	{"history", "[flags] [RUN_ID]", "Print the refresh history, or a single run"},
+	{"pies", "purge PATIENT_ID...", "Remove the pies stored for the FHIR patients"},
+}
+
+// isCommand returns true if the name is one of the commands
+func isCommand(name string) bool {
+	for _, c := range commands {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// usage prints the commands and flags
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: multifactorriskservice [flags] [command [args]]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.description)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "\nCommands other than serve exit with 0 on success, 1 on failure, or 2 if their args are invalid.")
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// newCommandFlagSet creates the flag set parsing a command's args, with a usage showing the command's args
+func newCommandFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, c := range commands {
+			if strings.Fields(name)[0] == c.name {
+				fmt.Fprintf(os.Stderr, "Usage: multifactorriskservice [flags] %s %s\n", c.name, c.args)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// commandUser describes who ran the command in the refresh history: the OS user if known
+func commandUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return "command line"
+}
+
+// anyFailed returns true if any study in the results had an error
+func anyFailed(results []client.Result) bool {
+	for _, result := range results {
+		if result.Error != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// runRefresh runs the refresh command, refreshing the risk assessments once just as a refresh requested through the API
+// would, and returns the exit code: 0 if the refresh succeeded, or 1 if it failed or any study had an error.  On
+// SIGINT or SIGTERM, the refresh is given until the shutdown timeout to finish the study it's on and save its progress,
+// so that the service resumes it when it next starts.
+func runRefresh(args []string, shutdownTimeout time.Duration, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *server.RefreshHistory) int {
+	fs := newCommandFlagSet("refresh")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Info("Stopping refresh", "signal", sig.String(), "timeout", shutdownTimeout.String())
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := server.StopRefreshes(ctx); err != nil {
+				slog.Error("The refresh didn't stop before the shutdown timeout", "error", err)
+			}
+		case <-done:
+		}
+	}()
+
+	ctx := logging.WithJobID(context.Background(), logging.NewJobID())
+	results, err := server.RefreshFromCommand(ctx, commandUser(), fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history, fs.Args()...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't refresh risk assessments", "error", err)
+		return 1
+	}
+	client.LogResultSummary(ctx, results)
+	if anyFailed(results) {
+		return 1
+	}
+	return 0
+}
+
+// runImport runs the import command, importing a REDCap CSV or JSON export file into a project just as a refresh would,
+// and returns the exit code: 0 if the import succeeded, or 1 if it failed or any study had an error
+func runImport(args []string, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *server.RefreshHistory) int {
+	fs := newCommandFlagSet("import")
+	source := fs.String("source", "", "Name or REDCap project ID of the project the file was exported from (default: the only configured project)")
+	format := fs.String("format", "", "Format of the export file: csv or json (default: from the file extension)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+
+	project, err := client.FindProject(projects, *source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	records, err := project.Fields.DecodeExport(f, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't read the REDCap export: %s\n", err)
+		return 1
+	}
+
+	ctx := logging.WithJobID(context.Background(), logging.NewJobID())
+	results, err := server.ImportRecords(ctx, commandUser()+" ("+filepath.Base(path)+")", fhirEndpoint, projects, project, records, pieCollection, basisPieURL, dispatcher, history)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't import risk assessments", "file", path, "error", err)
+		return 1
+	}
+	client.LogResultSummary(ctx, results)
+	if anyFailed(results) {
+		return 1
+	}
+	return 0
+}
+
+// runValidate runs the validate command, printing a summary of the configuration, which was already validated when it
+// was loaded, once the cron spec is validated too.  It returns 1 if the cron spec is invalid.
+func runValidate(args []string, cronSpec string, projects []client.REDCapProject, authenticator *server.Authenticator) int {
+	fs := newCommandFlagSet("validate")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if _, err := cron.Parse(cronSpec); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid cron spec %s: %s\n", cronSpec, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tREDCAP\tPROJECT ID\tTOKEN")
+	for _, p := range projects {
+		token := "static"
+		if p.TokenFile != nil {
+			token = "file"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, p.Endpoint, p.ProjectID, token)
+	}
+	w.Flush()
+	fmt.Printf("\nRefresh schedule: %s\n", cronSpec)
+	switch {
+	case authenticator == nil:
+		fmt.Println("API authentication: disabled")
+	case authenticator.JWKS != nil:
+		fmt.Printf("API authentication: %d API keys and JWT bearer tokens\n", len(authenticator.APIKeys))
+	default:
+		fmt.Printf("API authentication: %d API keys\n", len(authenticator.APIKeys))
+	}
+	fmt.Println("\nThe configuration is valid.")
+	return 0
+}
+
+// runCheck runs the check command, checking each dependency as the readiness endpoint does, and returns the exit code:
+// 0 if every dependency is up, or 1 if any is down
+func runCheck(args []string, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection) int {
+	fs := newCommandFlagSet("check")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	status, checks := server.CheckDependencies(fhirEndpoint, projects, pieCollection)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEPENDENCY\tSTATUS\tDURATION\tERROR")
+	for _, check := range checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", check.Name, check.Status, check.Duration, check.Error)
+	}
+	w.Flush()
+	fmt.Printf("\nStatus: %s\n", status)
+	if status != server.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// runHistory runs the history command, printing the runs in the refresh history matching the filters, or the run with
+// the given ID or job ID along with its per-study results.  It returns 1 if the history can't be read or the run
+// doesn't exist.
+func runHistory(args []string, history *server.RefreshHistory) int {
+	fs := newCommandFlagSet("history")
+	filters := map[string]*string{
+		"from":    fs.String("from", "", "Earliest start of the runs: an RFC 3339 time or a date"),
+		"to":      fs.String("to", "", "Latest start of the runs: an RFC 3339 time or a date, including the whole day"),
+		"status":  fs.String("status", "", "Comma-separated list of run statuses: running, succeeded, partial, failed, or interrupted"),
+		"trigger": fs.String("trigger", "", "Comma-separated list of triggers: cron, api, det, resume, import, or command"),
+		"limit":   fs.String("limit", "", "Maximum number of runs (default: 100)"),
+	}
+	asJSON := fs.Bool("json", false, "Print the runs as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if fs.NArg() == 1 {
+		var run *server.RefreshRun
+		var err error
+		if id := fs.Arg(0); bson.IsObjectIdHex(id) {
+			run, err = history.Get(bson.ObjectIdHex(id))
+		} else {
+			run, err = history.GetByJobID(id)
+		}
+		if err == mgo.ErrNotFound {
+			fmt.Fprintf(os.Stderr, "No refresh run %s\n", fs.Arg(0))
+			return 1
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't read the refresh history: %s\n", err)
+			return 1
+		}
+		encoder.Encode(run)
+		return 0
+	}
+
+	params := url.Values{}
+	for name, value := range filters {
+		if *value != "" {
+			params.Set(name, *value)
+		}
+	}
+	q, err := server.ParseHistoryQuery(params)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	runs, err := history.Find(q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't read the refresh history: %s\n", err)
+		return 1
+	}
+	if *asJSON {
+		encoder.Encode(runs)
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tJOB ID\tSTARTED\tSTATUS\tTRIGGER\tBY\tPATIENTS\tERRORS\tRISK ASSESSMENTS")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", run.ID.Hex(), run.JobID, run.Started.Format(time.RFC3339),
+			run.Status, run.Trigger.Type, run.Trigger.By, run.Patients, run.Errors, run.RiskAssessments)
+	}
+	w.Flush()
+	return 0
+}
+
+// runPies runs the pies command.  Its only subcommand, purge, removes the pies stored for the FHIR patients.  It
+// returns 1 if the pies can't be removed.
+func runPies(args []string, fhirEndpoint string, pieCollection *mgo.Collection) int {
+	if len(args) == 0 || args[0] != "purge" {
+		fmt.Fprintln(os.Stderr, "Usage: multifactorriskservice [flags] pies purge PATIENT_ID...")
+		return 2
+	}
+	fs := newCommandFlagSet("pies purge")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	removed, err := server.PurgePies(fhirEndpoint, pieCollection, fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't remove the pies: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Removed %d pies for %d patients.\n", removed, fs.NArg())
+	return 0
+}
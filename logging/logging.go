@@ -0,0 +1,151 @@
+// Package logging configures the structured, leveled logs written by the risk service and carries the correlation
+// IDs (refresh job, study, and FHIR patient) that are attached to every log line written during a refresh.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CorrelationIDHeader is the header carrying the refresh job ID on outbound REDCap and FHIR requests.  It is also
+// accepted on inbound refresh requests and echoed in their responses.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// Log attribute keys for the correlation IDs
+const (
+	JobIDKey     = "job_id"
+	StudyIDKey   = "study_id"
+	PatientIDKey = "fhir_patient_id"
+)
+
+type contextKey int
+
+const (
+	jobIDContextKey contextKey = iota
+	studyIDContextKey
+	patientIDContextKey
+)
+
+// Setup configures the default logger to write to w in the given format ("text" or "json"), dropping messages below
+// the given level ("debug", "info", "warn", or "error").  Output from the standard log package is also routed through
+// the default logger at the info level.
+func Setup(w io.Writer, format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("Invalid log level %s (must be debug, info, warn, or error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("Invalid log format %s (must be text or json)", format)
+	}
+	slog.SetDefault(slog.New(NewContextHandler(handler)))
+	return nil
+}
+
+// ContextHandler is a slog.Handler that adds the correlation IDs found in the context to every record
+type ContextHandler struct {
+	slog.Handler
+}
+
+// NewContextHandler wraps the handler so that it adds the correlation IDs to every record
+func NewContextHandler(h slog.Handler) *ContextHandler {
+	return &ContextHandler{h}
+}
+
+// Handle adds the correlation IDs from the context and passes the record on to the wrapped handler
+func (h *ContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := JobID(ctx); id != "" {
+			r.AddAttrs(slog.String(JobIDKey, id))
+		}
+		if id, ok := ctx.Value(studyIDContextKey).(string); ok {
+			r.AddAttrs(slog.String(StudyIDKey, id))
+		}
+		if id, ok := ctx.Value(patientIDContextKey).(string); ok {
+			r.AddAttrs(slog.String(PatientIDKey, id))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler with the attributes, which still adds the correlation IDs
+func (h *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup returns a handler with the group, which still adds the correlation IDs
+func (h *ContextHandler) WithGroup(name string) slog.Handler {
+	return &ContextHandler{h.Handler.WithGroup(name)}
+}
+
+// NewJobID generates a random ID for a refresh job
+func NewJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithJobID returns a context carrying the refresh job ID
+func WithJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDContextKey, id)
+}
+
+// JobID returns the refresh job ID carried by the context, or an empty string if there is none
+func JobID(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDContextKey).(string)
+	return id
+}
+
+// WithStudyID returns a context carrying the REDCap study ID being processed
+func WithStudyID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, studyIDContextKey, id)
+}
+
+// WithPatientID returns a context carrying the FHIR patient ID being processed
+func WithPatientID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, patientIDContextKey, id)
+}
+
+// GinLogger is Gin middleware writing a structured access log line for every request, replacing Gin's default logger
+func GinLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		level := slog.LevelInfo
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", c.Writer.Status()),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if id := c.Writer.Header().Get(CorrelationIDHeader); id != "" {
+			attrs = append(attrs, slog.String(JobIDKey, id))
+		}
+		if errs := c.Errors.String(); errs != "" {
+			attrs = append(attrs, slog.String("error", strings.TrimSpace(errs)))
+		}
+		slog.LogAttrs(context.Background(), level, "HTTP request", attrs...)
+	}
+}
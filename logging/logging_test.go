@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestLoggingSuite(t *testing.T) {
+	suite.Run(t, new(LoggingSuite))
+}
+
+type LoggingSuite struct {
+	suite.Suite
+	Default *slog.Logger
+	Buffer  bytes.Buffer
+}
+
+func (suite *LoggingSuite) SetupTest() {
+	suite.Default = slog.Default()
+	suite.Buffer.Reset()
+}
+
+func (suite *LoggingSuite) TearDownTest() {
+	slog.SetDefault(suite.Default)
+}
+
+// lines decodes each JSON log line written to the buffer
+func (suite *LoggingSuite) lines() []map[string]interface{} {
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&suite.Buffer)
+	for dec.More() {
+		var line map[string]interface{}
+		suite.Require().NoError(dec.Decode(&line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (suite *LoggingSuite) TestSetupRejectsInvalidOptions() {
+	assert := suite.Assert()
+
+	assert.Error(Setup(&suite.Buffer, "xml", "info"))
+	assert.Error(Setup(&suite.Buffer, "json", "loud"))
+	assert.NoError(Setup(&suite.Buffer, "JSON", "DEBUG"))
+	assert.NoError(Setup(&suite.Buffer, "text", "warn"))
+}
+
+func (suite *LoggingSuite) TestCorrelationIDs() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	require.NoError(Setup(&suite.Buffer, "json", "info"))
+	ctx := WithJobID(context.Background(), "job1")
+	slog.InfoContext(ctx, "Started")
+	slog.InfoContext(WithPatientID(WithStudyID(ctx, "study1"), "patient1"), "Posted", "count", 2)
+	slog.Info("Unrelated")
+
+	lines := suite.lines()
+	require.Len(lines, 3)
+	assert.Equal("Started", lines[0]["msg"])
+	assert.Equal("job1", lines[0][JobIDKey])
+	assert.NotContains(lines[0], StudyIDKey)
+	assert.Equal("job1", lines[1][JobIDKey])
+	assert.Equal("study1", lines[1][StudyIDKey])
+	assert.Equal("patient1", lines[1][PatientIDKey])
+	assert.Equal(float64(2), lines[1]["count"])
+	assert.NotContains(lines[2], JobIDKey)
+}
+
+func (suite *LoggingSuite) TestCorrelationIDsWithAttrs() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	require.NoError(Setup(&suite.Buffer, "json", "info"))
+	slog.With("source", "A").InfoContext(WithJobID(context.Background(), "job1"), "Started")
+
+	lines := suite.lines()
+	require.Len(lines, 1)
+	assert.Equal("A", lines[0]["source"])
+	assert.Equal("job1", lines[0][JobIDKey])
+}
+
+func (suite *LoggingSuite) TestLevel() {
+	require := suite.Require()
+
+	require.NoError(Setup(&suite.Buffer, "json", "warn"))
+	slog.Info("Dropped")
+	slog.Warn("Kept")
+
+	lines := suite.lines()
+	require.Len(lines, 1)
+	suite.Equal("Kept", lines[0]["msg"])
+}
+
+func (suite *LoggingSuite) TestJobID() {
+	assert := suite.Assert()
+
+	assert.Equal("", JobID(context.Background()))
+	assert.Equal("job1", JobID(WithJobID(context.Background(), "job1")))
+	id := NewJobID()
+	assert.Len(id, 16)
+	assert.NotEqual(id, NewJobID())
+}
+
+func (suite *LoggingSuite) TestGinLogger() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	require.NoError(Setup(&suite.Buffer, "json", "info"))
+	gin.SetMode(gin.ReleaseMode)
+	e := gin.New()
+	e.Use(GinLogger())
+	e.POST("/refresh", func(c *gin.Context) {
+		c.Header(CorrelationIDHeader, "job1")
+		c.Status(http.StatusInternalServerError)
+	})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/refresh", nil))
+
+	lines := suite.lines()
+	require.Len(lines, 1)
+	assert.Equal("ERROR", lines[0]["level"])
+	assert.Equal("POST", lines[0]["method"])
+	assert.Equal("/refresh", lines[0]["path"])
+	assert.Equal(float64(500), lines[0]["status"])
+	assert.Equal("job1", lines[0][JobIDKey])
+}
@@ -1,30 +1,102 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/robfig/cron"
 
 	"gopkg.in/mgo.v2"
 
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/models"
 	"github.com/intervention-engine/multifactorriskservice/server"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
 )
 
 func main() {
 	httpFlag := flag.String("http", "", "HTTP service address to listen on (env: HTTP_HOST_AND_PORT, default: \":9000\")")
 	mongoFlag := flag.String("mongo", "", "MongoDB address (env: MONGO_URL, default: \"mongodb://localhost:27017\")")
 	fhirFlag := flag.String("fhir", "", "FHIR API address (env: FHIR_URL, default: \"http://localhost:3001\")")
-	redcapFlag := flag.String("redcap", "", "REDCap API address (required, env: REDCAP_URL, example: \"http://redcapsrv:80\")")
-	tokenFlag := flag.String("token", "", "REDCap API token (required, env: REDCAP_TOKEN, example: \"F65EBA22DCB728FEC5ADFAD42378CA40\")")
+	var pf projectFlags
+	configFlag := flag.String("config", "", "Path to a JSON file configuring one or more REDCap projects, overriding the single project REDCap args (env: REDCAP_CONFIG)")
+	pf.redcap = flag.String("redcap", "", "REDCap API address (required without -config, env: REDCAP_URL, example: \"http://redcapsrv:80\")")
+	pf.token = flag.String("token", "", "REDCap API token, visible in process listings so -token-file is preferred (required without -config or -token-file, env: REDCAP_TOKEN, example: \"F65EBA22DCB728FEC5ADFAD42378CA40\")")
+	pf.tokenFile = flag.String("token-file", "", "Path to a file containing the REDCap API token, reloaded when rotated (env: REDCAP_TOKEN_FILE, example: \"/run/secrets/redcap-token\")")
+	tokenWatchFlag := flag.String("token-watch", "", "How often REDCap and FHIR token files are checked for rotation (env: REDCAP_TOKEN_WATCH, default: \"1m\")")
 	cronFlag := flag.String("cron", "", "Cron expression indicating when risk assessments should be automatically refreshed (env: REDCAP_CRON, default: \"0 0 22 * * *\")")
+	pf.projectID = flag.String("project", "", "REDCap project ID accepted by the data entry trigger endpoint, which is disabled if not set (env: REDCAP_PROJECT_ID, example: \"42\")")
+	pf.detTokenFile = flag.String("det-token-file", "", "Path to a file containing the shared secret REDCap must pass as the token query parameter of the data entry trigger URL, which rejects every trigger without one, reloaded when rotated (env: REDCAP_DET_TOKEN_FILE, or the secret itself in REDCAP_DET_TOKEN)")
+	pf.arms = flag.String("arms", "", "Comma-separated list of REDCap arm numbers to import (env: REDCAP_ARMS, default: all arms, example: \"1,2\")")
+	pf.events = flag.String("events", "", "Comma-separated list of REDCap event names or patterns to import (env: REDCAP_EVENTS, default: all events, example: \"initial_arm_1,visit*\")")
+	pf.excludeEvents = flag.String("exclude-events", "", "Comma-separated list of REDCap event names or patterns to skip (env: REDCAP_EXCLUDE_EVENTS, example: \"screening_*\")")
+	pf.minStatus = flag.String("min-status", "", "Minimum risk factors form status to import: 0 (Incomplete), 1 (Unverified), or 2 (Complete) (env: REDCAP_MIN_STATUS, default: \"2\")")
+	pf.scoreRanges = flag.String("score-ranges", "", "Comma-separated list of valid score ranges by REDCap field (env: REDCAP_SCORE_RANGES, default: 1-4 for every score, example: \"rf_cmc_risk_cat=1-3\")")
+	pf.earliestDate = flag.String("earliest-date", "", "Earliest plausible risk factor date (env: REDCAP_EARLIEST_DATE, default: \""+models.DefaultEarliestDate+"\")")
+	pf.futureTolerance = flag.String("future-tolerance", "", "How far in the future a risk factor date may be (env: REDCAP_FUTURE_TOLERANCE, default: \"0s\", example: \"48h\")")
+	redcapTLS := tlsFlags{
+		ca:         flag.String("redcap-ca", "", "Path to a PEM bundle of CAs trusted for REDCap, in addition to the system CAs (env: REDCAP_CA_FILE)"),
+		cert:       flag.String("redcap-cert", "", "Path to a PEM client certificate for mutual TLS with REDCap (env: REDCAP_CERT_FILE)"),
+		key:        flag.String("redcap-key", "", "Path to the PEM key for the REDCap client certificate (env: REDCAP_KEY_FILE)"),
+		minVersion: flag.String("redcap-tls-min", "", "Minimum TLS version for REDCap: 1.0, 1.1, 1.2, or 1.3 (env: REDCAP_TLS_MIN_VERSION)"),
+	}
+	fhirTLS := tlsFlags{
+		ca:         flag.String("fhir-ca", "", "Path to a PEM bundle of CAs trusted for the FHIR server, in addition to the system CAs (env: FHIR_CA_FILE)"),
+		cert:       flag.String("fhir-cert", "", "Path to a PEM client certificate for mutual TLS with the FHIR server (env: FHIR_CERT_FILE)"),
+		key:        flag.String("fhir-key", "", "Path to the PEM key for the FHIR client certificate (env: FHIR_KEY_FILE)"),
+		minVersion: flag.String("fhir-tls-min", "", "Minimum TLS version for the FHIR server: 1.0, 1.1, 1.2, or 1.3 (env: FHIR_TLS_MIN_VERSION)"),
+	}
+	fhirAuth := client.BindFHIRAuthFlags(flag.CommandLine)
+	apiKeysFlag := flag.String("api-keys", "", "Path to a JSON file of API keys and their scopes accepted in the X-API-Key header (env: API_KEYS_FILE)")
+	jwksFlag := flag.String("jwks", "", "Path to a JWKS file with the keys trusted to sign JWT bearer tokens (env: JWKS_FILE)")
+	jwtIssuerFlag := flag.String("jwt-issuer", "", "Required issuer of JWT bearer tokens (env: JWT_ISSUER)")
+	jwtAudienceFlag := flag.String("jwt-audience", "", "Required audience of JWT bearer tokens (env: JWT_AUDIENCE)")
+	logFormatFlag := flag.String("log-format", "", "Log format: text or json (env: LOG_FORMAT, default: \"text\")")
+	logLevelFlag := flag.String("log-level", "", "Minimum log level: debug, info, warn, or error (env: LOG_LEVEL, default: \"info\")")
+	historyRetentionFlag := flag.String("history-retention", "", "How long refresh runs are kept in the refresh history, or 0 to keep them forever (env: REFRESH_HISTORY_RETENTION, default: \"2160h\")")
+	leaseTTLFlag := flag.String("lease-ttl", "", "How long a replica's refresh lease lasts without a heartbeat before another replica may take it over (env: REFRESH_LEASE_TTL, default: \"2m\")")
+	shutdownTimeoutFlag := flag.String("shutdown-timeout", "", "How long to wait on shutdown for running refreshes to save their progress and requests and webhook deliveries to finish (env: SHUTDOWN_TIMEOUT, default: \"30s\")")
+	bulkDirFlag := flag.String("bulk-export-dir", "", "Directory where FHIR bulk export ($export) files are written (env: BULK_EXPORT_DIR, default: \"bulk-exports\")")
+	bulkRetentionFlag := flag.String("bulk-export-retention", "", "How long finished bulk export jobs and their files are kept (env: BULK_EXPORT_RETENTION, default: \"24h\")")
+	detDelayFlag := flag.String("det-delay", "", "Time to wait for further saves of a record before refreshing it from a data entry trigger (env: REDCAP_DET_DELAY, default: \"30s\")")
+	flag.Usage = usage
 	flag.Parse()
 
+	// Serve unless another command is given.  The flags configure every command.
+	command, args := "serve", flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if !isCommand(command) {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", command)
+		usage()
+		os.Exit(2)
+	} else if command == "serve" && len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "The serve command takes no args")
+		os.Exit(2)
+	}
+
+	// Keep REDCap tokens out of the logs
+	logFormat := getConfigValue(logFormatFlag, "LOG_FORMAT", "text")
+	logLevel := getConfigValue(logLevelFlag, "LOG_LEVEL", "info")
+	if err := logging.Setup(client.RedactingWriter{Writer: os.Stderr}, logFormat, logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	gin.DefaultWriter = client.RedactingWriter{Writer: os.Stdout}
+	gin.DefaultErrorWriter = client.RedactingWriter{Writer: os.Stderr}
+
 	// Prefer http arg, falling back to env, falling back to default
 	httpa := getConfigValue(httpFlag, "HTTP_HOST_AND_PORT", ":9000")
 
@@ -40,17 +112,132 @@ func main() {
 		fhir = "http://localhost" + fhir
 	}
 
-	redcap := getRequiredConfigValue(redcapFlag, "REDCAP_URL", "REDCap URL")
-	token := getRequiredConfigValue(tokenFlag, "REDCAP_TOKEN", "REDCap API Token")
 	cronSpec := getConfigValue(cronFlag, "REDCAP_CRON", "0 0 22 * * *")
+	detDelay, err := time.ParseDuration(getConfigValue(detDelayFlag, "REDCAP_DET_DELAY", "30s"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid data entry trigger delay: %s\n", err)
+		os.Exit(1)
+	}
+	historyRetention, err := time.ParseDuration(getConfigValue(historyRetentionFlag, "REFRESH_HISTORY_RETENTION", "2160h"))
+	if err != nil || historyRetention < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid refresh history retention.")
+		os.Exit(1)
+	}
+	bulkRetention, err := time.ParseDuration(getConfigValue(bulkRetentionFlag, "BULK_EXPORT_RETENTION", server.DefaultBulkRetention.String()))
+	if err != nil || bulkRetention <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid bulk export retention.")
+		os.Exit(1)
+	}
+	leaseTTL, err := time.ParseDuration(getConfigValue(leaseTTLFlag, "REFRESH_LEASE_TTL", server.DefaultLeaseTTL.String()))
+	if err != nil || leaseTTL < 3*time.Second {
+		fmt.Fprintln(os.Stderr, "Invalid refresh lease TTL (must be at least 3s).")
+		os.Exit(1)
+	}
+	shutdownTimeout, err := time.ParseDuration(getConfigValue(shutdownTimeoutFlag, "SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil || shutdownTimeout <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid shutdown timeout.")
+		os.Exit(1)
+	}
+	tokenWatch, err := time.ParseDuration(getConfigValue(tokenWatchFlag, "REDCAP_TOKEN_WATCH", "1m"))
+	if err != nil || tokenWatch <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid token file watch interval.")
+		os.Exit(1)
+	}
+
+	// Configure TLS for REDCap and the FHIR server
+	if client.REDCapClient, err = redcapTLS.toClient("REDCAP"); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid REDCap TLS configuration: %s\n", err)
+		os.Exit(1)
+	}
+	if client.FHIRClient, err = fhirTLS.toClient("FHIR"); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid FHIR TLS configuration: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Configure authorization to the FHIR server
+	auth, err := client.NewFHIRAuth(fhirAuth.Options(), client.FHIRClient, fhir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid FHIR authorization configuration: %s\n", err)
+		os.Exit(1)
+	}
+	if auth != nil {
+		if bearer, ok := auth.(*client.BearerTokenAuth); ok && bearer.TokenFile != nil {
+			bearer.TokenFile.Watch(tokenWatch)
+			defer bearer.TokenFile.StopWatching()
+		}
+		client.FHIRClient = client.NewAuthClient(client.FHIRClient, auth)
+	}
+
+	// Load the REDCap projects from the config file if specified, otherwise configure a single project from the args
+	var projects []client.REDCapProject
+	if configPath := getConfigValue(configFlag, "REDCAP_CONFIG", ""); configPath != "" {
+		if projects, err = client.LoadProjects(configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		projects = []client.REDCapProject{pf.toProject()}
+	}
+	for _, project := range projects {
+		if project.TokenFile != nil {
+			project.TokenFile.Watch(tokenWatch)
+			defer project.TokenFile.StopWatching()
+		}
+		if project.TriggerTokenFile != nil {
+			project.TriggerTokenFile.Watch(tokenWatch)
+			defer project.TriggerTokenFile.StopWatching()
+		}
+	}
+
+	// Require API keys or JWTs if either is configured
+	var authenticator *server.Authenticator
+	apiKeysPath := getConfigValue(apiKeysFlag, "API_KEYS_FILE", "")
+	jwksPath := getConfigValue(jwksFlag, "JWKS_FILE", "")
+	if apiKeysPath != "" || jwksPath != "" {
+		authenticator = &server.Authenticator{
+			Issuer:   getConfigValue(jwtIssuerFlag, "JWT_ISSUER", ""),
+			Audience: getConfigValue(jwtAudienceFlag, "JWT_AUDIENCE", ""),
+		}
+		if apiKeysPath != "" {
+			if authenticator.APIKeys, err = server.LoadAPIKeys(apiKeysPath); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			for _, k := range authenticator.APIKeys {
+				client.RegisterSecret(k.Key)
+			}
+		}
+		if jwksPath != "" {
+			if authenticator.JWKS, err = server.LoadJWKS(jwksPath); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	} else if command == "serve" {
+		slog.Warn("No API keys or JWKS configured.  Anyone who can reach the service can refresh risk assessments.")
+	}
+
+	// The configuration is valid if it got this far, so check the rest without connecting to anything
+	if command == "validate" {
+		os.Exit(runValidate(args, cronSpec, projects, authenticator))
+	}
 
 	session, err := mgo.Dial(mongo)
 	if err != nil {
-		panic("Can't connect to the database")
+		fmt.Fprintf(os.Stderr, "Can't connect to the database: %s\n", err)
+		os.Exit(1)
 	}
 	defer session.Close()
 	db := session.DB("riskservice")
 	pieCollection := db.C("pies")
+	dispatcher := webhook.NewDispatcher(db.C("webhooks"), db.C("webhookdeliveries"))
+	history := server.NewRefreshHistory(db.C("refreshruns"), historyRetention)
+	if err := history.EnsureIndexes(); err != nil {
+		slog.Error("Couldn't create refresh history indexes", "error", err)
+	}
+
+	// Share the refresh lease with any other replicas so only one refreshes at a time
+	server.RefreshLease = server.NewLease(db.C("leases"), "refresh", leaseTTL)
 
 	// Get own endpoint address, falling back to discovery if needed
 	endpoint := httpa
@@ -59,19 +246,109 @@ func main() {
 	}
 	basisPieURL := "http://" + endpoint + "/pies"
 
-	// Setup the cron job and start the scheduler
-	c := cron.New()
-	err = server.ScheduleRefreshRiskAssessmentsCron(c, cronSpec, fhir, redcap, token, pieCollection, basisPieURL)
+	// Run the one-shot commands and exit with their exit codes once their webhooks are delivered
+	if command != "serve" {
+		var code int
+		switch command {
+		case "refresh":
+			code = runRefresh(args, shutdownTimeout, fhir, projects, pieCollection, basisPieURL, dispatcher, history)
+		case "import":
+			code = runImport(args, fhir, projects, pieCollection, basisPieURL, dispatcher, history)
+		case "check":
+			code = runCheck(args, fhir, projects, pieCollection)
+		case "history":
+			code = runHistory(args, history)
+		case "pies":
+			code = runPies(args, fhir, pieCollection)
+		}
+		waitForWebhooks(dispatcher, shutdownTimeout)
+		session.Close()
+		os.Exit(code)
+	}
+
+	// Setup the cron job and start the scheduler, preferring a schedule saved through the schedule API
+	job := server.NewRefreshJob(fhir, projects, pieCollection, basisPieURL, dispatcher, history)
+	scheduler, err := server.NewScheduler(db.C("schedule"), cronSpec, job)
 	if err != nil {
-		panic("Can't setup cron job for refreshing risk assessments.  Specified spec: " + cronSpec)
+		fmt.Fprintf(os.Stderr, "Can't set up the schedule for refreshing risk assessments (configured spec: %s): %s\n", cronSpec, err)
+		os.Exit(1)
 	}
-	c.Start()
-	defer c.Stop()
+	scheduler.Start()
+	defer scheduler.Stop()
 
-	// Create the gin engine, register the routes, and run!
-	e := gin.Default()
-	server.RegisterRoutes(e, fhir, redcap, token, pieCollection, basisPieURL)
-	e.Run(httpa)
+	// Create the gin engine and register the routes
+	e := gin.New()
+	e.Use(gin.Recovery(), logging.GinLogger())
+	server.RegisterRoutes(e, fhir, projects, pieCollection, basisPieURL, dispatcher, history, authenticator)
+	server.RegisterScheduleHandlers(e, scheduler)
+	exporter := server.NewBulkExporter(getConfigValue(bulkDirFlag, "BULK_EXPORT_DIR", "bulk-exports"), "http://"+endpoint, fhir, pieCollection, basisPieURL)
+	exporter.RequiresAccessToken = authenticator != nil
+	exporter.Retention = bulkRetention
+	if _, err := exporter.Purge(time.Now()); err != nil {
+		slog.Error("Couldn't remove expired bulk export files", "error", err)
+	}
+	server.RegisterBulkExportHandlers(e, exporter)
+	registerDET := false
+	for _, project := range projects {
+		if project.ProjectID == "" {
+			continue
+		}
+		registerDET = true
+		if project.DataEntryTriggerToken() == "" {
+			slog.Warn("Data entry triggers will be rejected since no data entry trigger token is configured", "project", project.Name, "project_id", project.ProjectID)
+		}
+	}
+	if registerDET {
+		server.RegisterDataEntryTriggerHandler(e, detDelay, fhir, projects, pieCollection, basisPieURL, dispatcher, history)
+	}
+
+	// Finish any refreshes interrupted by the last shutdown
+	go server.ResumeInterruptedRefreshes(fhir, projects, pieCollection, basisPieURL, dispatcher, history)
+
+	// Run until SIGINT or SIGTERM, then stop taking new work and give running refreshes until the shutdown timeout to
+	// finish the study they're on and save their progress
+	srv := &http.Server{Addr: httpa, Handler: e}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		slog.Error("Couldn't serve HTTP", "error", err)
+		os.Exit(1)
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String(), "timeout", shutdownTimeout.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	scheduler.Stop()
+	// Stop accepting requests while the refreshes stop, since the requests in progress may be waiting on them
+	httpStopped := make(chan error, 1)
+	go func() {
+		httpStopped <- srv.Shutdown(ctx)
+	}()
+	if err := server.StopRefreshes(ctx); err != nil {
+		slog.Error("Running refreshes didn't stop before the shutdown timeout", "error", err)
+	}
+	if err := <-httpStopped; err != nil {
+		slog.Error("HTTP requests didn't finish before the shutdown timeout", "error", err)
+	}
+	if err := dispatcher.WaitContext(ctx); err != nil {
+		slog.Error("Webhook deliveries didn't finish before the shutdown timeout", "error", err)
+	}
+}
+
+// waitForWebhooks gives webhook deliveries (including retries) until the timeout to finish, so exiting doesn't drop
+// the events published while running a command
+func waitForWebhooks(dispatcher *webhook.Dispatcher, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := dispatcher.WaitContext(ctx); err != nil {
+		slog.Error("Webhook deliveries didn't finish before the shutdown timeout", "error", err)
+	}
 }
 
 func getConfigValue(parsedFlag *string, envVar string, defaultVal string) string {
@@ -85,6 +362,95 @@ func getConfigValue(parsedFlag *string, envVar string, defaultVal string) string
 	return val
 }
 
+// projectFlags holds the args used to configure a single REDCap project when no config file is specified
+type projectFlags struct {
+	redcap, token, tokenFile, projectID, detTokenFile, arms, events, excludeEvents, minStatus, scoreRanges, earliestDate, futureTolerance *string
+}
+
+// toProject configures the REDCap project from the args, falling back to env, falling back to defaults
+func (pf *projectFlags) toProject() client.REDCapProject {
+	project := client.REDCapProject{
+		ProjectID: getConfigValue(pf.projectID, "REDCAP_PROJECT_ID", ""),
+		Endpoint:  getRequiredConfigValue(pf.redcap, "REDCAP_URL", "REDCap URL"),
+		Filter: models.RecordFilter{
+			Arms:          getListConfigValue(pf.arms, "REDCAP_ARMS"),
+			IncludeEvents: getListConfigValue(pf.events, "REDCAP_EVENTS"),
+			ExcludeEvents: getListConfigValue(pf.excludeEvents, "REDCAP_EXCLUDE_EVENTS"),
+		},
+	}
+
+	var err error
+	if tokenFile := getConfigValue(pf.tokenFile, "REDCAP_TOKEN_FILE", ""); tokenFile != "" && *pf.token == "" {
+		if project.TokenFile, err = client.NewSecretFile(tokenFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't read REDCap API token file: %s\n", err)
+			os.Exit(1)
+		}
+	} else {
+		if *pf.token != "" {
+			slog.Warn("The REDCap API token was passed as an argument, which exposes it in process listings.  Use -token-file or REDCAP_TOKEN instead.")
+		}
+		project.Token = getRequiredConfigValue(pf.token, "REDCAP_TOKEN", "REDCap API Token (or token file)")
+		client.RegisterSecret(project.Token)
+	}
+	if detTokenFile := getConfigValue(pf.detTokenFile, "REDCAP_DET_TOKEN_FILE", ""); detTokenFile != "" {
+		if project.TriggerTokenFile, err = client.NewSecretFile(detTokenFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't read data entry trigger token file: %s\n", err)
+			os.Exit(1)
+		}
+	} else {
+		project.TriggerToken = os.Getenv("REDCAP_DET_TOKEN")
+		client.RegisterSecret(project.TriggerToken)
+	}
+	project.Filter.MinFormStatus, err = strconv.Atoi(getConfigValue(pf.minStatus, "REDCAP_MIN_STATUS", "2"))
+	if err != nil || project.Filter.MinFormStatus < models.FormIncomplete || project.Filter.MinFormStatus > models.FormComplete {
+		fmt.Fprintln(os.Stderr, "Minimum form status must be 0, 1, or 2.")
+		os.Exit(1)
+	}
+	scoreRanges, err := models.ParseScoreRanges(getConfigValue(pf.scoreRanges, "REDCAP_SCORE_RANGES", ""))
+	if err == nil {
+		project.Rules.ScoreRanges, err = project.Fields.StandardScoreRanges(scoreRanges)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	earliest := getConfigValue(pf.earliestDate, "REDCAP_EARLIEST_DATE", models.DefaultEarliestDate)
+	if project.Rules.EarliestDate, err = time.ParseInLocation("2006-01-02", earliest, time.Local); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid earliest risk factor date: %s\n", err)
+		os.Exit(1)
+	}
+	if project.Rules.FutureTolerance, err = time.ParseDuration(getConfigValue(pf.futureTolerance, "REDCAP_FUTURE_TOLERANCE", "0s")); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid future tolerance: %s\n", err)
+		os.Exit(1)
+	}
+	return project
+}
+
+// tlsFlags holds the args used to configure TLS for a server
+type tlsFlags struct {
+	ca, cert, key, minVersion *string
+}
+
+// toClient creates the HTTP client from the args, falling back to env vars with the given prefix
+func (tf *tlsFlags) toClient(envPrefix string) (*http.Client, error) {
+	return client.NewHTTPClient(client.TLSOptions{
+		CAFile:     getConfigValue(tf.ca, envPrefix+"_CA_FILE", ""),
+		CertFile:   getConfigValue(tf.cert, envPrefix+"_CERT_FILE", ""),
+		KeyFile:    getConfigValue(tf.key, envPrefix+"_KEY_FILE", ""),
+		MinVersion: getConfigValue(tf.minVersion, envPrefix+"_TLS_MIN_VERSION", ""),
+	})
+}
+
+func getListConfigValue(parsedFlag *string, envVar string) []string {
+	var list []string
+	for _, val := range strings.Split(getConfigValue(parsedFlag, envVar, ""), ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			list = append(list, val)
+		}
+	}
+	return list
+}
+
 func getRequiredConfigValue(parsedFlag *string, envVar string, name string) string {
 	val := getConfigValue(parsedFlag, envVar, "")
 	if val == "" {
@@ -98,7 +464,7 @@ func getRequiredConfigValue(parsedFlag *string, envVar string, name string) stri
 func discoverSelf() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Println("Unable to determine IP address.  Defaulting to localhost.")
+		slog.Warn("Unable to determine IP address.  Defaulting to localhost.")
 		return "localhost"
 	}
 
@@ -110,6 +476,6 @@ func discoverSelf() string {
 		}
 	}
 
-	log.Println("Unable to determine IP address.  Defaulting to localhost.")
+	slog.Warn("Unable to determine IP address.  Defaulting to localhost.")
 	return "localhost"
 }
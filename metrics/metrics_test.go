@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestMetricsSuite(t *testing.T) {
+	suite.Run(t, new(MetricsSuite))
+}
+
+type MetricsSuite struct {
+	suite.Suite
+}
+
+func (suite *MetricsSuite) write() string {
+	var buf bytes.Buffer
+	suite.Require().NoError(DefaultRegistry.WritePrometheus(&buf))
+	return buf.String()
+}
+
+func (suite *MetricsSuite) TestCounter() {
+	assert := suite.Assert()
+
+	c := NewCounterVec("test_requests_total", "Test requests.", "method", "code")
+	c.Inc("GET", "200")
+	c.Inc("GET", "200")
+	c.Add(2.5, "POST", "500")
+	assert.Equal(2.0, c.Value("GET", "200"))
+	assert.Equal(0.0, c.Value("GET", "404"))
+
+	out := suite.write()
+	assert.Contains(out, "# HELP test_requests_total Test requests.\n# TYPE test_requests_total counter\n")
+	assert.Contains(out, "test_requests_total{method=\"GET\",code=\"200\"} 2\ntest_requests_total{method=\"POST\",code=\"500\"} 2.5\n")
+
+	assert.Panics(func() { c.Inc("GET") })
+	assert.Panics(func() { c.Add(-1, "GET", "200") })
+	assert.Panics(func() { NewCounterVec("test_requests_total", "Duplicate.") })
+}
+
+func (suite *MetricsSuite) TestGauge() {
+	assert := suite.Assert()
+
+	g := NewGaugeVec("test_last_run_timestamp_seconds", "Test gauge.")
+	g.Set(1466000000)
+	assert.Equal(1466000000.0, g.Value())
+	assert.Contains(suite.write(), "# TYPE test_last_run_timestamp_seconds gauge\ntest_last_run_timestamp_seconds 1.466e+09\n")
+}
+
+func (suite *MetricsSuite) TestHistogram() {
+	assert := suite.Assert()
+
+	h := NewHistogramVec("test_duration_seconds", "Test histogram.", []float64{0.1, 1}, "operation")
+	h.Observe(0.05, "search")
+	h.Observe(0.5, "search")
+	h.Observe(2, "search")
+	assert.EqualValues(3, h.Count("search"))
+	assert.EqualValues(0, h.Count("post"))
+
+	assert.Contains(suite.write(), `# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{operation="search",le="0.1"} 1
+test_duration_seconds_bucket{operation="search",le="1"} 2
+test_duration_seconds_bucket{operation="search",le="+Inf"} 3
+test_duration_seconds_sum{operation="search"} 2.55
+test_duration_seconds_count{operation="search"} 3
+`)
+}
+
+func (suite *MetricsSuite) TestEscaping() {
+	c := NewCounterVec("test_escaped_total", "Help with \\ and\nnewline.", "source")
+	c.Inc("clinic \"a\"\n")
+	out := suite.write()
+	suite.Contains(out, "# HELP test_escaped_total Help with \\\\ and\\nnewline.\n")
+	suite.Contains(out, `test_escaped_total{source="clinic \"a\"\n"} 1`)
+}
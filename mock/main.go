@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -19,7 +20,6 @@ import (
 	"github.com/intervention-engine/multifactorriskservice/client"
 	"github.com/intervention-engine/multifactorriskservice/models"
 	"github.com/intervention-engine/multifactorriskservice/server"
-	"github.com/intervention-engine/riskservice/service"
 	"gopkg.in/mgo.v2"
 )
 
@@ -28,6 +28,7 @@ func main() {
 	httpFlag := flag.String("http", "", "HTTP service address to listen on (env: HTTP_HOST_AND_PORT, default: \":9000\")")
 	mongoFlag := flag.String("mongo", "", "MongoDB address (env: MONGO_URL, default: \"mongodb://localhost:27017\")")
 	fhirFlag := flag.String("fhir", "", "FHIR API address (env: FHIR_URL, default: \"http://localhost:3001\")")
+	fhirAuth := client.BindFHIRAuthFlags(flag.CommandLine)
 	genFlag := flag.Bool("gen", false, "Flag to indicate that mock risk assessments should be generated immediately")
 	flag.Parse()
 
@@ -49,6 +50,15 @@ func main() {
 		fhir = "http://localhost" + fhir
 	}
 
+	auth, err := client.NewFHIRAuth(fhirAuth.Options(), client.FHIRClient, fhir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid FHIR authorization configuration: %s\n", err)
+		os.Exit(1)
+	}
+	if auth != nil {
+		client.FHIRClient = client.NewAuthClient(client.FHIRClient, auth)
+	}
+
 	session, err := mgo.Dial(mongo)
 	if err != nil {
 		panic("Can't connect to the database")
@@ -73,7 +83,7 @@ func main() {
 		if err != nil {
 			log.Println("Failed to generate mock risk assessments", err)
 		} else {
-			client.LogResultSummary(results)
+			client.LogResultSummary(context.Background(), results)
 		}
 	}
 	e.Run(httpa)
@@ -93,7 +103,7 @@ func RegisterMockRefreshHandler(e *gin.Engine, fhirEndpoint string, pieCollectio
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
-		client.LogResultSummary(results)
+		client.LogResultSummary(context.Background(), results)
 		c.JSON(http.StatusOK, results)
 	})
 }
@@ -119,7 +129,7 @@ func RefreshMockRiskAssessments(fhirEndpoint string, pieCollection *mgo.Collecti
 			FHIRPatientID: id,
 		}
 		calcResults := study.ToRiskServiceCalculationResults(fhirEndpoint + "/Patient/" + id)
-		err = service.UpdateRiskAssessmentsAndPies(fhirEndpoint, id, calcResults, pieCollection, basisPieURL, client.REDCapRiskServiceConfig)
+		err = client.UpdateRiskAssessmentsAndPies(context.Background(), fhirEndpoint, id, calcResults, pieCollection, basisPieURL, client.REDCapRiskServiceConfig)
 		if err != nil {
 			result.Error = err
 		} else {
@@ -142,7 +152,7 @@ func getPatientSummariesFromFHIR(fhirEndpoint string) (map[string]patientSummary
 			return nil, err
 		}
 		r.Header.Set("Accept", "application/json")
-		res, err := http.DefaultClient.Do(r)
+		res, err := client.FHIRClient.Do(r)
 		if err != nil {
 			return nil, err
 		}
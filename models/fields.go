@@ -0,0 +1,134 @@
+package models
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// StandardFields lists the REDCap fields used by Record, using the field names from the original risk stratification
+// project.  The REDCap event and repeat fields are exported automatically, so they don't need to be requested.
+var StandardFields = []string{"study_id", "redcap_event_name", "rf_date", "rf_cmc_risk_cat", "rf_func_risk_cat",
+	"rf_sb_risk_cat", "rf_util_risk_cat", "rf_risk_predicted", "risk_factors_complete"}
+
+// FieldMapping maps the standard field names (e.g., "rf_date") to the field names used by a specific REDCap project.
+// Fields that aren't mapped use the standard name.
+type FieldMapping map[string]string
+
+// Field returns the project's field name for the given standard field name
+func (m FieldMapping) Field(standard string) string {
+	if name, ok := m[standard]; ok && name != "" {
+		return name
+	}
+	return standard
+}
+
+// ProjectFields returns the project's field names for all of the standard fields
+func (m FieldMapping) ProjectFields() []string {
+	fields := make([]string, len(StandardFields))
+	for i := range StandardFields {
+		fields[i] = m.Field(StandardFields[i])
+	}
+	return fields
+}
+
+// ToStandard renames the keys of a raw REDCap record from the project's field names to the standard field names
+func (m FieldMapping) ToStandard(raw map[string]interface{}) map[string]interface{} {
+	if len(m) == 0 {
+		return raw
+	}
+	renamed := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		renamed[k] = v
+	}
+	for standard, name := range m {
+		if name == "" || name == standard {
+			continue
+		}
+		if v, ok := raw[name]; ok {
+			renamed[standard] = v
+			delete(renamed, name)
+		}
+	}
+	return renamed
+}
+
+// DecodeRecords decodes a REDCap JSON export (a list of flat records) using the project's field names
+func (m FieldMapping) DecodeRecords(r io.Reader) ([]Record, error) {
+	if len(m) == 0 {
+		var records []Record
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	return m.ToRecords(raw)
+}
+
+// ToRecords converts raw REDCap records using the project's field names to Records
+func (m FieldMapping) ToRecords(raw []map[string]interface{}) ([]Record, error) {
+	records := make([]Record, len(raw))
+	for i := range raw {
+		data, err := json.Marshal(m.ToStandard(raw[i]))
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &records[i]); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// REDCap export file formats
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// DecodeCSVRecords decodes a REDCap CSV export (with raw field names in the header row and raw values) using the
+// project's field names.  Exports with labels instead of raw names and values are not supported.
+func (m FieldMapping) DecodeCSVRecords(r io.Reader) ([]Record, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// REDCap starts its CSV exports with a byte order mark
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	header := rows[0]
+	raw := make([]map[string]interface{}, len(rows)-1)
+	for i, row := range rows[1:] {
+		raw[i] = make(map[string]interface{}, len(header))
+		for j, name := range header {
+			raw[i][name] = row[j]
+		}
+	}
+	return m.ToRecords(raw)
+}
+
+// DecodeExport decodes a REDCap export file in the given format (csv or json) using the project's field names
+func (m FieldMapping) DecodeExport(r io.Reader, format string) ([]Record, error) {
+	switch format {
+	case FormatCSV:
+		return m.DecodeCSVRecords(r)
+	case FormatJSON:
+		return m.DecodeRecords(r)
+	default:
+		return nil, fmt.Errorf("Invalid export format %s (must be csv or json)", format)
+	}
+}
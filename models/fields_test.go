@@ -0,0 +1,110 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestFieldMappingSuite(t *testing.T) {
+	suite.Run(t, new(FieldMappingSuite))
+}
+
+type FieldMappingSuite struct {
+	suite.Suite
+}
+
+func (suite *FieldMappingSuite) TestProjectFields() {
+	assert := suite.Assert()
+
+	var empty FieldMapping
+	assert.Equal(StandardFields, empty.ProjectFields())
+
+	m := FieldMapping{"study_id": "record_id", "rf_date": "assessment_date"}
+	fields := m.ProjectFields()
+	assert.Len(fields, len(StandardFields))
+	assert.Equal("record_id", fields[0])
+	assert.Equal("redcap_event_name", fields[1])
+	assert.Equal("assessment_date", fields[2])
+	assert.Equal("rf_cmc_risk_cat", fields[3])
+}
+
+func (suite *FieldMappingSuite) TestDecodeRecordsWithoutMapping() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var m FieldMapping
+	records, err := m.DecodeRecords(strings.NewReader(`[{"study_id": "1", "rf_date": "2016-01-01", "rf_cmc_risk_cat": "2"}]`))
+	require.NoError(err)
+	require.Len(records, 1)
+	assert.Equal("1", records[0].StudyID)
+	assert.Equal("2016-01-01", records[0].RiskFactorDate)
+	assert.Equal("2", records[0].ClinicalRisk)
+}
+
+func (suite *FieldMappingSuite) TestDecodeRecordsWithMapping() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	m := FieldMapping{"study_id": "record_id", "rf_date": "assessment_date", "rf_cmc_risk_cat": "cmc"}
+	records, err := m.DecodeRecords(strings.NewReader(`[{"record_id": "7", "redcap_event_name": "initial_arm_1",
+		"assessment_date": "2016-01-01", "cmc": "3", "rf_func_risk_cat": "1", "study_id": "ignored"}]`))
+	require.NoError(err)
+	require.Len(records, 1)
+	assert.Equal("7", records[0].StudyID)
+	assert.Equal("initial_arm_1", records[0].EventName)
+	assert.Equal("2016-01-01", records[0].RiskFactorDate)
+	assert.Equal("3", records[0].ClinicalRisk)
+	assert.Equal("1", records[0].FunctionalRisk)
+}
+
+func (suite *FieldMappingSuite) TestDecodeRecordsInvalidJSON() {
+	m := FieldMapping{"study_id": "record_id"}
+	_, err := m.DecodeRecords(strings.NewReader(`{"record_id": "7"`))
+	suite.Error(err)
+}
+
+func (suite *FieldMappingSuite) TestDecodeCSVRecords() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	m := FieldMapping{"study_id": "record_id"}
+	records, err := m.DecodeCSVRecords(strings.NewReader("\xef\xbb\xbfrecord_id,redcap_event_name,rf_date,rf_cmc_risk_cat\n" +
+		"1,initial_arm_1,2016-01-01,2\n" +
+		"\"a\",visit1_arm_1,,\n"))
+	require.NoError(err)
+	require.Len(records, 2)
+	assert.Equal("1", records[0].StudyIDString())
+	assert.Equal("initial_arm_1", records[0].EventName)
+	assert.Equal("2016-01-01", records[0].RiskFactorDate)
+	assert.Equal("2", records[0].ClinicalRisk)
+	assert.Equal("a", records[1].StudyIDString())
+	assert.Empty(records[1].RiskFactorDate)
+
+	records, err = m.DecodeCSVRecords(strings.NewReader(""))
+	require.NoError(err)
+	assert.Empty(records)
+
+	_, err = m.DecodeCSVRecords(strings.NewReader("record_id,rf_date\n1\n"))
+	assert.Error(err)
+}
+
+func (suite *FieldMappingSuite) TestDecodeExport() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var m FieldMapping
+	records, err := m.DecodeExport(strings.NewReader(`[{"study_id": "1"}]`), FormatJSON)
+	require.NoError(err)
+	require.Len(records, 1)
+	records, err = m.DecodeExport(strings.NewReader("study_id\n1\n"), FormatCSV)
+	require.NoError(err)
+	require.Len(records, 1)
+	assert.Equal("1", records[0].StudyIDString())
+
+	_, err = m.DecodeExport(strings.NewReader(""), "xml")
+	assert.Error(err)
+}
@@ -0,0 +1,73 @@
+package models
+
+import "path"
+
+// Reasons a record may be skipped during import
+const (
+	SkipArmNotIncluded   = "arm not included"
+	SkipEventNotIncluded = "event not included"
+	SkipEventExcluded    = "event excluded"
+	SkipFormStatus       = "form status below minimum"
+	SkipNoRiskFactors    = "no risk factors"
+)
+
+// RecordFilter determines which REDCap records should be imported.  Empty criteria allow all records.  Event lists
+// may contain exact unique event names or shell-style patterns (e.g., "screening_*").
+type RecordFilter struct {
+	// Arms lists the arm numbers to import (e.g., "1")
+	Arms []string
+	// IncludeEvents lists the events to import.  If empty, all events not excluded are imported.
+	IncludeEvents []string
+	// ExcludeEvents lists the events to skip, even if they are also included
+	ExcludeEvents []string
+	// MinFormStatus is the minimum risk factors form status to import (FormIncomplete, FormUnverified, or
+	// FormComplete).  Records with an invalid status are only imported if the minimum is FormIncomplete.
+	MinFormStatus int
+}
+
+// Allows indicates if the record should be imported according to the filter
+func (f *RecordFilter) Allows(r *Record) bool {
+	return f.SkipReason(r) == ""
+}
+
+// SkipReason returns the reason the record should be skipped according to the filter, or an empty string if the
+// record should be imported.  Records whose risk factors form was never filled out are reported as having no risk
+// factors rather than as having a low form status.
+func (f *RecordFilter) SkipReason(r *Record) string {
+	if len(f.Arms) > 0 && !contains(f.Arms, r.Arm()) {
+		return SkipArmNotIncluded
+	}
+	if len(f.IncludeEvents) > 0 && !matchesAny(f.IncludeEvents, r.EventName) {
+		return SkipEventNotIncluded
+	}
+	if matchesAny(f.ExcludeEvents, r.EventName) {
+		return SkipEventExcluded
+	}
+	if f.MinFormStatus > FormIncomplete {
+		if !r.HasRiskFactors() {
+			return SkipNoRiskFactors
+		}
+		if status, err := r.RiskFactorsStatus(); err != nil || status < f.MinFormStatus {
+			return SkipFormStatus
+		}
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, s string) bool {
+	for i := range patterns {
+		if matched, err := path.Match(patterns[i], s); (err == nil && matched) || patterns[i] == s {
+			return true
+		}
+	}
+	return false
+}
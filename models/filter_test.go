@@ -0,0 +1,96 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestRecordFilterSuite(t *testing.T) {
+	suite.Run(t, new(RecordFilterSuite))
+}
+
+type RecordFilterSuite struct {
+	suite.Suite
+}
+
+func (suite *RecordFilterSuite) TestEmptyFilterAllowsEverything() {
+	assert := suite.Assert()
+
+	f := RecordFilter{}
+	assert.True(f.Allows(&Record{EventName: "initial_arm_1"}))
+	assert.True(f.Allows(&Record{EventName: "screening_arm_2"}))
+	assert.True(f.Allows(&Record{}))
+}
+
+func (suite *RecordFilterSuite) TestArms() {
+	assert := suite.Assert()
+
+	f := RecordFilter{Arms: []string{"1", "3"}}
+	assert.Equal("", f.SkipReason(&Record{EventName: "initial_arm_1"}))
+	assert.Equal(SkipArmNotIncluded, f.SkipReason(&Record{EventName: "initial_arm_2"}))
+	assert.Equal("", f.SkipReason(&Record{EventName: "initial_arm_3"}))
+}
+
+func (suite *RecordFilterSuite) TestIncludeEvents() {
+	assert := suite.Assert()
+
+	f := RecordFilter{IncludeEvents: []string{"initial_arm_1", "visit*_arm_1"}}
+	assert.Equal("", f.SkipReason(&Record{EventName: "initial_arm_1"}))
+	assert.Equal("", f.SkipReason(&Record{EventName: "visit1_arm_1"}))
+	assert.Equal("", f.SkipReason(&Record{EventName: "visit12_arm_1"}))
+	assert.Equal(SkipEventNotIncluded, f.SkipReason(&Record{EventName: "visit1_arm_2"}))
+	assert.Equal(SkipEventNotIncluded, f.SkipReason(&Record{EventName: "screening_arm_1"}))
+}
+
+func (suite *RecordFilterSuite) TestExcludeEvents() {
+	assert := suite.Assert()
+
+	f := RecordFilter{ExcludeEvents: []string{"screening_*", "test_arm_1"}}
+	assert.Equal("", f.SkipReason(&Record{EventName: "initial_arm_1"}))
+	assert.Equal(SkipEventExcluded, f.SkipReason(&Record{EventName: "screening_arm_1"}))
+	assert.Equal(SkipEventExcluded, f.SkipReason(&Record{EventName: "test_arm_1"}))
+}
+
+func (suite *RecordFilterSuite) TestExcludeOverridesInclude() {
+	assert := suite.Assert()
+
+	f := RecordFilter{IncludeEvents: []string{"*_arm_1"}, ExcludeEvents: []string{"screening_arm_1"}}
+	assert.Equal("", f.SkipReason(&Record{EventName: "initial_arm_1"}))
+	assert.Equal(SkipEventExcluded, f.SkipReason(&Record{EventName: "screening_arm_1"}))
+}
+
+func (suite *RecordFilterSuite) TestMinFormStatus() {
+	assert := suite.Assert()
+
+	f := RecordFilter{MinFormStatus: FormComplete}
+	assert.Equal("", f.SkipReason(&Record{ClinicalRisk: "1", RiskFactorsComplete: "2"}))
+	assert.Equal(SkipFormStatus, f.SkipReason(&Record{ClinicalRisk: "1", RiskFactorsComplete: "1"}))
+	assert.Equal(SkipFormStatus, f.SkipReason(&Record{ClinicalRisk: "1", RiskFactorsComplete: "0"}))
+	assert.Equal(SkipFormStatus, f.SkipReason(&Record{ClinicalRisk: "1"}))
+	assert.Equal(SkipFormStatus, f.SkipReason(&Record{ClinicalRisk: "1", RiskFactorsComplete: "bogus"}))
+
+	f = RecordFilter{MinFormStatus: FormUnverified}
+	assert.Equal("", f.SkipReason(&Record{ClinicalRisk: "1", RiskFactorsComplete: "2"}))
+	assert.Equal("", f.SkipReason(&Record{ClinicalRisk: "1", RiskFactorsComplete: "1"}))
+	assert.Equal(SkipFormStatus, f.SkipReason(&Record{ClinicalRisk: "1", RiskFactorsComplete: "0"}))
+
+	f = RecordFilter{MinFormStatus: FormIncomplete}
+	assert.Equal("", f.SkipReason(&Record{RiskFactorsComplete: "0"}))
+	assert.Equal("", f.SkipReason(&Record{RiskFactorsComplete: "bogus"}))
+}
+
+func (suite *RecordFilterSuite) TestMinFormStatusWithoutRiskFactors() {
+	assert := suite.Assert()
+
+	// A risk factors form that was never filled out has no status, but it shouldn't be counted as a low status
+	f := RecordFilter{MinFormStatus: FormComplete}
+	assert.Equal(SkipNoRiskFactors, f.SkipReason(&Record{RiskFactorsComplete: "0"}))
+	assert.Equal(SkipNoRiskFactors, f.SkipReason(&Record{}))
+
+	// Arm and event reasons still take precedence
+	f = RecordFilter{Arms: []string{"1"}, MinFormStatus: FormComplete}
+	assert.Equal(SkipArmNotIncluded, f.SkipReason(&Record{EventName: "initial_arm_2"}))
+}
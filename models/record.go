@@ -3,6 +3,7 @@ package models
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
 	"time"
 
@@ -11,31 +12,80 @@ import (
 	"github.com/intervention-engine/riskservice/plugin"
 )
 
-// Record represents the key info from a REDCap record in the risk stratification project
+// Record represents the key info from a REDCap record in the risk stratification project.  Projects using repeating
+// instruments export one record per repeat instance, identified by the repeat instrument and instance number.
 type Record struct {
-	StudyID   interface{} `json:"study_id"`
-	EventName string      `json:"redcap_event_name"`
-
-	RiskFactorDate   string `json:"rf_date"`
-	ClinicalRisk     string `json:"rf_cmc_risk_cat"`
-	FunctionalRisk   string `json:"rf_func_risk_cat"`
-	PsychosocialRisk string `json:"rf_sb_risk_cat"`
-	UtilizationRisk  string `json:"rf_util_risk_cat"`
-	PerceivedRisk    string `json:"rf_risk_predicted"`
+	StudyID          interface{} `json:"study_id"`
+	EventName        string      `json:"redcap_event_name"`
+	RepeatInstrument string      `json:"redcap_repeat_instrument"`
+	RepeatInstance   interface{} `json:"redcap_repeat_instance"`
+
+	RiskFactorDate      string `json:"rf_date"`
+	ClinicalRisk        string `json:"rf_cmc_risk_cat"`
+	FunctionalRisk      string `json:"rf_func_risk_cat"`
+	PsychosocialRisk    string `json:"rf_sb_risk_cat"`
+	UtilizationRisk     string `json:"rf_util_risk_cat"`
+	PerceivedRisk       string `json:"rf_risk_predicted"`
+	RiskFactorsComplete string `json:"risk_factors_complete"`
 }
 
+// REDCap form completion statuses, as exported in the <instrument>_complete field
+const (
+	FormIncomplete = 0
+	FormUnverified = 1
+	FormComplete   = 2
+)
+
 // StudyIDString returns a string representation of the study ID (which could be a string or a number)
 func (r *Record) StudyIDString() string {
 	return fmt.Sprint(r.StudyID)
 }
 
+// RepeatInstanceString returns a string representation of the repeat instance (which could be a string or a number).
+// If the record is not a repeat instance, it returns an empty string.
+func (r *Record) RepeatInstanceString() string {
+	if r.RepeatInstance == nil {
+		return ""
+	}
+	return fmt.Sprint(r.RepeatInstance)
+}
+
+// IsRepeatInstance indicates if the record represents an instance of a repeating instrument
+func (r *Record) IsRepeatInstance() bool {
+	return r.RepeatInstrument != "" || r.RepeatInstanceString() != ""
+}
+
+var armRegexp = regexp.MustCompile(`_arm_(\d+)$`)
+
+// Arm returns the arm number from the unique REDCap event name (e.g., "2" for "visit1_arm_2").  If the event name
+// doesn't indicate an arm, it returns an empty string.
+func (r *Record) Arm() string {
+	if match := armRegexp.FindStringSubmatch(r.EventName); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
 // RiskFactorDateTime returns the parsed date/time for the risk factor form
 func (r *Record) RiskFactorDateTime() (time.Time, error) {
 	return time.ParseInLocation("2006-01-02", r.RiskFactorDate, time.Local)
 }
 
-// IsRiskFactorsComplete checks that the risk factors form was marked as complete, that a valid risk factor date was
-// set, and that all risk factor scores are set
+// RiskFactorsStatus returns the completion status of the risk factors form (FormIncomplete, FormUnverified, or
+// FormComplete).  A record without a status is considered incomplete.
+func (r *Record) RiskFactorsStatus() (int, error) {
+	if r.RiskFactorsComplete == "" {
+		return FormIncomplete, nil
+	}
+	status, err := strconv.Atoi(r.RiskFactorsComplete)
+	if err != nil || status < FormIncomplete || status > FormComplete {
+		return FormIncomplete, fmt.Errorf("Invalid risk factors form status: %s", r.RiskFactorsComplete)
+	}
+	return status, nil
+}
+
+// IsRiskFactorsComplete checks that a valid risk factor date was set and that all risk factor scores are set.  Note
+// that this does not check the form's completion status (see RiskFactorsStatus).
 func (r *Record) IsRiskFactorsComplete() bool {
 	return r.RiskFactorDate != "" && r.ClinicalRisk != "" && r.FunctionalRisk != "" &&
 		r.PsychosocialRisk != "" && r.UtilizationRisk != "" && r.PerceivedRisk != ""
@@ -103,14 +153,14 @@ func (r *Record) ToRiskServiceCalculationResult(patientURL string) (result *plug
 
 func newSlice(name string, score string) (slice *plugin.Slice, err error) {
 	value, err := strconv.Atoi(score)
-	if err != nil {
+	if err != nil || value < MinRiskScore || value > MaxRiskScore {
 		return nil, fmt.Errorf("Invalid %s: %s", name, score)
 	}
 	slice = new(plugin.Slice)
 	slice.Name = name
 	slice.Value = value
 	slice.Weight = 25
-	slice.MaxValue = 4
+	slice.MaxValue = MaxRiskScore
 
 	return
 }
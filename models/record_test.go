@@ -42,6 +42,7 @@ func (suite *RecordSuite) TestLoadRecordsFromJSON() {
 		PsychosocialRisk:    "1",
 		UtilizationRisk:     "3",
 		PerceivedRisk:       "3",
+		RiskFactorsComplete: "2",
 	}, suite.Records[0])
 	assert.Equal(Record{
 		StudyID:             float64(1),
@@ -52,6 +53,7 @@ func (suite *RecordSuite) TestLoadRecordsFromJSON() {
 		PsychosocialRisk:    "1",
 		UtilizationRisk:     "4",
 		PerceivedRisk:       "4",
+		RiskFactorsComplete: "2",
 	}, suite.Records[1])
 	assert.Equal(Record{
 		StudyID:             "a",
@@ -62,6 +64,7 @@ func (suite *RecordSuite) TestLoadRecordsFromJSON() {
 		PsychosocialRisk:    "2",
 		UtilizationRisk:     "1",
 		PerceivedRisk:       "2",
+		RiskFactorsComplete: "2",
 	}, suite.Records[2])
 }
 
@@ -87,6 +90,29 @@ func (suite *RecordSuite) TestRiskFactorDateTime() {
 	assert.Equal(time.Date(2016, time.February, 21, 0, 0, 0, 0, time.Local), t)
 }
 
+func (suite *RecordSuite) TestRiskFactorsStatus() {
+	assert := suite.Assert()
+
+	record := suite.Records[0]
+	status, err := record.RiskFactorsStatus()
+	assert.NoError(err)
+	assert.Equal(FormComplete, status)
+
+	record.RiskFactorsComplete = "1"
+	status, err = record.RiskFactorsStatus()
+	assert.NoError(err)
+	assert.Equal(FormUnverified, status)
+
+	record.RiskFactorsComplete = ""
+	status, err = record.RiskFactorsStatus()
+	assert.NoError(err)
+	assert.Equal(FormIncomplete, status)
+
+	record.RiskFactorsComplete = "3"
+	_, err = record.RiskFactorsStatus()
+	assert.Error(err)
+}
+
 func (suite *RecordSuite) TestIsRiskFactorsComplete() {
 	assert := suite.Assert()
 	record := suite.Records[0]
@@ -129,6 +155,18 @@ func (suite *RecordSuite) TestIncompleteRiskFactorsToPie() {
 	assert.Error(err)
 }
 
+func (suite *RecordSuite) TestOutOfRangeRiskFactorsToPie() {
+	assert := suite.Assert()
+
+	for _, score := range []string{"0", "5", "44", "-1"} {
+		record := suite.Records[0]
+		record.ClinicalRisk = score
+		pie, err := record.ToPie("http://fhir/Patient/1")
+		assert.Nil(pie)
+		assert.Error(err)
+	}
+}
+
 func (suite *RecordSuite) TestToRiskServiceCalculationResult() {
 	assert := suite.Assert()
 	require := suite.Require()
@@ -164,3 +202,34 @@ func (suite *RecordSuite) assertPieForRecord0(pie *plugin.Pie) {
 	assert.Equal("Utilization Risk", pie.Slices[3].Name)
 	assert.Equal(3, pie.Slices[3].Value)
 }
+
+func (suite *RecordSuite) TestLoadRepeatingInstrumentRecordFromJSON() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var records []Record
+	err := json.Unmarshal([]byte(`[
+		{"study_id": 1, "redcap_event_name": "initial_arm_2", "redcap_repeat_instrument": "", "redcap_repeat_instance": ""},
+		{"study_id": 1, "redcap_event_name": "initial_arm_2", "redcap_repeat_instrument": "risk_factors", "redcap_repeat_instance": 2}
+	]`), &records)
+	require.NoError(err)
+	require.Len(records, 2)
+
+	assert.False(records[0].IsRepeatInstance())
+	assert.Equal("", records[0].RepeatInstanceString())
+	assert.True(records[1].IsRepeatInstance())
+	assert.Equal("risk_factors", records[1].RepeatInstrument)
+	assert.Equal("2", records[1].RepeatInstanceString())
+}
+
+func (suite *RecordSuite) TestArm() {
+	assert := suite.Assert()
+	assert.Equal("1", suite.Records[0].Arm())
+
+	record := suite.Records[0]
+	record.EventName = "visit12_arm_10"
+	assert.Equal("10", record.Arm())
+
+	record.EventName = "visit12"
+	assert.Equal("", record.Arm())
+}
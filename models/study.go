@@ -8,8 +8,16 @@ import (
 
 // Study represents a single study / patient, containing all of the records making up the study
 type Study struct {
-	ID                  string
-	Records             []Record
+	ID      string
+	Records []Record
+	Skipped []SkippedRecord
+	Invalid []InvalidRecord
+}
+
+// SkippedRecord represents a record that was intentionally not imported, along with the reason it was skipped
+type SkippedRecord struct {
+	Record Record
+	Reason string
 }
 
 // AddRecord adds a record to the study, checking to ensure it has the same Study ID
@@ -28,6 +36,61 @@ func (s *Study) AddRecord(r Record) error {
 	return nil
 }
 
+// Filter removes the records that are not allowed by the filter, noting them as skipped records
+func (s *Study) Filter(f RecordFilter) {
+	records := s.Records[:0]
+	for i := range s.Records {
+		if reason := f.SkipReason(&s.Records[i]); reason != "" {
+			s.Skipped = append(s.Skipped, SkippedRecord{Record: s.Records[i], Reason: reason})
+		} else {
+			records = append(records, s.Records[i])
+		}
+	}
+	s.Records = records
+}
+
+// Validate removes the records that fail validation against the rules, noting them as invalid records along with the
+// reasons they failed.  Records that don't have any risk factors at all are noted as skipped records instead.
+func (s *Study) Validate(rules ValidationRules) {
+	records := s.Records[:0]
+	for i := range s.Records {
+		if !s.Records[i].HasRiskFactors() {
+			s.Skipped = append(s.Skipped, SkippedRecord{Record: s.Records[i], Reason: SkipNoRiskFactors})
+		} else if errs := s.Records[i].Validate(rules); len(errs) > 0 {
+			s.Invalid = append(s.Invalid, InvalidRecord{Record: s.Records[i], Errors: errs})
+		} else {
+			records = append(records, s.Records[i])
+		}
+	}
+	s.Records = records
+}
+
+// SkippedCounts returns the number of skipped records, indexed by the reason they were skipped.  If no records were
+// skipped, it returns nil.
+func (s *Study) SkippedCounts() map[string]int {
+	if len(s.Skipped) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for i := range s.Skipped {
+		counts[s.Skipped[i].Reason]++
+	}
+	return counts
+}
+
+// Arms returns the distinct arms represented by the study's records
+func (s *Study) Arms() []string {
+	var arms []string
+	seen := make(map[string]bool)
+	for i := range s.Records {
+		if arm := s.Records[i].Arm(); arm != "" && !seen[arm] {
+			seen[arm] = true
+			arms = append(arms, arm)
+		}
+	}
+	return arms
+}
+
 // ToRiskServiceCalculationResults converts the records to RiskServiceCalculationResults and returns them sorted
 // by the AsOf date.  Note that the size of the resulting list may be smaller than the size of the record list since
 // some records may represent incomplete risk factors.  The corresponding patientURL must be passed in so the risk pie
@@ -69,3 +132,17 @@ func (s StudyMap) AddRecords(r []Record) error {
 	}
 	return nil
 }
+
+// Filter removes the records from each study that are not allowed by the filter, noting them as skipped records
+func (s StudyMap) Filter(f RecordFilter) {
+	for _, study := range s {
+		study.Filter(f)
+	}
+}
+
+// Validate removes the records from each study that fail validation against the rules, noting them as invalid records
+func (s StudyMap) Validate(rules ValidationRules) {
+	for _, study := range s {
+		study.Validate(rules)
+	}
+}
@@ -176,3 +176,76 @@ func (suite *StudySuite) TestStudyMapAddRecords() {
 	require.Len(s.Records, 1)
 	assert.Equal(suite.Records[2], s.Records[0])
 }
+
+func (suite *StudySuite) TestArms() {
+	assert := suite.Assert()
+
+	study := new(Study)
+	study.AddRecord(suite.Records[0])
+	study.AddRecord(suite.Records[1])
+	other := suite.Records[1]
+	other.EventName = "visit1_arm_2"
+	study.AddRecord(other)
+
+	assert.Equal([]string{"1", "2"}, study.Arms())
+}
+
+func (suite *StudySuite) TestStudyMapFilterByArm() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	other := suite.Records[1]
+	other.EventName = "visit1_arm_2"
+
+	m := make(StudyMap)
+	m.AddRecords(suite.Records)
+	m.AddRecord(other)
+	require.Len(m["1"].Records, 3)
+
+	m.Filter(RecordFilter{Arms: []string{"2"}})
+	require.Len(m["1"].Records, 1)
+	assert.Equal(other, m["1"].Records[0])
+	assert.Len(m["a"].Records, 0)
+}
+
+func (suite *StudySuite) TestToRiskServiceCalculationResultsWithRepeatInstances() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// The base record for the event has no risk factor data, while each repeat instance has its own date
+	base := Record{StudyID: "1", EventName: "initial_arm_1"}
+	first := suite.Records[0]
+	first.RepeatInstrument, first.RepeatInstance = "risk_factors", float64(1)
+	second := suite.Records[1]
+	second.EventName, second.RepeatInstrument, second.RepeatInstance = "initial_arm_1", "risk_factors", float64(2)
+
+	study := new(Study)
+	study.AddRecord(base)
+	study.AddRecord(first)
+	study.AddRecord(second)
+	results := study.ToRiskServiceCalculationResults("http://fhir/Patient/1")
+
+	require.Len(results, 2)
+	assert.Equal(time.Date(2015, time.December, 7, 0, 0, 0, 0, time.Local), results[0].AsOf)
+	assert.Equal(time.Date(2016, time.April, 1, 0, 0, 0, 0, time.Local), results[1].AsOf)
+}
+
+func (suite *StudySuite) TestFilterSkippedCounts() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	screening := suite.Records[0]
+	screening.EventName = "screening_arm_1"
+
+	study := new(Study)
+	study.AddRecord(suite.Records[0])
+	study.AddRecord(suite.Records[1])
+	study.AddRecord(screening)
+	assert.Nil(study.SkippedCounts())
+
+	study.Filter(RecordFilter{IncludeEvents: []string{"initial_arm_1", "screening_arm_1"}, ExcludeEvents: []string{"screening_*"}})
+	require.Len(study.Records, 1)
+	assert.Equal(suite.Records[0], study.Records[0])
+	require.Len(study.Skipped, 2)
+	assert.Equal(map[string]int{SkipEventNotIncluded: 1, SkipEventExcluded: 1}, study.SkippedCounts())
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons a record may fail validation
+const (
+	InvalidMissingField = "missing field"
+	InvalidNonNumeric   = "non-numeric value"
+	InvalidOutOfRange   = "value out of range"
+	InvalidDate         = "unparseable date"
+	InvalidFutureDate   = "date in the future"
+	InvalidEarlyDate    = "date too early"
+)
+
+// Score range for the risk factor categories, matching the scale of the pie slices
+const (
+	MinRiskScore = 1
+	MaxRiskScore = 4
+)
+
+// ScoreFields lists the standard names of the risk score fields
+var ScoreFields = []string{"rf_cmc_risk_cat", "rf_func_risk_cat", "rf_sb_risk_cat", "rf_util_risk_cat", "rf_risk_predicted"}
+
+// DefaultEarliestDate is the earliest plausible risk factor date (in YYYY-MM-DD form) used when a project doesn't
+// configure one.  Earlier dates, such as 1900-01-01 placeholders, are almost certainly data entry errors.
+const DefaultEarliestDate = "2000-01-01"
+
+// ScoreRange represents the inclusive range of valid values for a score
+type ScoreRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Contains indicates if the value is within the range
+func (s ScoreRange) Contains(value int) bool {
+	return value >= s.Min && value <= s.Max
+}
+
+// ValidationRules configures the checks performed when validating records.  The zero value uses the default score
+// range for every field and only rejects dates in the future.
+type ValidationRules struct {
+	// ScoreRanges holds the valid range for each score, indexed by standard field name (e.g., "rf_cmc_risk_cat").
+	// Fields not listed use the default range (MinRiskScore to MaxRiskScore).  Ranges configured by a project's
+	// REDCap field names are translated with FieldMapping.StandardScoreRanges.
+	ScoreRanges map[string]ScoreRange
+	// EarliestDate is the earliest plausible risk factor date.  If zero, there is no lower limit, so configured
+	// projects default to DefaultEarliestDate.
+	EarliestDate time.Time
+	// FutureTolerance is how far past the current time a risk factor date may be
+	FutureTolerance time.Duration
+}
+
+// ScoreRange returns the valid range for the given REDCap field
+func (v *ValidationRules) ScoreRange(field string) ScoreRange {
+	if r, ok := v.ScoreRanges[field]; ok {
+		return r
+	}
+	return ScoreRange{Min: MinRiskScore, Max: MaxRiskScore}
+}
+
+// StandardScoreRanges translates score ranges indexed by the project's REDCap field names to the standard field names
+// used by ValidationRules, returning an error if any field isn't one of the project's score fields
+func (m FieldMapping) StandardScoreRanges(ranges map[string]ScoreRange) (map[string]ScoreRange, error) {
+	if ranges == nil {
+		return nil, nil
+	}
+	standard := make(map[string]ScoreRange, len(ranges))
+	for field, r := range ranges {
+		var found bool
+		for _, score := range ScoreFields {
+			if m.Field(score) == field {
+				standard[score], found = r, true
+				break
+			}
+		}
+		if !found {
+			names := make([]string, len(ScoreFields))
+			for i, score := range ScoreFields {
+				names[i] = m.Field(score)
+			}
+			return nil, fmt.Errorf("Unknown score field %s (must be one of %s)", field, strings.Join(names, ", "))
+		}
+	}
+	return standard, nil
+}
+
+// ParseScoreRanges parses score ranges in the form "field=min-max", separated by commas
+// (e.g., "rf_cmc_risk_cat=1-3,rf_risk_predicted=1-4").  Each range must be within the pie slice scale.
+func ParseScoreRanges(s string) (map[string]ScoreRange, error) {
+	ranges := make(map[string]ScoreRange)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid score range: %s", item)
+		}
+		bounds := strings.SplitN(parts[1], "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid score range: %s", item)
+		}
+		min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid score range: %s", item)
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid score range: %s", item)
+		}
+		if min > max || min < MinRiskScore || max > MaxRiskScore {
+			return nil, fmt.Errorf("Score range must be within %d-%d: %s", MinRiskScore, MaxRiskScore, item)
+		}
+		ranges[strings.TrimSpace(parts[0])] = ScoreRange{Min: min, Max: max}
+	}
+	return ranges, nil
+}
+
+// ValidationError describes a single problem with a field in a REDCap record
+type ValidationError struct {
+	Reason string `json:"reason"`
+	Field  string `json:"field"`
+	Value  string `json:"value,omitempty"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%s: %s", e.Reason, e.Field)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Reason, e.Field, e.Value)
+}
+
+// InvalidRecord represents a record that was dropped because it failed validation, along with every reason it failed
+type InvalidRecord struct {
+	Record Record            `json:"record"`
+	Errors []ValidationError `json:"errors"`
+}
+
+// HasRiskFactors indicates if any of the risk factor fields are set.  Records without any risk factors typically
+// represent events where the risk factors form was not filled out at all.
+func (r *Record) HasRiskFactors() bool {
+	return r.RiskFactorDate != "" || r.ClinicalRisk != "" || r.FunctionalRisk != "" ||
+		r.PsychosocialRisk != "" || r.UtilizationRisk != "" || r.PerceivedRisk != ""
+}
+
+// Validate checks the risk factor fields against the rules, returning an error for each field that is missing or
+// invalid.  If the record is valid, it returns nil.
+func (r *Record) Validate(rules ValidationRules) []ValidationError {
+	var errs []ValidationError
+
+	if r.RiskFactorDate == "" {
+		errs = append(errs, ValidationError{Reason: InvalidMissingField, Field: "rf_date"})
+	} else if t, err := r.RiskFactorDateTime(); err != nil {
+		errs = append(errs, ValidationError{Reason: InvalidDate, Field: "rf_date", Value: r.RiskFactorDate})
+	} else if t.After(time.Now().Add(rules.FutureTolerance)) {
+		errs = append(errs, ValidationError{Reason: InvalidFutureDate, Field: "rf_date", Value: r.RiskFactorDate})
+	} else if t.Before(rules.EarliestDate) {
+		errs = append(errs, ValidationError{Reason: InvalidEarlyDate, Field: "rf_date", Value: r.RiskFactorDate})
+	}
+
+	scores := []struct {
+		field string
+		value string
+	}{
+		{"rf_cmc_risk_cat", r.ClinicalRisk},
+		{"rf_func_risk_cat", r.FunctionalRisk},
+		{"rf_sb_risk_cat", r.PsychosocialRisk},
+		{"rf_util_risk_cat", r.UtilizationRisk},
+		{"rf_risk_predicted", r.PerceivedRisk},
+	}
+	for _, score := range scores {
+		if score.value == "" {
+			errs = append(errs, ValidationError{Reason: InvalidMissingField, Field: score.field})
+		} else if value, err := strconv.Atoi(score.value); err != nil {
+			errs = append(errs, ValidationError{Reason: InvalidNonNumeric, Field: score.field, Value: score.value})
+		} else if !rules.ScoreRange(score.field).Contains(value) {
+			errs = append(errs, ValidationError{Reason: InvalidOutOfRange, Field: score.field, Value: score.value})
+		}
+	}
+
+	return errs
+}
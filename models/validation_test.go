@@ -0,0 +1,185 @@
+package models
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestValidationSuite(t *testing.T) {
+	suite.Run(t, new(ValidationSuite))
+}
+
+type ValidationSuite struct {
+	suite.Suite
+	Records []Record
+}
+
+func (suite *ValidationSuite) SetupTest() {
+	require := suite.Require()
+
+	data, err := ioutil.ReadFile("../fixtures/example_records.json")
+	require.NoError(err)
+	err = json.Unmarshal(data, &suite.Records)
+	require.NoError(err)
+}
+
+func (suite *ValidationSuite) TestValidRecords() {
+	assert := suite.Assert()
+	for i := range suite.Records {
+		assert.Nil(suite.Records[i].Validate(ValidationRules{}))
+	}
+}
+
+func (suite *ValidationSuite) TestMissingFields() {
+	assert := suite.Assert()
+
+	record := suite.Records[0]
+	record.RiskFactorDate = ""
+	record.UtilizationRisk = ""
+	assert.Equal([]ValidationError{
+		{Reason: InvalidMissingField, Field: "rf_date"},
+		{Reason: InvalidMissingField, Field: "rf_util_risk_cat"},
+	}, record.Validate(ValidationRules{}))
+}
+
+func (suite *ValidationSuite) TestInvalidScores() {
+	assert := suite.Assert()
+
+	record := suite.Records[0]
+	record.ClinicalRisk = "high"
+	record.FunctionalRisk = "44"
+	record.PsychosocialRisk = "0"
+	assert.Equal([]ValidationError{
+		{Reason: InvalidNonNumeric, Field: "rf_cmc_risk_cat", Value: "high"},
+		{Reason: InvalidOutOfRange, Field: "rf_func_risk_cat", Value: "44"},
+		{Reason: InvalidOutOfRange, Field: "rf_sb_risk_cat", Value: "0"},
+	}, record.Validate(ValidationRules{}))
+}
+
+func (suite *ValidationSuite) TestInvalidDates() {
+	assert := suite.Assert()
+
+	record := suite.Records[0]
+	record.RiskFactorDate = "12/07/2015"
+	assert.Equal([]ValidationError{
+		{Reason: InvalidDate, Field: "rf_date", Value: "12/07/2015"},
+	}, record.Validate(ValidationRules{}))
+
+	record.RiskFactorDate = time.Now().AddDate(0, 0, 2).Format("2006-01-02")
+	assert.Equal([]ValidationError{
+		{Reason: InvalidFutureDate, Field: "rf_date", Value: record.RiskFactorDate},
+	}, record.Validate(ValidationRules{}))
+}
+
+func (suite *ValidationSuite) TestValidationErrorString() {
+	assert := suite.Assert()
+	assert.Equal("missing field: rf_date", ValidationError{Reason: InvalidMissingField, Field: "rf_date"}.Error())
+	assert.Equal("value out of range: rf_sb_risk_cat (0)", ValidationError{Reason: InvalidOutOfRange, Field: "rf_sb_risk_cat", Value: "0"}.Error())
+}
+
+func (suite *ValidationSuite) TestStudyValidate() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	empty := Record{StudyID: float64(1), EventName: "visit2_arm_1"}
+	invalid := suite.Records[1]
+	invalid.ClinicalRisk = "5"
+
+	study := new(Study)
+	study.AddRecord(suite.Records[0])
+	study.AddRecord(invalid)
+	study.AddRecord(empty)
+	study.Validate(ValidationRules{})
+
+	require.Len(study.Records, 1)
+	assert.Equal(suite.Records[0], study.Records[0])
+	require.Len(study.Invalid, 1)
+	assert.Equal(invalid, study.Invalid[0].Record)
+	assert.Equal([]ValidationError{{Reason: InvalidOutOfRange, Field: "rf_cmc_risk_cat", Value: "5"}}, study.Invalid[0].Errors)
+	assert.Equal(map[string]int{SkipNoRiskFactors: 1}, study.SkippedCounts())
+}
+
+func (suite *ValidationSuite) TestConfiguredScoreRanges() {
+	assert := suite.Assert()
+
+	rules := ValidationRules{ScoreRanges: map[string]ScoreRange{"rf_util_risk_cat": {Min: 1, Max: 2}}}
+	record := suite.Records[0]
+	assert.Equal([]ValidationError{
+		{Reason: InvalidOutOfRange, Field: "rf_util_risk_cat", Value: "3"},
+	}, record.Validate(rules))
+
+	record.UtilizationRisk = "2"
+	assert.Nil(record.Validate(rules))
+}
+
+func (suite *ValidationSuite) TestConfiguredDateWindow() {
+	assert := suite.Assert()
+
+	rules := ValidationRules{EarliestDate: time.Date(2016, time.January, 1, 0, 0, 0, 0, time.Local)}
+	record := suite.Records[0]
+	assert.Equal([]ValidationError{
+		{Reason: InvalidEarlyDate, Field: "rf_date", Value: "2015-12-07"},
+	}, record.Validate(rules))
+	assert.Nil(suite.Records[1].Validate(rules))
+
+	record.RiskFactorDate = time.Now().AddDate(0, 0, 2).Format("2006-01-02")
+	rules = ValidationRules{FutureTolerance: 7 * 24 * time.Hour}
+	assert.Nil(record.Validate(rules))
+}
+
+func (suite *ValidationSuite) TestStandardScoreRanges() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	fields := FieldMapping{"rf_cmc_risk_cat": "cmc_category"}
+	ranges, err := fields.StandardScoreRanges(map[string]ScoreRange{
+		"cmc_category":      {Min: 1, Max: 3},
+		"rf_risk_predicted": {Min: 2, Max: 4},
+	})
+	require.NoError(err)
+	assert.Equal(map[string]ScoreRange{
+		"rf_cmc_risk_cat":   {Min: 1, Max: 3},
+		"rf_risk_predicted": {Min: 2, Max: 4},
+	}, ranges)
+
+	ranges, err = fields.StandardScoreRanges(nil)
+	assert.NoError(err)
+	assert.Nil(ranges)
+
+	// The standard name of a mapped field and fields that aren't scores match nothing
+	_, err = fields.StandardScoreRanges(map[string]ScoreRange{"rf_cmc_risk_cat": {Min: 1, Max: 3}})
+	assert.Error(err)
+	_, err = FieldMapping(nil).StandardScoreRanges(map[string]ScoreRange{"rf_date": {Min: 1, Max: 3}})
+	assert.Error(err)
+}
+
+func (suite *ValidationSuite) TestParseScoreRanges() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	ranges, err := ParseScoreRanges("rf_cmc_risk_cat=1-3, rf_risk_predicted = 2-4")
+	require.NoError(err)
+	assert.Equal(map[string]ScoreRange{
+		"rf_cmc_risk_cat":   {Min: 1, Max: 3},
+		"rf_risk_predicted": {Min: 2, Max: 4},
+	}, ranges)
+
+	ranges, err = ParseScoreRanges("")
+	require.NoError(err)
+	assert.Len(ranges, 0)
+
+	_, err = ParseScoreRanges("rf_cmc_risk_cat")
+	assert.Error(err)
+	_, err = ParseScoreRanges("rf_cmc_risk_cat=1")
+	assert.Error(err)
+	_, err = ParseScoreRanges("rf_cmc_risk_cat=3-1")
+	assert.Error(err)
+	_, err = ParseScoreRanges("rf_cmc_risk_cat=0-5")
+	assert.Error(err)
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+)
+
+// tokenTestResult represents the result of testing a REDCap project's token
+type tokenTestResult struct {
+	Project      string `json:"project,omitempty"`
+	OK           bool   `json:"ok"`
+	ProjectID    string `json:"projectID,omitempty"`
+	ProjectTitle string `json:"projectTitle,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// RegisterAdminHandlers registers the handlers for administrative tasks.  POST /admin/redcap/token-test tests the
+// current token of each REDCap project by requesting the project information from REDCap, responding with HTTP 502 if
+// any token is rejected.
+func RegisterAdminHandlers(e *gin.Engine, projects []client.REDCapProject) {
+	e.POST("/admin/redcap/token-test", func(c *gin.Context) {
+		status := http.StatusOK
+		results := make([]tokenTestResult, len(projects))
+		for i := range projects {
+			results[i].Project = projects[i].Name
+			info, err := client.GetREDCapProjectInfo(projects[i])
+			if err != nil {
+				results[i].Error = client.Redact(err.Error())
+				status = http.StatusBadGateway
+				continue
+			}
+			results[i].ProjectID = info.ProjectID.String()
+			results[i].ProjectTitle = info.ProjectTitle
+			if projects[i].ProjectID != "" && projects[i].ProjectID != results[i].ProjectID {
+				results[i].Error = "Token belongs to REDCap project " + results[i].ProjectID + ", not the configured project " + projects[i].ProjectID
+				status = http.StatusBadGateway
+				continue
+			}
+			results[i].OK = true
+		}
+		c.JSON(status, results)
+	})
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestAdminSuite(t *testing.T) {
+	suite.Run(t, new(AdminSuite))
+}
+
+type AdminSuite struct {
+	suite.Suite
+	REDCapServer *httptest.Server
+}
+
+func (suite *AdminSuite) SetupTest() {
+	// Turn off debug mode since all of the logging gets in the way
+	gin.SetMode(gin.ReleaseMode)
+
+	suite.REDCapServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("token") != "123abc" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "You do not have permissions to use the API"}`))
+			return
+		}
+		w.Write([]byte(`{"project_id": 42, "project_title": "Risk Stratification"}`))
+	}))
+}
+
+func (suite *AdminSuite) TearDownTest() {
+	suite.REDCapServer.Close()
+}
+
+func (suite *AdminSuite) testTokens(projects []client.REDCapProject) (int, []tokenTestResult) {
+	require := suite.Require()
+
+	e := gin.New()
+	RegisterAdminHandlers(e, projects)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/admin/redcap/token-test", "", nil)
+	require.NoError(err)
+	defer res.Body.Close()
+	var results []tokenTestResult
+	require.NoError(json.NewDecoder(res.Body).Decode(&results))
+	return res.StatusCode, results
+}
+
+func (suite *AdminSuite) TestValidToken() {
+	assert := suite.Assert()
+
+	status, results := suite.testTokens([]client.REDCapProject{{Name: "clinic-a", ProjectID: "42", Endpoint: suite.REDCapServer.URL, Token: "123abc"}})
+	assert.Equal(http.StatusOK, status)
+	assert.Equal([]tokenTestResult{{Project: "clinic-a", OK: true, ProjectID: "42", ProjectTitle: "Risk Stratification"}}, results)
+}
+
+func (suite *AdminSuite) TestInvalidToken() {
+	assert := suite.Assert()
+
+	status, results := suite.testTokens([]client.REDCapProject{
+		{Name: "clinic-a", Endpoint: suite.REDCapServer.URL, Token: "123abc"},
+		{Name: "clinic-b", Endpoint: suite.REDCapServer.URL, Token: "456def"},
+	})
+	assert.Equal(http.StatusBadGateway, status)
+	assert.True(results[0].OK)
+	assert.False(results[1].OK)
+	assert.Equal("Received HTTP 403 from REDCap: You do not have permissions to use the API", results[1].Error)
+}
+
+func (suite *AdminSuite) TestTokenForWrongProject() {
+	assert := suite.Assert()
+
+	status, results := suite.testTokens([]client.REDCapProject{{Name: "clinic-a", ProjectID: "43", Endpoint: suite.REDCapServer.URL, Token: "123abc"}})
+	assert.Equal(http.StatusBadGateway, status)
+	assert.False(results[0].OK)
+	assert.Equal("42", results[0].ProjectID)
+	assert.Contains(results[0].Error, "not the configured project 43")
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes granted to API keys and JWTs
+const (
+	// ScopeRead allows reading pies, validation reports, and metrics
+	ScopeRead = "read"
+	// ScopeRefresh allows refreshing risk assessments
+	ScopeRefresh = "refresh"
+	// ScopeAdmin allows managing webhooks and other administrative actions, and grants every other scope
+	ScopeAdmin = "admin"
+)
+
+// scopeRule maps requests to the scope they require.  Requests matching a rule with an empty scope don't require
+// credentials.
+type scopeRule struct {
+	method string
+	prefix string
+	scope  string
+}
+
+// scopeRules are checked in order, and requests not matching any rule require the admin scope
+var scopeRules = []scopeRule{
+	// REDCap can't send credentials with data entry triggers, which are instead limited to the configured projects
+	{"POST", "/redcap/det", ""},
+	// Orchestrators check health without credentials
+	{"GET", "/healthz", ""},
+	{"GET", "/readyz", ""},
+	{"GET", "/pies/", ScopeRead},
+	{"GET", "/validation.csv", ScopeRead},
+	{"GET", "/reports/", ScopeRead},
+	{"GET", "/export", ScopeRead},
+	{"GET", "/$export", ScopeRead},
+	{"GET", "/bulkstatus/", ScopeRead},
+	// Cancelling deletes an export job, which may belong to another user
+	{"DELETE", "/bulkstatus/", ScopeAdmin},
+	{"GET", "/bulkfiles/", ScopeRead},
+	{"GET", "/metrics", ScopeRead},
+	{"GET", "/refresh/history", ScopeRead},
+	{"GET", "/refresh/history/", ScopeRead},
+	{"POST", "/refresh", ScopeRefresh},
+	{"POST", "/refresh/jobs/", ScopeRefresh},
+	{"POST", "/import", ScopeRefresh},
+	{"GET", "/schedule", ScopeRead},
+}
+
+// RequiredScope returns the scope required for the request, or an empty string if no credentials are required
+func RequiredScope(method, path string) string {
+	for _, rule := range scopeRules {
+		if method == rule.method && (path == rule.prefix || (strings.HasSuffix(rule.prefix, "/") && strings.HasPrefix(path, rule.prefix))) {
+			return rule.scope
+		}
+	}
+	return ScopeAdmin
+}
+
+// APIKey is a key that can be sent in the API key header, along with the scopes it grants
+type APIKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+}
+
+// Authenticator requires requests to present an API key or a JWT signed by a key in the JWKS, granting the scope
+// required by the request
+type Authenticator struct {
+	// APIKeyHeader is the header holding the API key (default: "X-API-Key")
+	APIKeyHeader string
+	APIKeys      []APIKey
+	// JWKS holds the keys trusted to sign JWTs sent as bearer tokens.  If nil, JWTs are not accepted.
+	JWKS *JWKS
+	// Issuer and Audience, if set, must match the JWT's iss and aud claims
+	Issuer   string
+	Audience string
+}
+
+// Middleware returns the Gin middleware rejecting requests without the credentials and scope they require.  Rejections
+// are logged with the connection's remote address as well as the client IP, which X-Forwarded-For can spoof.
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := RequiredScope(c.Request.Method, c.Request.URL.Path)
+		if scope == "" {
+			c.Next()
+			return
+		}
+		subject, scopes, err := a.authenticate(c.Request)
+		if err != nil {
+			slog.Warn("Rejected unauthenticated request", "method", c.Request.Method, "path", c.Request.URL.Path, "client_ip", c.ClientIP(), "remote_addr", c.Request.RemoteAddr, "error", err)
+			c.Header("WWW-Authenticate", `Bearer realm="multifactorriskservice"`)
+			c.String(http.StatusUnauthorized, "Unauthorized")
+			c.Abort()
+			return
+		}
+		if !hasScope(scopes, scope) {
+			slog.Warn("Rejected request lacking scope", "method", c.Request.Method, "path", c.Request.URL.Path, "client_ip", c.ClientIP(), "remote_addr", c.Request.RemoteAddr, "subject", subject, "scope", scope)
+			c.String(http.StatusForbidden, "Missing required scope: %s", scope)
+			c.Abort()
+			return
+		}
+		c.Set("subject", subject)
+		c.Next()
+	}
+}
+
+// requestSubject returns the subject of the request's credentials, or the client's IP if the request wasn't
+// authenticated, to record who made a change
+func requestSubject(c *gin.Context) string {
+	if subject, ok := c.Get("subject"); ok {
+		return subject.(string)
+	}
+	return c.ClientIP()
+}
+
+// authenticate returns the subject and scopes of the request's credentials
+func (a *Authenticator) authenticate(r *http.Request) (string, []string, error) {
+	header := a.APIKeyHeader
+	if header == "" {
+		header = "X-API-Key"
+	}
+	if key := r.Header.Get(header); key != "" {
+		for _, k := range a.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+				return "API key " + k.Name, k.Scopes, nil
+			}
+		}
+		return "", nil, errors.New("invalid API key")
+	}
+
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return "", nil, errors.New("no credentials")
+	}
+	if a.JWKS == nil {
+		return "", nil, errors.New("bearer tokens are not accepted")
+	}
+	claims, err := a.JWKS.verify(strings.TrimPrefix(authz, "Bearer "))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid JWT: %s", err)
+	}
+	if err := claims.validate(a.Issuer, a.Audience, time.Now()); err != nil {
+		return "", nil, fmt.Errorf("invalid JWT: %s", err)
+	}
+	return "JWT subject " + claims.Subject, claims.scopes(), nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAPIKeys loads API keys from a JSON file in the form:
+// {"keys": [{"name": "frontend", "key": "...", "scopes": ["read"]}]}
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config struct {
+		Keys []APIKey `json:"keys"`
+	}
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, fmt.Errorf("Couldn't parse API keys file %s: %s", path, err)
+	}
+	for _, k := range config.Keys {
+		if k.Name == "" || len(k.Key) < 16 {
+			return nil, errors.New("Every API key must have a name and a key of at least 16 characters")
+		}
+		for _, s := range k.Scopes {
+			if s != ScopeRead && s != ScopeRefresh && s != ScopeAdmin {
+				return nil, fmt.Errorf("Unknown scope for API key %s: %s", k.Name, s)
+			}
+		}
+	}
+	return config.Keys, nil
+}
+
+// JWKS is a JSON Web Key Set holding the RSA and EC public keys trusted to sign JWTs, indexed by key ID
+type JWKS struct {
+	keys map[string]crypto.PublicKey
+}
+
+// jwk represents a JSON Web Key.  Only the fields for RSA and EC public keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS loads a JSON Web Key Set from a file.  Keys other than RSA and EC signing keys are ignored.
+func LoadJWKS(path string) (*JWKS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(f).Decode(&set); err != nil {
+		return nil, fmt.Errorf("Couldn't parse JWKS file %s: %s", path, err)
+	}
+	jwks := &JWKS{keys: make(map[string]crypto.PublicKey)}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %s in JWKS file %s: %s", k.Kid, path, err)
+		}
+		if key != nil {
+			jwks.keys[k.Kid] = key
+		}
+	}
+	if len(jwks.keys) == 0 {
+		return nil, fmt.Errorf("No signing keys found in JWKS file %s", path)
+	}
+	return jwks, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// jwtClaims holds the registered JWT claims used for authorization, along with the scopes
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scp       []string        `json:"scp"`
+}
+
+// clockSkew is the leeway allowed when checking a JWT's expiration and not before times
+const clockSkew = time.Minute
+
+func (c *jwtClaims) validate(issuer, audience string, now time.Time) error {
+	if c.ExpiresAt == 0 {
+		return errors.New("missing expiration")
+	}
+	if now.Add(-clockSkew).Unix() > c.ExpiresAt {
+		return errors.New("token expired")
+	}
+	if c.NotBefore != 0 && now.Add(clockSkew).Unix() < c.NotBefore {
+		return errors.New("token not yet valid")
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return fmt.Errorf("unexpected issuer %s", c.Issuer)
+	}
+	if audience != "" {
+		var audiences []string
+		var single string
+		if err := json.Unmarshal(c.Audience, &single); err == nil {
+			audiences = []string{single}
+		} else {
+			json.Unmarshal(c.Audience, &audiences)
+		}
+		found := false
+		for _, aud := range audiences {
+			found = found || aud == audience
+		}
+		if !found {
+			return errors.New("unexpected audience")
+		}
+	}
+	return nil
+}
+
+// scopes returns the scopes from the space-separated scope claim or the scp list claim
+func (c *jwtClaims) scopes() []string {
+	return append(strings.Fields(c.Scope), c.Scp...)
+}
+
+// verify checks the JWT's signature against the key with the matching key ID, returning its claims.  The claims still
+// need to be validated.
+func (j *JWKS) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	key, ok := j.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	claims := new(jwtClaims)
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// verifySignature verifies the signature using the algorithm, which must match the key type so that tokens can't
+// choose a weaker algorithm (e.g., "none" or HMAC with the public key)
+func verifySignature(alg string, key crypto.PublicKey, input, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	var hash crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		d := sha256.Sum256(input)
+		digest = d[:]
+	case crypto.SHA384:
+		d := sha512.Sum384(input)
+		digest = d[:]
+	case crypto.SHA512:
+		d := sha512.Sum512(input)
+		digest = d[:]
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || digest == nil {
+			return fmt.Errorf("unsupported algorithm %s for RSA key", alg)
+		}
+		if rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") || digest == nil {
+			return fmt.Errorf("unsupported algorithm %s for EC key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
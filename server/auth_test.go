@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestAuthSuite(t *testing.T) {
+	suite.Run(t, new(AuthSuite))
+}
+
+type AuthSuite struct {
+	suite.Suite
+	RSAKey   *rsa.PrivateKey
+	ECKey    *ecdsa.PrivateKey
+	JWKSPath string
+	Server   *httptest.Server
+}
+
+func (suite *AuthSuite) SetupSuite() {
+	require := suite.Require()
+
+	// Turn off debug mode since all of the logging gets in the way
+	gin.SetMode(gin.ReleaseMode)
+
+	var err error
+	suite.RSAKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	suite.ECKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": b64(suite.RSAKey.N), "e": b64(big.NewInt(int64(suite.RSAKey.E)))},
+			{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(suite.ECKey.X), "y": b64(suite.ECKey.Y)},
+			{"kty": "oct", "kid": "ignored", "k": "c2VjcmV0"},
+		},
+	}
+	f, err := ioutil.TempFile("", "jwks")
+	require.NoError(err)
+	require.NoError(json.NewEncoder(f).Encode(jwks))
+	f.Close()
+	suite.JWKSPath = f.Name()
+}
+
+func (suite *AuthSuite) TearDownSuite() {
+	os.Remove(suite.JWKSPath)
+}
+
+func (suite *AuthSuite) SetupTest() {
+	jwks, err := LoadJWKS(suite.JWKSPath)
+	suite.Require().NoError(err)
+
+	e := gin.New()
+	e.Use((&Authenticator{
+		APIKeys: []APIKey{
+			{Name: "frontend", Key: "read-only-key-0123456789", Scopes: []string{ScopeRead}},
+			{Name: "ops", Key: "admin-key-0123456789abcd", Scopes: []string{ScopeAdmin}},
+		},
+		JWKS:     jwks,
+		Issuer:   "https://auth.example.org",
+		Audience: "riskservice",
+	}).Middleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	e.GET("/pies/:id", ok)
+	e.POST("/refresh", ok)
+	e.POST("/redcap/det", ok)
+	e.GET("/webhooks", ok)
+	e.DELETE("/bulkstatus/:id", ok)
+	suite.Server = httptest.NewServer(e)
+}
+
+func (suite *AuthSuite) TearDownTest() {
+	suite.Server.Close()
+}
+
+func (suite *AuthSuite) do(method, path string, header ...string) int {
+	req, err := http.NewRequest(method, suite.Server.URL+path, nil)
+	suite.Require().NoError(err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	suite.Require().NoError(err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func (suite *AuthSuite) sign(alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch alg {
+	case "RS256":
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, suite.RSAKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, suite.ECKey, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (suite *AuthSuite) claims(scope string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "https://auth.example.org",
+		"sub":   "scheduler",
+		"aud":   []string{"riskservice"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": scope,
+	}
+}
+
+func (suite *AuthSuite) TestRequiredScope() {
+	assert := suite.Assert()
+
+	assert.Equal(ScopeRead, RequiredScope("GET", "/pies/56fd63cdac1c5d77f6f695a1"))
+	assert.Equal(ScopeRead, RequiredScope("GET", "/validation.csv"))
+	assert.Equal(ScopeRead, RequiredScope("GET", "/reports/distribution"))
+	assert.Equal(ScopeRead, RequiredScope("GET", "/export"))
+	assert.Equal(ScopeRead, RequiredScope("GET", "/$export"))
+	assert.Equal(ScopeAdmin, RequiredScope("DELETE", "/bulkstatus/56fd63cdac1c5d77f6f695a1"))
+	assert.Equal(ScopeRead, RequiredScope("GET", "/bulkfiles/56fd63cdac1c5d77f6f695a1/RiskAssessment.ndjson"))
+	assert.Equal(ScopeRefresh, RequiredScope("POST", "/refresh"))
+	assert.Equal(ScopeRefresh, RequiredScope("POST", "/refresh/jobs/job1/resume"))
+	assert.Equal(ScopeRefresh, RequiredScope("POST", "/import"))
+	assert.Equal(ScopeRead, RequiredScope("GET", "/refresh/history"))
+	assert.Equal(ScopeRead, RequiredScope("GET", "/refresh/history/56fd63cdac1c5d77f6f695a1"))
+	assert.Equal(ScopeRead, RequiredScope("GET", "/schedule"))
+	assert.Equal(ScopeAdmin, RequiredScope("PUT", "/schedule"))
+	assert.Equal(ScopeAdmin, RequiredScope("POST", "/schedule/pause"))
+	assert.Equal("", RequiredScope("POST", "/redcap/det"))
+	assert.Equal(ScopeAdmin, RequiredScope("GET", "/webhooks"))
+	assert.Equal(ScopeAdmin, RequiredScope("POST", "/admin/redcap/token-test"))
+	assert.Equal(ScopeAdmin, RequiredScope("DELETE", "/pies/56fd63cdac1c5d77f6f695a1"))
+}
+
+func (suite *AuthSuite) TestNoCredentials() {
+	assert := suite.Assert()
+
+	assert.Equal(http.StatusUnauthorized, suite.do("GET", "/pies/1"))
+	assert.Equal(http.StatusUnauthorized, suite.do("POST", "/refresh"))
+	assert.Equal(http.StatusOK, suite.do("POST", "/redcap/det"))
+}
+
+func (suite *AuthSuite) TestAPIKeys() {
+	assert := suite.Assert()
+
+	assert.Equal(http.StatusOK, suite.do("GET", "/pies/1", "X-API-Key", "read-only-key-0123456789"))
+	assert.Equal(http.StatusForbidden, suite.do("POST", "/refresh", "X-API-Key", "read-only-key-0123456789"))
+	assert.Equal(http.StatusUnauthorized, suite.do("GET", "/pies/1", "X-API-Key", "wrong-key-0123456789abc"))
+	assert.Equal(http.StatusOK, suite.do("POST", "/refresh", "X-API-Key", "admin-key-0123456789abcd"))
+	assert.Equal(http.StatusOK, suite.do("GET", "/webhooks", "X-API-Key", "admin-key-0123456789abcd"))
+	assert.Equal(http.StatusForbidden, suite.do("DELETE", "/bulkstatus/1", "X-API-Key", "read-only-key-0123456789"))
+	assert.Equal(http.StatusOK, suite.do("DELETE", "/bulkstatus/1", "X-API-Key", "admin-key-0123456789abcd"))
+}
+
+func (suite *AuthSuite) TestJWT() {
+	assert := suite.Assert()
+
+	token := suite.sign("RS256", "rsa-1", suite.claims("read refresh"))
+	assert.Equal(http.StatusOK, suite.do("GET", "/pies/1", "Authorization", "Bearer "+token))
+	assert.Equal(http.StatusOK, suite.do("POST", "/refresh", "Authorization", "Bearer "+token))
+	assert.Equal(http.StatusForbidden, suite.do("GET", "/webhooks", "Authorization", "Bearer "+token))
+
+	token = suite.sign("ES256", "ec-1", suite.claims("admin"))
+	assert.Equal(http.StatusOK, suite.do("GET", "/webhooks", "Authorization", "Bearer "+token))
+
+	claims := suite.claims("")
+	claims["scp"] = []string{"refresh"}
+	token = suite.sign("RS256", "rsa-1", claims)
+	assert.Equal(http.StatusOK, suite.do("POST", "/refresh", "Authorization", "Bearer "+token))
+}
+
+func (suite *AuthSuite) TestInvalidJWTs() {
+	assert := suite.Assert()
+
+	expired := suite.claims("read")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongIssuer := suite.claims("read")
+	wrongIssuer["iss"] = "https://evil.example.org"
+	wrongAudience := suite.claims("read")
+	wrongAudience["aud"] = "other-service"
+	noExpiration := suite.claims("read")
+	delete(noExpiration, "exp")
+
+	valid := suite.sign("RS256", "rsa-1", suite.claims("read"))
+	parts := strings.Split(valid, ".")
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa-1"}`)) + "." + parts[1] + "."
+
+	tokens := []string{
+		suite.sign("RS256", "rsa-1", expired),
+		suite.sign("RS256", "rsa-1", wrongIssuer),
+		suite.sign("RS256", "rsa-1", wrongAudience),
+		suite.sign("RS256", "rsa-1", noExpiration),
+		suite.sign("RS256", "unknown", suite.claims("read")),
+		suite.sign("RS256", "ec-1", suite.claims("read")),
+		parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])-4] + "AAAA",
+		unsigned,
+		"not-a-jwt",
+	}
+	for _, token := range tokens {
+		assert.Equal(http.StatusUnauthorized, suite.do("GET", "/pies/1", "Authorization", "Bearer "+token), token)
+	}
+}
+
+func (suite *AuthSuite) TestRejectionLogsRemoteAddr() {
+	assert := suite.Assert()
+
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	// The client IP can be spoofed with X-Forwarded-For, so the connection's address is logged too
+	assert.Equal(http.StatusUnauthorized, suite.do("POST", "/refresh", "X-Forwarded-For", "10.1.2.3"))
+	var entry map[string]interface{}
+	suite.Require().NoError(json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal("Rejected unauthenticated request", entry["msg"])
+	assert.Equal("10.1.2.3", entry["client_ip"])
+	assert.True(strings.HasPrefix(entry["remote_addr"].(string), "127.0.0.1:"), entry["remote_addr"])
+}
+
+func (suite *AuthSuite) TestLoadAPIKeys() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	write := func(content string) string {
+		f, err := ioutil.TempFile("", "apikeys")
+		require.NoError(err)
+		f.WriteString(content)
+		f.Close()
+		return f.Name()
+	}
+
+	path := write(`{"keys": [{"name": "frontend", "key": "read-only-key-0123456789", "scopes": ["read"]}]}`)
+	defer os.Remove(path)
+	keys, err := LoadAPIKeys(path)
+	require.NoError(err)
+	assert.Equal([]APIKey{{Name: "frontend", Key: "read-only-key-0123456789", Scopes: []string{"read"}}}, keys)
+
+	for _, content := range []string{
+		`{"keys": [{"name": "frontend", "key": "short", "scopes": ["read"]}]}`,
+		`{"keys": [{"name": "frontend", "key": "read-only-key-0123456789", "scopes": ["write"]}]}`,
+		`{"keys": [`,
+	} {
+		path := write(content)
+		_, err := LoadAPIKeys(path)
+		assert.Error(err, content)
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/riskservice/plugin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Statuses of a bulk export job
+const (
+	BulkInProgress = "in-progress"
+	BulkComplete   = "complete"
+	BulkFailed     = "failed"
+)
+
+// bulkOutputFile is the name of the NDJSON file holding the exported risk assessments
+const bulkOutputFile = "RiskAssessment.ndjson"
+
+// DefaultBulkRetention is how long a finished bulk export job and its files are kept
+const DefaultBulkRetention = 24 * time.Hour
+
+// BulkExportJob is an asynchronous export of the risk assessments, following the FHIR Bulk Data Access pattern
+type BulkExportJob struct {
+	ID              string
+	Request         string
+	TransactionTime time.Time
+	// Since limits the export to the risk assessments stored at or after the time
+	Since  time.Time
+	Status string
+	// Count is the number of risk assessments written so far
+	Count int
+	Error string
+	// Expires is when the finished job and its files are removed
+	Expires time.Time
+	// cancel stops the job if it is still running
+	cancel context.CancelFunc
+}
+
+// BulkOutput is an output file listed in a bulk export manifest
+type BulkOutput struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+}
+
+// BulkManifest is the manifest returned when a bulk export job is complete
+type BulkManifest struct {
+	TransactionTime     time.Time    `json:"transactionTime"`
+	Request             string       `json:"request"`
+	RequiresAccessToken bool         `json:"requiresAccessToken"`
+	Output              []BulkOutput `json:"output"`
+	Error               []BulkOutput `json:"error"`
+}
+
+// BulkExporter runs bulk export jobs, writing the exported risk assessments, generated from the stored pies, to NDJSON
+// files on disk.  Finished jobs and their files are removed once they are older than the retention period.  Jobs are
+// kept in memory, so the status of jobs started before a restart is lost; their files are removed by Purge.
+type BulkExporter struct {
+	// Dir is the directory holding a subdirectory of files for each job
+	Dir string
+	// BaseURL is the service's own URL, used in the status and file URLs
+	BaseURL      string
+	FHIREndpoint string
+	Pies         *mgo.Collection
+	BasisPieURL  string
+	// RequiresAccessToken indicates whether the files require the same credentials as the export itself
+	RequiresAccessToken bool
+	// Retention is how long finished jobs and their files are kept
+	Retention time.Duration
+	jobs      map[string]*BulkExportJob
+	mutex     sync.Mutex
+}
+
+// NewBulkExporter creates a new bulk exporter writing its files to the directory
+func NewBulkExporter(dir, baseURL, fhirEndpoint string, pieCollection *mgo.Collection, basisPieURL string) *BulkExporter {
+	return &BulkExporter{
+		Dir:          dir,
+		BaseURL:      baseURL,
+		FHIREndpoint: fhirEndpoint,
+		Pies:         pieCollection,
+		BasisPieURL:  basisPieURL,
+		Retention:    DefaultBulkRetention,
+		jobs:         make(map[string]*BulkExportJob),
+	}
+}
+
+// Start starts a job exporting the risk assessments stored since the given time (or all of them, if zero), returning
+// the job
+func (b *BulkExporter) Start(request string, since time.Time) (*BulkExportJob, error) {
+	if _, err := b.Purge(time.Now()); err != nil {
+		slog.Error("Couldn't remove expired bulk export files", "error", err)
+	}
+	job := &BulkExportJob{
+		ID:              bson.NewObjectId().Hex(),
+		Request:         request,
+		TransactionTime: time.Now().UTC(),
+		Since:           since,
+		Status:          BulkInProgress,
+	}
+	if err := os.MkdirAll(filepath.Join(b.Dir, job.ID), 0700); err != nil {
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, job.cancel = context.WithCancel(logging.WithJobID(context.Background(), job.ID))
+
+	b.mutex.Lock()
+	b.jobs[job.ID] = job
+	b.mutex.Unlock()
+
+	go b.run(ctx, job)
+	return job, nil
+}
+
+// run writes the job's file and records the outcome
+func (b *BulkExporter) run(ctx context.Context, job *BulkExportJob) {
+	slog.InfoContext(ctx, "Starting bulk export", "since", job.Since)
+	err := b.write(ctx, job)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	job.Expires = time.Now().UTC().Add(b.Retention)
+	time.AfterFunc(b.Retention, func() {
+		if _, err := b.Purge(time.Now()); err != nil {
+			slog.ErrorContext(ctx, "Couldn't remove expired bulk export files", "error", err)
+		}
+	})
+	if err != nil {
+		job.Status = BulkFailed
+		job.Error = err.Error()
+		if ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Bulk export failed", "error", err)
+		}
+		return
+	}
+	job.Status = BulkComplete
+	slog.InfoContext(ctx, "Finished bulk export", "risk_assessments", job.Count)
+}
+
+// write writes a risk assessment for each stored pie to the job's NDJSON file, stopping if the context is cancelled
+func (b *BulkExporter) write(ctx context.Context, job *BulkExportJob) error {
+	f, err := os.Create(filepath.Join(b.Dir, job.ID, bulkOutputFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+
+	method := client.REDCapRiskServiceConfig.Method.Coding[0]
+	sel := bson.M{"method.coding": bson.M{"$elemMatch": bson.M{"system": method.System, "code": method.Code}}}
+	if !job.Since.IsZero() {
+		sel["created"] = bson.M{"$gte": job.Since}
+	}
+	iter := b.Pies.Find(sel).Sort("_id").Iter()
+	var pie storedPie
+	for iter.Next(&pie) {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return err
+		}
+		if err := encoder.Encode(toBulkRiskAssessment(&pie, b.FHIREndpoint, b.BasisPieURL)); err != nil {
+			iter.Close()
+			return err
+		}
+		b.mutex.Lock()
+		job.Count++
+		b.mutex.Unlock()
+		pie = storedPie{}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// toBulkRiskAssessment generates the risk assessment for a stored pie, as posted to the FHIR server by a refresh.  The
+// risk assessment is identified by its pie's ID.
+func toBulkRiskAssessment(pie *storedPie, fhirEndpoint, basisPieURL string) *fhir.RiskAssessment {
+	result := plugin.RiskServiceCalculationResult{AsOf: pie.Created, Pie: &pie.Pie}
+	if pie.AsOf != nil {
+		result.AsOf = *pie.AsOf
+	}
+	score := (&latestPie{Slices: pie.Slices}).Score()
+	result.Score = &score
+	ra := result.ToRiskAssessment(strings.TrimPrefix(pie.Patient, fhirEndpoint+"/Patient/"), basisPieURL, client.REDCapRiskServiceConfig)
+	ra.Id = pie.Id.Hex()
+	return ra
+}
+
+// Job returns a copy of the job with the given ID, or false if there is no such job
+func (b *BulkExporter) Job(id string) (BulkExportJob, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	job, ok := b.jobs[id]
+	if !ok || job.expired(time.Now()) {
+		return BulkExportJob{}, false
+	}
+	return *job, true
+}
+
+// expired indicates if the job finished before the retention period, as of the given time.  The exporter's mutex must
+// be held.
+func (job *BulkExportJob) expired(now time.Time) bool {
+	return job.Status != BulkInProgress && !job.Expires.IsZero() && now.After(job.Expires)
+}
+
+// Purge removes the jobs that expired as of the given time, along with their files, and the files of any jobs the
+// exporter doesn't know about (e.g., jobs from before a restart) that are older than the retention period.  It returns
+// the number of jobs whose files were removed.
+func (b *BulkExporter) Purge(now time.Time) (int, error) {
+	entries, err := os.ReadDir(b.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	var expired []string
+	b.mutex.Lock()
+	for id, job := range b.jobs {
+		if job.expired(now) {
+			delete(b.jobs, id)
+			expired = append(expired, id)
+		}
+	}
+	for _, entry := range entries {
+		if _, ok := b.jobs[entry.Name()]; ok || !entry.IsDir() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) > b.Retention {
+			expired = append(expired, entry.Name())
+		}
+	}
+	b.mutex.Unlock()
+
+	removed := 0
+	for _, id := range expired {
+		if err := os.RemoveAll(filepath.Join(b.Dir, id)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Delete cancels the job if it is running and removes it along with its files, returning false if there is no such job
+func (b *BulkExporter) Delete(id string) (bool, error) {
+	b.mutex.Lock()
+	job, ok := b.jobs[id]
+	delete(b.jobs, id)
+	b.mutex.Unlock()
+	if !ok {
+		return false, nil
+	}
+	job.cancel()
+	return true, os.RemoveAll(filepath.Join(b.Dir, id))
+}
+
+// Manifest returns the manifest of the complete job
+func (b *BulkExporter) Manifest(job BulkExportJob) BulkManifest {
+	return BulkManifest{
+		TransactionTime:     job.TransactionTime,
+		Request:             job.Request,
+		RequiresAccessToken: b.RequiresAccessToken,
+		Output: []BulkOutput{{
+			Type:  "RiskAssessment",
+			URL:   b.BaseURL + "/bulkfiles/" + job.ID + "/" + bulkOutputFile,
+			Count: job.Count,
+		}},
+		Error: []BulkOutput{},
+	}
+}
+
+// bulkError responds with an OperationOutcome describing the error
+func bulkError(c *gin.Context, status int, code, diagnostics string) {
+	c.JSON(status, fhir.NewOperationOutcome("error", code, diagnostics))
+}
+
+// RegisterBulkExportHandlers registers the FHIR Bulk Data style handlers: the $export kick-off, which requires the
+// "Accept: application/fhir+json" and "Prefer: respond-async" headers and supports the _outputFormat, _type, and
+// _since parameters, the status endpoint returning the manifest once the job is complete (or deleting the job), and
+// the endpoint serving the exported files.
+func RegisterBulkExportHandlers(e *gin.Engine, exporter *BulkExporter) {
+	e.GET("/$export", func(c *gin.Context) {
+		if c.Request.Header.Get("Accept") != "application/fhir+json" {
+			bulkError(c, http.StatusBadRequest, "invalid", "The Accept header must be application/fhir+json")
+			return
+		}
+		if c.Request.Header.Get("Prefer") != "respond-async" {
+			bulkError(c, http.StatusBadRequest, "invalid", "The Prefer header must be respond-async")
+			return
+		}
+		switch format := c.Query("_outputFormat"); format {
+		case "", "application/fhir+ndjson", "application/ndjson", "ndjson":
+		default:
+			bulkError(c, http.StatusBadRequest, "not-supported", fmt.Sprintf("Unsupported _outputFormat %s (must be application/fhir+ndjson)", format))
+			return
+		}
+		for _, t := range splitList(c.Query("_type")) {
+			if t != "RiskAssessment" {
+				bulkError(c, http.StatusBadRequest, "not-supported", fmt.Sprintf("Unsupported _type %s (only RiskAssessment is exported)", t))
+				return
+			}
+		}
+		var since time.Time
+		if s := c.Query("_since"); s != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, s); err != nil {
+				bulkError(c, http.StatusBadRequest, "invalid", fmt.Sprintf("Invalid _since %s (must be a FHIR instant)", s))
+				return
+			}
+		}
+
+		job, err := exporter.Start(exporter.BaseURL+c.Request.URL.RequestURI(), since)
+		if err != nil {
+			slog.Error("Couldn't start bulk export", "error", err)
+			bulkError(c, http.StatusInternalServerError, "exception", "Couldn't start the export")
+			return
+		}
+		c.Header("Content-Location", exporter.BaseURL+"/bulkstatus/"+job.ID)
+		c.Status(http.StatusAccepted)
+	})
+
+	e.GET("/bulkstatus/:id", func(c *gin.Context) {
+		job, ok := exporter.Job(c.Param("id"))
+		if !ok {
+			bulkError(c, http.StatusNotFound, "not-found", "No such export job")
+			return
+		}
+		switch job.Status {
+		case BulkInProgress:
+			c.Header("X-Progress", fmt.Sprintf("%d risk assessments exported", job.Count))
+			c.Header("Retry-After", "5")
+			c.Status(http.StatusAccepted)
+		case BulkFailed:
+			bulkError(c, http.StatusInternalServerError, "exception", job.Error)
+		default:
+			if !job.Expires.IsZero() {
+				c.Header("Expires", job.Expires.Format(http.TimeFormat))
+			}
+			c.JSON(http.StatusOK, exporter.Manifest(job))
+		}
+	})
+
+	e.DELETE("/bulkstatus/:id", func(c *gin.Context) {
+		ok, err := exporter.Delete(c.Param("id"))
+		if !ok {
+			bulkError(c, http.StatusNotFound, "not-found", "No such export job")
+			return
+		} else if err != nil {
+			slog.Error("Couldn't remove bulk export files", "job_id", c.Param("id"), "error", err)
+		}
+		c.Status(http.StatusAccepted)
+	})
+
+	e.GET("/bulkfiles/:id/:file", func(c *gin.Context) {
+		job, ok := exporter.Job(c.Param("id"))
+		if !ok || job.Status != BulkComplete || c.Param("file") != bulkOutputFile {
+			bulkError(c, http.StatusNotFound, "not-found", "No such export file")
+			return
+		}
+		c.Header("Content-Type", "application/fhir+ndjson")
+		http.ServeFile(c.Writer, c.Request, filepath.Join(exporter.Dir, job.ID, bulkOutputFile))
+	})
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestBulkExportSuite(t *testing.T) {
+	suite.Run(t, new(BulkExportSuite))
+}
+
+type BulkExportSuite struct {
+	suite.Suite
+	Exporter *BulkExporter
+	Server   *httptest.Server
+}
+
+func (suite *BulkExportSuite) SetupTest() {
+	// Turn off debug mode since all of the logging gets in the way
+	gin.SetMode(gin.ReleaseMode)
+
+	e := gin.New()
+	suite.Exporter = NewBulkExporter(suite.T().TempDir(), "http://riskservice", "http://fhir", nil, "http://riskservice/pies")
+	RegisterBulkExportHandlers(e, suite.Exporter)
+	suite.Server = httptest.NewServer(e)
+}
+
+func (suite *BulkExportSuite) TearDownTest() {
+	suite.Server.Close()
+}
+
+func (suite *BulkExportSuite) kickOff(query, accept, prefer string) *http.Response {
+	req, err := http.NewRequest("GET", suite.Server.URL+"/$export"+query, nil)
+	suite.Require().NoError(err)
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Prefer", prefer)
+	res, err := http.DefaultClient.Do(req)
+	suite.Require().NoError(err)
+	res.Body.Close()
+	return res
+}
+
+func (suite *BulkExportSuite) TestInvalidKickOff() {
+	assert := suite.Assert()
+
+	assert.Equal(http.StatusBadRequest, suite.kickOff("", "application/json", "respond-async").StatusCode)
+	assert.Equal(http.StatusBadRequest, suite.kickOff("", "application/fhir+json", "").StatusCode)
+	assert.Equal(http.StatusBadRequest, suite.kickOff("?_outputFormat=text/csv", "application/fhir+json", "respond-async").StatusCode)
+	assert.Equal(http.StatusBadRequest, suite.kickOff("?_type=Patient", "application/fhir+json", "respond-async").StatusCode)
+	assert.Equal(http.StatusBadRequest, suite.kickOff("?_since=yesterday", "application/fhir+json", "respond-async").StatusCode)
+}
+
+func (suite *BulkExportSuite) TestUnknownJob() {
+	assert := suite.Assert()
+
+	res, err := http.Get(suite.Server.URL + "/bulkstatus/56fd63cdac1c5d77f6f695a1")
+	suite.Require().NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(suite.Server.URL + "/bulkfiles/56fd63cdac1c5d77f6f695a1/RiskAssessment.ndjson")
+	suite.Require().NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+
+	req, err := http.NewRequest("DELETE", suite.Server.URL+"/bulkstatus/56fd63cdac1c5d77f6f695a1", nil)
+	suite.Require().NoError(err)
+	res, err = http.DefaultClient.Do(req)
+	suite.Require().NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func (suite *BulkExportSuite) TestManifest() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	transactionTime := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	expires := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	job := &BulkExportJob{ID: "job1", Request: "http://riskservice/$export", TransactionTime: transactionTime, Status: BulkComplete, Count: 3, Expires: expires}
+	suite.Exporter.jobs[job.ID] = job
+
+	res, err := http.Get(suite.Server.URL + "/bulkstatus/job1")
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal(expires.Format(http.TimeFormat), res.Header.Get("Expires"))
+	var manifest BulkManifest
+	require.NoError(json.NewDecoder(res.Body).Decode(&manifest))
+	assert.Equal(BulkManifest{
+		TransactionTime: transactionTime,
+		Request:         "http://riskservice/$export",
+		Output:          []BulkOutput{{Type: "RiskAssessment", URL: "http://riskservice/bulkfiles/job1/RiskAssessment.ndjson", Count: 3}},
+		Error:           []BulkOutput{},
+	}, manifest)
+
+	job.Status = BulkInProgress
+	res, err = http.Get(suite.Server.URL + "/bulkstatus/job1")
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+	assert.Equal("3 risk assessments exported", res.Header.Get("X-Progress"))
+}
+
+func (suite *BulkExportSuite) TestPurge() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	now := time.Now()
+	mkdir := func(id string, modified time.Time) {
+		dir := filepath.Join(suite.Exporter.Dir, id)
+		require.NoError(os.MkdirAll(dir, 0700))
+		require.NoError(os.Chtimes(dir, modified, modified))
+	}
+	suite.Exporter.jobs["expired"] = &BulkExportJob{ID: "expired", Status: BulkComplete, Expires: now.Add(-time.Minute)}
+	mkdir("expired", now.Add(-2*time.Hour))
+	suite.Exporter.jobs["current"] = &BulkExportJob{ID: "current", Status: BulkComplete, Expires: now.Add(time.Minute)}
+	mkdir("current", now.Add(-48*time.Hour))
+	suite.Exporter.jobs["running"] = &BulkExportJob{ID: "running", Status: BulkInProgress}
+	mkdir("running", now.Add(-48*time.Hour))
+	// Files left from jobs started before a restart are removed once they're older than the retention period
+	mkdir("old-orphan", now.Add(-48*time.Hour))
+	mkdir("new-orphan", now.Add(-time.Minute))
+
+	_, ok := suite.Exporter.Job("expired")
+	assert.False(ok, "Expired jobs shouldn't be reported")
+
+	removed, err := suite.Exporter.Purge(now)
+	require.NoError(err)
+	assert.Equal(2, removed)
+	assert.NotContains(suite.Exporter.jobs, "expired")
+	assert.Contains(suite.Exporter.jobs, "current")
+	assert.Contains(suite.Exporter.jobs, "running")
+	for id, exists := range map[string]bool{"expired": false, "current": true, "running": true, "old-orphan": false, "new-orphan": true} {
+		_, err := os.Stat(filepath.Join(suite.Exporter.Dir, id))
+		assert.Equal(exists, err == nil, id)
+	}
+}
+
+func (suite *BulkExportSuite) TestRiskAssessment() {
+	assert := suite.Assert()
+
+	asOf := time.Date(2016, 2, 21, 0, 0, 0, 0, time.UTC)
+	pie := &storedPie{
+		Pie: plugin.Pie{
+			Id:      bson.ObjectIdHex("56fd63cdac1c5d77f6f695b1"),
+			Patient: "http://fhir/Patient/p1",
+			Slices:  []plugin.Slice{{Name: "Clinical Risk", Value: 2}, {Name: "Utilization Risk", Value: 3}},
+		},
+		AsOf: &asOf,
+	}
+	ra := toBulkRiskAssessment(pie, "http://fhir", "http://riskservice/pies")
+	assert.Equal("56fd63cdac1c5d77f6f695b1", ra.Id)
+	assert.Equal("Patient/p1", ra.Subject.Reference)
+	assert.Equal(asOf, ra.Date.Time)
+	assert.Equal(&client.REDCapRiskServiceConfig.Method, ra.Method)
+	assert.Equal(3.0, *ra.Prediction[0].ProbabilityDecimal)
+	assert.Equal([]fhir.Reference{{Reference: "http://riskservice/pies/56fd63cdac1c5d77f6f695b1"}}, ra.Basis)
+}
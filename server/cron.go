@@ -1,21 +1,42 @@
 package server
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"time"
 
 	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
 	"github.com/robfig/cron"
 	"gopkg.in/mgo.v2"
 )
 
-// ScheduleRefreshRiskAssessmentsCron schedules a cron job for refreshing the risk assessments
-func ScheduleRefreshRiskAssessmentsCron(c *cron.Cron, spec string, fhirEndpoint, redcapEndpoint, redcapToken string, pieCollection *mgo.Collection, basisPieURL string) error {
+// ScheduleRefreshRiskAssessmentsCron schedules a cron job for refreshing the risk assessments.  If the history is not
+// nil, each run is recorded in it.  Use a Scheduler instead if the schedule should be changeable while running.
+func ScheduleRefreshRiskAssessmentsCron(c *cron.Cron, spec string, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory) error {
+	job := NewRefreshJob(fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history)
 	return c.AddFunc(spec, func() {
-		results, err := client.RefreshRiskAssessments(fhirEndpoint, redcapEndpoint, redcapToken, pieCollection, basisPieURL)
-		if err != nil {
-			log.Println("Error refreshing risk assessments", err)
+		job(logging.WithJobID(context.Background(), logging.NewJobID()), spec)
+	})
+}
+
+// ScheduledJob is a job run on a cron schedule.  The spec is the schedule the job was run on.
+type ScheduledJob func(ctx context.Context, spec string) ([]client.Result, error)
+
+// NewRefreshJob returns the scheduled job refreshing the risk assessments.  If the history is not nil, each run is
+// recorded in it.
+func NewRefreshJob(fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory) ScheduledJob {
+	return func(ctx context.Context, spec string) ([]client.Result, error) {
+		cronLastRun.Set(float64(time.Now().Unix()))
+		results, err := refreshRiskAssessments(ctx, RefreshTrigger{TriggerCron, spec}, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history)
+		if held, ok := err.(*LeaseHeldError); ok {
+			slog.InfoContext(ctx, "Skipping scheduled refresh while another refresh runs", "running_job_id", held.JobID, "owner", held.Owner)
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Couldn't refresh risk assessments", "trigger", "cron", "error", err)
 		} else {
-			client.LogResultSummary(results)
+			client.LogResultSummary(ctx, results)
 		}
-	})
+		return results, err
+	}
 }
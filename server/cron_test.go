@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/intervention-engine/multifactorriskservice/client"
 	"github.com/intervention-engine/multifactorriskservice/models"
 
 	"gopkg.in/mgo.v2"
@@ -106,7 +108,7 @@ func (suite *CronSuite) TestCron() {
 
 	// Schedule the cron
 	c := cron.New()
-	err := ScheduleRefreshRiskAssessmentsCron(c, "@every 1s", suite.FHIRServer.URL, suite.REDCapServer.URL, "12345", suite.Database.C("pies"), "http://example.org/pies/")
+	err := ScheduleRefreshRiskAssessmentsCron(c, "@every 1s", suite.FHIRServer.URL, []client.REDCapProject{{Endpoint: suite.REDCapServer.URL, Token: "12345"}}, suite.Database.C("pies"), "http://example.org/pies/", nil, nil)
 	c.Start()
 	defer c.Stop()
 
@@ -125,3 +127,23 @@ func (suite *CronSuite) TestCron() {
 	}
 	assert.Equal(3, count)
 }
+
+func (suite *CronSuite) TestSchedulerSavesSchedule() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	job := func(ctx context.Context, spec string) ([]client.Result, error) { return nil, nil }
+	scheduler, err := NewScheduler(suite.Database.C("schedule"), "0 0 22 * * *", job)
+	require.NoError(err)
+	require.NoError(scheduler.SetSpec("0 30 6 * * *", "API key ops"))
+	require.NoError(scheduler.Pause("API key ops"))
+
+	// A restarted service uses the saved schedule rather than the configured one
+	scheduler, err = NewScheduler(suite.Database.C("schedule"), "0 0 22 * * *", job)
+	require.NoError(err)
+	status := scheduler.Status()
+	assert.Equal("0 30 6 * * *", status.Spec)
+	assert.True(status.Paused)
+	assert.Equal("API key ops", status.UpdatedBy)
+	assert.Empty(status.NextRuns)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
+	"gopkg.in/mgo.v2"
+)
+
+// RegisterDataEntryTriggerHandler registers the handler that receives REDCap Data Entry Trigger notifications.  Only
+// notifications for the project IDs of the configured projects are accepted, and only if the trigger URL passes the
+// project's data entry trigger token in the token query parameter.  Since the endpoint doesn't require API keys or
+// JWTs, projects without a token never accept notifications.  Repeated saves of the same record are
+// debounced, so the record is refreshed once no more saves have been received for the given delay.  If the history is
+// not nil, each refresh is recorded in it.
+func RegisterDataEntryTriggerHandler(e *gin.Engine, delay time.Duration, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory) {
+	debouncer := NewDebouncer(delay)
+	e.POST("/redcap/det", func(c *gin.Context) {
+		projectID := c.PostForm("project_id")
+		var project *client.REDCapProject
+		for i := range projects {
+			if projectID != "" && projects[i].ProjectID == projectID {
+				project = &projects[i]
+				break
+			}
+		}
+		if project == nil {
+			slog.Warn("Ignoring REDCap data entry trigger for unknown project", "project_id", projectID)
+			c.String(http.StatusForbidden, "Unknown REDCap project ID")
+			return
+		}
+		if !project.AcceptsTriggerToken(c.Query("token")) {
+			slog.Warn("Ignoring REDCap data entry trigger without a valid token", "project_id", projectID, "remote_addr", c.Request.RemoteAddr)
+			c.String(http.StatusForbidden, "Invalid data entry trigger token")
+			return
+		}
+		record := c.PostForm("record")
+		if record == "" {
+			c.String(http.StatusBadRequest, "Missing REDCap record")
+			return
+		}
+
+		key := projectID + "|" + record
+		var refresh func()
+		refresh = func() {
+			ctx := logging.WithJobID(context.Background(), logging.NewJobID())
+			// Every project is passed along so that the record's patient keeps its studies from the other projects
+			opts := client.RefreshOptions{RecordIDs: []string{record}, Source: project.Name}
+			results, err := refreshRiskAssessmentsWithOptions(ctx, RefreshTrigger{TriggerDET, "REDCap project " + projectID}, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history, opts)
+			if held, ok := err.(*LeaseHeldError); ok {
+				// Try again once the running refresh has had some time to finish
+				slog.InfoContext(logging.WithStudyID(ctx, record), "Delaying data entry trigger refresh while another refresh runs", "running_job_id", held.JobID)
+				debouncer.Trigger(key, refresh)
+			} else if err != nil {
+				slog.ErrorContext(logging.WithStudyID(ctx, record), "Couldn't refresh risk assessments", "trigger", "det", "error", err)
+			} else {
+				client.LogResultSummary(ctx, results)
+			}
+		}
+		debouncer.Trigger(key, refresh)
+		c.Status(http.StatusAccepted)
+	})
+}
+
+// Debouncer delays calls to a function until no more calls with the same key have been triggered for a given delay
+type Debouncer struct {
+	Delay  time.Duration
+	timers map[string]*time.Timer
+	mutex  sync.Mutex
+}
+
+// NewDebouncer creates a new debouncer with the given delay
+func NewDebouncer(delay time.Duration) *Debouncer {
+	return &Debouncer{
+		Delay:  delay,
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// Trigger schedules fn to be called after the delay.  If another call with the same key is already pending, the
+// pending call is cancelled and replaced by this one.
+func (d *Debouncer) Trigger(key string, fn func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if t, ok := d.timers[key]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d.Delay, func() {
+		d.mutex.Lock()
+		if d.timers[key] == t {
+			delete(d.timers, key)
+		}
+		d.mutex.Unlock()
+		fn()
+	})
+	d.timers[key] = t
+}
+
+// Pending returns the number of calls waiting to be made
+func (d *Debouncer) Pending() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.timers)
+}
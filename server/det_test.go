@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestDataEntryTriggerSuite(t *testing.T) {
+	suite.Run(t, new(DataEntryTriggerSuite))
+}
+
+type DataEntryTriggerSuite struct {
+	suite.Suite
+	Server *httptest.Server
+}
+
+func (suite *DataEntryTriggerSuite) SetupTest() {
+	// Turn off debug mode since all of the logging gets in the way
+	gin.SetMode(gin.ReleaseMode)
+
+	e := gin.New()
+	RegisterDataEntryTriggerHandler(e, time.Hour, "http://fhir", []client.REDCapProject{{ProjectID: "42", Endpoint: "http://redcap", Token: "123abc", TriggerToken: "det-secret"}}, nil, "http://example.org/pies", nil, nil)
+	suite.Server = httptest.NewServer(e)
+}
+
+func (suite *DataEntryTriggerSuite) TearDownTest() {
+	suite.Server.Close()
+}
+
+func (suite *DataEntryTriggerSuite) TestWrongProject() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	res, err := http.PostForm(suite.Server.URL+"/redcap/det?token=det-secret", url.Values{
+		"project_id":        {"43"},
+		"record":            {"1"},
+		"instrument":        {"risk_factors"},
+		"redcap_event_name": {"initial_arm_1"},
+	})
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusForbidden, res.StatusCode)
+}
+
+func (suite *DataEntryTriggerSuite) TestMissingRecord() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	res, err := http.PostForm(suite.Server.URL+"/redcap/det?token=det-secret", url.Values{
+		"project_id": {"42"},
+		"instrument": {"risk_factors"},
+	})
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (suite *DataEntryTriggerSuite) TestInvalidToken() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	values := url.Values{
+		"project_id":        {"42"},
+		"record":            {"1"},
+		"instrument":        {"risk_factors"},
+		"redcap_event_name": {"initial_arm_1"},
+	}
+	for _, query := range []string{"", "?token=", "?token=guess"} {
+		res, err := http.PostForm(suite.Server.URL+"/redcap/det"+query, values)
+		require.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusForbidden, res.StatusCode, query)
+	}
+}
+
+func (suite *DataEntryTriggerSuite) TestProjectWithoutToken() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// The endpoint doesn't require API keys, so a project without a token can't accept triggers at all
+	e := gin.New()
+	RegisterDataEntryTriggerHandler(e, time.Hour, "http://fhir", []client.REDCapProject{{ProjectID: "42", Endpoint: "http://redcap", Token: "123abc"}}, nil, "http://example.org/pies", nil, nil)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.PostForm(server.URL+"/redcap/det?token=", url.Values{"project_id": {"42"}, "record": {"1"}})
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusForbidden, res.StatusCode)
+}
+
+func (suite *DataEntryTriggerSuite) TestAccepted() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	res, err := http.PostForm(suite.Server.URL+"/redcap/det?token=det-secret", url.Values{
+		"project_id":        {"42"},
+		"record":            {"1"},
+		"instrument":        {"risk_factors"},
+		"redcap_event_name": {"initial_arm_1"},
+	})
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+}
+
+func (suite *DataEntryTriggerSuite) TestSharedPatient() {
+	require := suite.Require()
+
+	projects, fhirServer, transactions, closeServers := newSharedPatientServers(&suite.Suite)
+	defer closeServers()
+	e := gin.New()
+	RegisterDataEntryTriggerHandler(e, 10*time.Millisecond, fhirServer.URL, projects, nil, "http://example.org/pies", nil, nil)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.PostForm(server.URL+"/redcap/det?token=det-a", url.Values{"project_id": {"42"}, "record": {"1"}})
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(http.StatusAccepted, res.StatusCode)
+
+	// Replacing the patient's risk assessments keeps the one from project B
+	select {
+	case bundle := <-transactions:
+		assertPostedDates(&suite.Suite, bundle, "2016-01-01", "2016-02-01")
+	case <-time.After(5 * time.Second):
+		require.FailNow("The data entry trigger didn't post the risk assessments")
+	}
+}
+
+// newSharedPatientServers starts the servers for two REDCap projects, A and B, whose studies 1 and 7 belong to FHIR
+// patient p1, along with the FHIR server.  Transactions posted to the FHIR server are sent to the channel and fail, so
+// no pies are stored.
+func newSharedPatientServers(s *suite.Suite) ([]client.REDCapProject, *httptest.Server, chan *fhir.Bundle, func()) {
+	newREDCap := func(studyID, date string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			r.ParseForm()
+			requested := false
+			for key, values := range r.PostForm {
+				requested = requested || (strings.HasPrefix(key, "records[") && values[0] == studyID)
+			}
+			if !requested {
+				w.Write([]byte(`[]`))
+				return
+			}
+			fmt.Fprintf(w, `[{"study_id": "%s", "redcap_event_name": "initial_arm_1", "rf_date": "%s", "rf_cmc_risk_cat": "1",
+				"rf_func_risk_cat": "2", "rf_sb_risk_cat": "3", "rf_util_risk_cat": "4", "rf_risk_predicted": "2",
+				"risk_factors_complete": "2"}]`, studyID, date)
+		}))
+	}
+	redcapA := newREDCap("1", "2016-01-01")
+	redcapB := newREDCap("7", "2016-02-01")
+
+	transactions := make(chan *fhir.Bundle, 1)
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST":
+			bundle := new(fhir.Bundle)
+			s.NoError(json.NewDecoder(r.Body).Decode(bundle))
+			transactions <- bundle
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == "/Patient/p1":
+			w.Write([]byte(`{"resourceType": "Patient", "id": "p1", "identifier": [{"system": "http://a", "value": "1"},
+				{"system": "http://b", "value": "7"}]}`))
+		case r.URL.Query().Get("identifier") == "http://a|1" || r.URL.Query().Get("identifier") == "http://b|7":
+			w.Write([]byte(`{"resourceType": "Bundle", "entry": [{"resource": {"resourceType": "Patient", "id": "p1"}}]}`))
+		default:
+			w.Write([]byte(`{"resourceType": "Bundle", "entry": []}`))
+		}
+	}))
+
+	projects := []client.REDCapProject{
+		{Name: "A", ProjectID: "42", Endpoint: redcapA.URL, Token: "123abc", TriggerToken: "det-a", IdentifierSystem: "http://a"},
+		{Name: "B", ProjectID: "43", Endpoint: redcapB.URL, Token: "456def", TriggerToken: "det-b", IdentifierSystem: "http://b"},
+	}
+	return projects, fhirServer, transactions, func() {
+		redcapA.Close()
+		redcapB.Close()
+		fhirServer.Close()
+	}
+}
+
+// assertPostedDates asserts that the transaction replaces the patient's risk assessments with ones for the dates
+func assertPostedDates(s *suite.Suite, bundle *fhir.Bundle, dates ...string) {
+	s.Require().Len(bundle.Entry, len(dates)+1)
+	s.Equal("DELETE", bundle.Entry[0].Request.Method)
+	var posted []string
+	for _, entry := range bundle.Entry[1:] {
+		s.Equal("POST", entry.Request.Method)
+		posted = append(posted, entry.Resource.(*fhir.RiskAssessment).Date.Time.Format("2006-01-02"))
+	}
+	s.Equal(dates, posted)
+}
+
+func (suite *DataEntryTriggerSuite) TestDebouncer() {
+	assert := suite.Assert()
+
+	var a, b int32
+	d := NewDebouncer(100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		d.Trigger("a", func() { atomic.AddInt32(&a, 1) })
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.Trigger("b", func() { atomic.AddInt32(&b, 1) })
+	assert.Equal(2, d.Pending())
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&a), "Repeated triggers should only be called once")
+	assert.Equal(int32(1), atomic.LoadInt32(&b))
+	assert.Equal(0, d.Pending())
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/riskservice/plugin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// exportFlushRows is how many rows are written between flushes of the export response
+const exportFlushRows = 100
+
+// ExportQuery filters the risk assessments exported.  Zero values don't filter.
+type ExportQuery struct {
+	Format string
+	// From and To limit the risk assessments to those dated in the time range (inclusive)
+	From, To time.Time
+	// Patients and Studies limit the risk assessments to those for the given FHIR patient IDs and study IDs
+	Patients []string
+	Studies  []string
+}
+
+// ParseExportQuery parses the export format and filters from the query parameters: format (csv or ndjson, defaulting
+// to csv), from and to (RFC 3339 times, or dates, where a "to" date includes the whole day), and patient and study
+// (comma-separated)
+func ParseExportQuery(params map[string][]string) (ExportQuery, error) {
+	get := func(key string) string {
+		if values := params[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+	q := ExportQuery{Format: ExportCSV}
+	var err error
+	switch format := get("format"); format {
+	case "", ExportCSV:
+	case ExportNDJSON:
+		q.Format = ExportNDJSON
+	default:
+		return q, fmt.Errorf("Invalid format %s (must be csv or ndjson)", format)
+	}
+	if from := get("from"); from != "" {
+		if q.From, err = parseHistoryTime(from, false); err != nil {
+			return q, err
+		}
+	}
+	if to := get("to"); to != "" {
+		if q.To, err = parseHistoryTime(to, true); err != nil {
+			return q, err
+		}
+	}
+	q.Patients = splitList(get("patient"))
+	q.Studies = splitList(get("study"))
+	return q, nil
+}
+
+// selector returns the Mongo selector for the pies matching the query.  Patient IDs are matched against the patient
+// URLs on the FHIR endpoint.
+func (q *ExportQuery) selector(fhirEndpoint string) bson.M {
+	method := client.REDCapRiskServiceConfig.Method.Coding[0]
+	sel := bson.M{"method.coding": bson.M{"$elemMatch": bson.M{"system": method.System, "code": method.Code}}}
+	asOf := bson.M{}
+	if !q.From.IsZero() {
+		asOf["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		asOf["$lte"] = q.To
+	}
+	if len(asOf) > 0 {
+		sel["asOf"] = asOf
+	}
+	if len(q.Patients) > 0 {
+		urls := make([]string, len(q.Patients))
+		for i, id := range q.Patients {
+			urls[i] = fhirEndpoint + "/Patient/" + id
+		}
+		sel["patient"] = bson.M{"$in": urls}
+	}
+	if len(q.Studies) > 0 {
+		sel["studyID"] = bson.M{"$in": q.Studies}
+	}
+	return sel
+}
+
+// storedPie is a pie as stored by a refresh, with its assessment date and source record.  Pies stored before the
+// assessment date and source record were recorded don't have them.
+type storedPie struct {
+	plugin.Pie       `bson:",inline"`
+	AsOf             *time.Time `bson:"asOf"`
+	client.PieSource `bson:",inline"`
+}
+
+// ExportRow is the exported form of a risk assessment and its pie
+type ExportRow struct {
+	StudyID          string     `json:"studyID,omitempty"`
+	FHIRPatientID    string     `json:"fhirPatientID"`
+	Date             *time.Time `json:"date,omitempty"`
+	Event            string     `json:"event,omitempty"`
+	Source           string     `json:"source,omitempty"`
+	ClinicalRisk     *int       `json:"clinicalRisk,omitempty"`
+	FunctionalRisk   *int       `json:"functionalRisk,omitempty"`
+	PsychosocialRisk *int       `json:"psychosocialRisk,omitempty"`
+	UtilizationRisk  *int       `json:"utilizationRisk,omitempty"`
+	PerceivedRisk    *int       `json:"perceivedRisk,omitempty"`
+	Score            int        `json:"score"`
+	PieID            string     `json:"pieID"`
+}
+
+// ExportHeader is the header row of the CSV export
+var ExportHeader = []string{"study_id", "fhir_patient_id", "date", "redcap_event_name", "source", "clinical_risk",
+	"functional_risk", "psychosocial_risk", "utilization_risk", "perceived_risk", "score", "pie_id"}
+
+// newExportRow converts a stored pie to its exported form
+func newExportRow(pie *storedPie) ExportRow {
+	row := ExportRow{
+		StudyID:       pie.StudyID,
+		Date:          pie.AsOf,
+		Event:         pie.Event,
+		Source:        pie.Source,
+		PerceivedRisk: pie.PerceivedRisk,
+		PieID:         pie.Id.Hex(),
+	}
+	if i := strings.LastIndex(pie.Patient, "/Patient/"); i >= 0 {
+		row.FHIRPatientID = pie.Patient[i+len("/Patient/"):]
+	}
+	latest := latestPie{Slices: pie.Slices}
+	row.Score = latest.Score()
+	for i := range pie.Slices {
+		value := pie.Slices[i].Value
+		switch pie.Slices[i].Name {
+		case "Clinical Risk":
+			row.ClinicalRisk = &value
+		case "Functional and Environmental Risk":
+			row.FunctionalRisk = &value
+		case "Psychosocial and Mental Health Risk":
+			row.PsychosocialRisk = &value
+		case "Utilization Risk":
+			row.UtilizationRisk = &value
+		}
+	}
+	return row
+}
+
+// csv returns the row's CSV fields, in the order of the ExportHeader
+func (r *ExportRow) csv() []string {
+	optional := func(value *int) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.Itoa(*value)
+	}
+	var date string
+	if r.Date != nil {
+		date = r.Date.Format("2006-01-02")
+	}
+	return []string{r.StudyID, r.FHIRPatientID, date, r.Event, r.Source, optional(r.ClinicalRisk),
+		optional(r.FunctionalRisk), optional(r.PsychosocialRisk), optional(r.UtilizationRisk), optional(r.PerceivedRisk),
+		strconv.Itoa(r.Score), r.PieID}
+}
+
+// exportWriter writes export rows in one of the export formats
+type exportWriter interface {
+	Write(row *ExportRow) error
+	Flush() error
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvExportWriter) Write(row *ExportRow) error {
+	return w.writer.Write(row.csv())
+}
+
+func (w *csvExportWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *ndjsonExportWriter) Write(row *ExportRow) error {
+	return w.encoder.Encode(row)
+}
+
+func (w *ndjsonExportWriter) Flush() error {
+	return nil
+}
+
+// WriteExport writes one row for every risk assessment matching the query to the writer, in the query's format.  The
+// pies are read from Mongo and written as they are iterated, calling flush after every few rows, so the export never
+// has to fit in memory.
+func WriteExport(w io.Writer, flush func(), fhirEndpoint string, pieCollection *mgo.Collection, q ExportQuery) error {
+	var writer exportWriter
+	if q.Format == ExportNDJSON {
+		writer = &ndjsonExportWriter{json.NewEncoder(w)}
+	} else {
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(ExportHeader); err != nil {
+			return err
+		}
+		writer = &csvExportWriter{csvWriter}
+	}
+
+	// Sorting by ID gives a stable order without needing another index
+	iter := pieCollection.Find(q.selector(fhirEndpoint)).Sort("_id").Iter()
+	var pie storedPie
+	for rows := 1; iter.Next(&pie); rows++ {
+		row := newExportRow(&pie)
+		if err := writer.Write(&row); err != nil {
+			iter.Close()
+			return err
+		}
+		if rows%exportFlushRows == 0 {
+			if err := writer.Flush(); err != nil {
+				iter.Close()
+				return err
+			}
+			flush()
+		}
+		pie = storedPie{}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// RegisterExportHandler registers the handler streaming the risk assessments as CSV or NDJSON
+func RegisterExportHandler(e *gin.Engine, fhirEndpoint string, pieCollection *mgo.Collection) {
+	e.GET("/export", func(c *gin.Context) {
+		q, err := ParseExportQuery(c.Request.URL.Query())
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if q.Format == ExportNDJSON {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Header("Content-Disposition", `attachment; filename="riskassessments.ndjson"`)
+		} else {
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Header("Content-Disposition", `attachment; filename="riskassessments.csv"`)
+		}
+		c.Status(http.StatusOK)
+		if err := WriteExport(c.Writer, c.Writer.Flush, fhirEndpoint, pieCollection, q); err != nil {
+			c.Error(err)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestExportSuite(t *testing.T) {
+	suite.Run(t, new(ExportSuite))
+}
+
+type ExportSuite struct {
+	suite.Suite
+}
+
+func (suite *ExportSuite) TestParseExportQuery() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	q, err := ParseExportQuery(url.Values{})
+	require.NoError(err)
+	assert.Equal(ExportQuery{Format: ExportCSV}, q)
+
+	q, err = ParseExportQuery(url.Values{
+		"format":  {"ndjson"},
+		"from":    {"2016-01-01"},
+		"to":      {"2016-01-31"},
+		"patient": {"p1,p2"},
+		"study":   {"1"},
+	})
+	require.NoError(err)
+	assert.Equal(ExportNDJSON, q.Format)
+	sel := q.selector("http://fhir")
+	assert.Equal(bson.M{"$gte": q.From, "$lte": q.To}, sel["asOf"])
+	assert.Equal(bson.M{"$in": []string{"http://fhir/Patient/p1", "http://fhir/Patient/p2"}}, sel["patient"])
+	assert.Equal(bson.M{"$in": []string{"1"}}, sel["studyID"])
+	assert.NotNil(sel["method.coding"])
+
+	for _, params := range []url.Values{
+		{"format": {"xml"}},
+		{"from": {"yesterday"}},
+	} {
+		_, err = ParseExportQuery(params)
+		assert.Error(err, "%v", params)
+	}
+}
+
+func (suite *ExportSuite) TestExportRow() {
+	assert := suite.Assert()
+
+	asOf := time.Date(2016, 2, 21, 0, 0, 0, 0, time.UTC)
+	perceived := 2
+	pie := &storedPie{
+		Pie: plugin.Pie{
+			Id:      bson.ObjectIdHex("56fd63cdac1c5d77f6f695b1"),
+			Patient: "http://fhir/Patient/p1",
+			Slices: []plugin.Slice{
+				{Name: "Clinical Risk", Value: 1},
+				{Name: "Functional and Environmental Risk", Value: 1},
+				{Name: "Psychosocial and Mental Health Risk", Value: 3},
+				{Name: "Utilization Risk", Value: 1},
+			},
+		},
+		AsOf:      &asOf,
+		PieSource: client.PieSource{StudyID: "a", Event: "initial_arm_1", Source: "A", PerceivedRisk: &perceived},
+	}
+	row := newExportRow(pie)
+	assert.Equal("p1", row.FHIRPatientID)
+	assert.Equal(3, row.Score)
+	assert.Equal([]string{"a", "p1", "2016-02-21", "initial_arm_1", "A", "1", "1", "3", "1", "2", "3", "56fd63cdac1c5d77f6f695b1"}, row.csv())
+
+	// Pies stored before their source records were recorded leave the columns empty
+	row = newExportRow(&storedPie{Pie: pie.Pie})
+	assert.Equal([]string{"", "p1", "", "", "", "1", "1", "3", "1", "", "3", "56fd63cdac1c5d77f6f695b1"}, row.csv())
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"gopkg.in/mgo.v2"
+)
+
+var errTimeout = errors.New("check timed out")
+
+// healthCheckTimeout is how long each readiness check may take before the dependency is considered down
+var healthCheckTimeout = 5 * time.Second
+
+// Readiness statuses
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+)
+
+// refreshStatus describes the outcome of the most recent refresh
+type refreshStatus struct {
+	sync.RWMutex
+	Time            *time.Time `json:"time,omitempty"`
+	Partial         bool       `json:"partial,omitempty"`
+	Patients        int        `json:"patients"`
+	Errors          int        `json:"errors"`
+	RiskAssessments int        `json:"riskAssessments"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// lastRefresh holds the outcome of the most recent refresh, reported by the readiness endpoint
+var lastRefresh refreshStatus
+
+// Update records the outcome of a refresh.  A partial refresh only refreshed specific records.
+func (r *refreshStatus) Update(summary RefreshCompletedEvent, partial bool) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	r.Time = &now
+	r.Partial = partial
+	r.Patients = summary.Patients
+	r.Errors = summary.Errors
+	r.RiskAssessments = summary.RiskAssessments
+	r.Error = summary.Error
+}
+
+// copy returns a copy of the status that is safe to serialize
+func (r *refreshStatus) copy() *refreshStatus {
+	r.RLock()
+	defer r.RUnlock()
+	return &refreshStatus{
+		Time:            r.Time,
+		Partial:         r.Partial,
+		Patients:        r.Patients,
+		Errors:          r.Errors,
+		RiskAssessments: r.RiskAssessments,
+		Error:           r.Error,
+	}
+}
+
+// DependencyCheck represents the result of checking a dependency
+type DependencyCheck struct {
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+
+	check func() error
+}
+
+// RegisterHealthHandlers registers the liveness (GET /healthz) and readiness (GET /readyz) handlers.  Readiness pings
+// Mongo, requests the FHIR server's metadata, and requests the version from each REDCap project.  Mongo and the FHIR
+// server are critical, so the service is unavailable (HTTP 503) if either is down.  If only REDCap is down, pies can
+// still be served, so the service is degraded but ready.
+func RegisterHealthHandlers(e *gin.Engine, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection) {
+	e.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+	})
+
+	e.GET("/readyz", func(c *gin.Context) {
+		status, checks := CheckDependencies(fhirEndpoint, projects, pieCollection)
+		code := http.StatusOK
+		if status == StatusUnavailable {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, gin.H{
+			"status":      status,
+			"checks":      checks,
+			"lastRefresh": lastRefresh.copy(),
+		})
+	})
+}
+
+// CheckDependencies pings Mongo, requests the FHIR server's metadata, and requests the version from each REDCap
+// project, returning the overall status along with each check.  The status is unavailable if Mongo or the FHIR server
+// is down, or degraded if only REDCap is down.
+func CheckDependencies(fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection) (string, []*DependencyCheck) {
+	checks := []*DependencyCheck{
+		{Name: "mongo", Critical: true, check: func() error {
+			session := pieCollection.Database.Session.Copy()
+			defer session.Close()
+			return session.Ping()
+		}},
+		{Name: "fhir", Critical: true, check: func() error {
+			return client.CheckFHIRServer(fhirEndpoint)
+		}},
+	}
+	for i := range projects {
+		project := projects[i]
+		name := "redcap"
+		if project.Name != "" {
+			name += ":" + project.Name
+		}
+		checks = append(checks, &DependencyCheck{Name: name, check: func() error {
+			_, err := client.GetREDCapVersion(project)
+			return err
+		}})
+	}
+	runChecks(checks)
+
+	status := StatusOK
+	for _, check := range checks {
+		if check.Status != StatusOK {
+			if check.Critical {
+				return StatusUnavailable, checks
+			}
+			status = StatusDegraded
+		}
+	}
+	return status, checks
+}
+
+// runChecks runs the checks concurrently, failing any that don't finish within the timeout
+func runChecks(checks []*DependencyCheck) {
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check *DependencyCheck) {
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- check.check() }()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(healthCheckTimeout):
+				err = errTimeout
+			}
+			check.Duration = time.Since(start).String()
+			if err != nil {
+				check.Status = StatusUnavailable
+				check.Error = client.Redact(err.Error())
+			} else {
+				check.Status = StatusOK
+			}
+		}(check)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestHealthSuite(t *testing.T) {
+	suite.Run(t, new(HealthSuite))
+}
+
+type HealthSuite struct {
+	suite.Suite
+}
+
+func (suite *HealthSuite) TestHealthz() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	gin.SetMode(gin.ReleaseMode)
+	e := gin.New()
+	RegisterHealthHandlers(e, "http://fhir", nil, nil)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/healthz")
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	var body map[string]string
+	require.NoError(json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(StatusOK, body["status"])
+}
+
+func (suite *HealthSuite) TestRunChecks() {
+	assert := suite.Assert()
+
+	defer func(timeout time.Duration) { healthCheckTimeout = timeout }(healthCheckTimeout)
+	healthCheckTimeout = 20 * time.Millisecond
+
+	checks := []*DependencyCheck{
+		{Name: "ok", check: func() error { return nil }},
+		{Name: "failed", check: func() error { return errors.New("connection refused") }},
+		{Name: "slow", check: func() error { time.Sleep(time.Second); return nil }},
+	}
+	runChecks(checks)
+	assert.Equal(StatusOK, checks[0].Status)
+	assert.Empty(checks[0].Error)
+	assert.Equal(StatusUnavailable, checks[1].Status)
+	assert.Equal("connection refused", checks[1].Error)
+	assert.Equal(StatusUnavailable, checks[2].Status)
+	assert.Equal("check timed out", checks[2].Error)
+}
+
+func (suite *HealthSuite) TestRefreshStatus() {
+	assert := suite.Assert()
+
+	var status refreshStatus
+	assert.Nil(status.copy().Time)
+
+	status.Update(RefreshCompletedEvent{Patients: 3, Errors: 1, RiskAssessments: 5}, true)
+	c := status.copy()
+	assert.NotNil(c.Time)
+	assert.True(c.Partial)
+	assert.Equal(3, c.Patients)
+	assert.Equal(1, c.Errors)
+	assert.Equal(5, c.RiskAssessments)
+
+	status.Update(RefreshCompletedEvent{Error: "REDCap is down"}, false)
+	c = status.copy()
+	assert.False(c.Partial)
+	assert.Equal("REDCap is down", c.Error)
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// What triggered a refresh
+const (
+	TriggerCron = "cron"
+	TriggerAPI  = "api"
+	TriggerDET  = "det"
+	// TriggerResume indicates the refresh resumed an interrupted run
+	TriggerResume = "resume"
+	// TriggerImport indicates the refresh imported a REDCap export file instead of querying REDCap
+	TriggerImport = "import"
+	// TriggerCommand indicates the refresh was run by the refresh command rather than the running service
+	TriggerCommand = "command"
+)
+
+// Statuses of a refresh run
+const (
+	// RunRunning indicates the refresh hasn't finished (or the service stopped before it could finish)
+	RunRunning = "running"
+	// RunSucceeded indicates every study was refreshed without errors
+	RunSucceeded = "succeeded"
+	// RunPartial indicates the refresh finished, but some studies had errors
+	RunPartial = "partial"
+	// RunFailed indicates the refresh failed entirely (e.g., REDCap couldn't be reached)
+	RunFailed = "failed"
+	// RunInterrupted indicates the refresh was stopped (e.g., at shutdown) before every study was processed
+	RunInterrupted = "interrupted"
+)
+
+// RefreshTrigger describes what started a refresh: the trigger type and who or what was behind it (the API
+// credentials' subject, the cron spec, the REDCap project sending a data entry trigger, the imported file, or the user
+// running the refresh command)
+type RefreshTrigger struct {
+	Type string `bson:"type" json:"type"`
+	By   string `bson:"by,omitempty" json:"by,omitempty"`
+}
+
+// RefreshRun is the record of a single refresh kept in the refresh history
+type RefreshRun struct {
+	ID       bson.ObjectId  `bson:"_id" json:"id"`
+	JobID    string         `bson:"jobID,omitempty" json:"jobID,omitempty"`
+	Trigger  RefreshTrigger `bson:"trigger" json:"trigger"`
+	Started  time.Time      `bson:"started" json:"started"`
+	Finished *time.Time     `bson:"finished,omitempty" json:"finished,omitempty"`
+	Status   string         `bson:"status" json:"status"`
+	Records  []string       `bson:"records,omitempty" json:"records,omitempty"`
+	// Exclude lists the studies left out of the run because an earlier run it resumed already processed them
+	Exclude         []string        `bson:"exclude,omitempty" json:"exclude,omitempty"`
+	Projects        []ProjectConfig `bson:"projects" json:"projects"`
+	Patients        int             `bson:"patients" json:"patients"`
+	Errors          int             `bson:"errors" json:"errors"`
+	RiskAssessments int             `bson:"riskAssessments" json:"riskAssessments"`
+	Error           string          `bson:"error,omitempty" json:"error,omitempty"`
+	Results         []RunResult     `bson:"results,omitempty" json:"results,omitempty"`
+	// Checkpointed is when the results of the studies processed so far were last saved
+	Checkpointed *time.Time `bson:"checkpointed,omitempty" json:"checkpointed,omitempty"`
+	// Pending lists the studies an interrupted run didn't process.  If empty, the run either didn't process any studies
+	// or was still running at the shutdown timeout, and is resumed from its checkpointed results.
+	Pending []string `bson:"pending,omitempty" json:"pending,omitempty"`
+	// ResumedBy is the job ID of the refresh resuming an interrupted run
+	ResumedBy string `bson:"resumedBy,omitempty" json:"resumedBy,omitempty"`
+}
+
+// ProjectConfig is the snapshot of a REDCap project's configuration recorded with each run.  It never includes the
+// project's API token.
+type ProjectConfig struct {
+	Name             string                       `bson:"name,omitempty" json:"name,omitempty"`
+	ProjectID        string                       `bson:"projectID,omitempty" json:"projectID,omitempty"`
+	Endpoint         string                       `bson:"endpoint" json:"endpoint"`
+	IdentifierSystem string                       `bson:"identifierSystem,omitempty" json:"identifierSystem,omitempty"`
+	Fields           models.FieldMapping          `bson:"fields,omitempty" json:"fields,omitempty"`
+	Arms             []string                     `bson:"arms,omitempty" json:"arms,omitempty"`
+	IncludeEvents    []string                     `bson:"includeEvents,omitempty" json:"includeEvents,omitempty"`
+	ExcludeEvents    []string                     `bson:"excludeEvents,omitempty" json:"excludeEvents,omitempty"`
+	MinFormStatus    int                          `bson:"minFormStatus" json:"minFormStatus"`
+	ScoreRanges      map[string]models.ScoreRange `bson:"scoreRanges,omitempty" json:"scoreRanges,omitempty"`
+	EarliestDate     *time.Time                   `bson:"earliestDate,omitempty" json:"earliestDate,omitempty"`
+	FutureTolerance  string                       `bson:"futureTolerance,omitempty" json:"futureTolerance,omitempty"`
+}
+
+// RunResult is the stored form of a client.Result
+type RunResult struct {
+	StudyID             string                 `bson:"studyID,omitempty" json:"studyID,omitempty"`
+	Source              string                 `bson:"source,omitempty" json:"source,omitempty"`
+	FHIRPatientID       string                 `bson:"fhirPatientID,omitempty" json:"fhirPatientID,omitempty"`
+	RiskAssessmentCount int                    `bson:"riskAssessmentCount" json:"riskAssessmentCount"`
+	Skipped             map[string]int         `bson:"skipped,omitempty" json:"skipped,omitempty"`
+	Invalid             []models.InvalidRecord `bson:"invalid,omitempty" json:"invalid,omitempty"`
+	Error               string                 `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// snapshotProjects returns the configuration of the projects, without their tokens
+func snapshotProjects(projects []client.REDCapProject) []ProjectConfig {
+	configs := make([]ProjectConfig, len(projects))
+	for i, p := range projects {
+		configs[i] = ProjectConfig{
+			Name:             p.Name,
+			ProjectID:        p.ProjectID,
+			Endpoint:         p.Endpoint,
+			IdentifierSystem: p.IdentifierSystem,
+			Fields:           p.Fields,
+			Arms:             p.Filter.Arms,
+			IncludeEvents:    p.Filter.IncludeEvents,
+			ExcludeEvents:    p.Filter.ExcludeEvents,
+			MinFormStatus:    p.Filter.MinFormStatus,
+			ScoreRanges:      p.Rules.ScoreRanges,
+		}
+		if !p.Rules.EarliestDate.IsZero() {
+			earliest := p.Rules.EarliestDate
+			configs[i].EarliestDate = &earliest
+		}
+		if p.Rules.FutureTolerance != 0 {
+			configs[i].FutureTolerance = p.Rules.FutureTolerance.String()
+		}
+	}
+	return configs
+}
+
+// RefreshHistory records every refresh run in Mongo, removing runs older than the retention period
+type RefreshHistory struct {
+	Runs *mgo.Collection
+	// Retention is how long runs are kept.  If zero, runs are kept forever.
+	Retention time.Duration
+}
+
+// NewRefreshHistory creates a new refresh history backed by the given collection
+func NewRefreshHistory(runs *mgo.Collection, retention time.Duration) *RefreshHistory {
+	return &RefreshHistory{Runs: runs, Retention: retention}
+}
+
+// EnsureIndexes creates the indexes used to query the history
+func (h *RefreshHistory) EnsureIndexes() error {
+	if err := h.Runs.EnsureIndex(mgo.Index{Key: []string{"-started"}}); err != nil {
+		return err
+	}
+	return h.Runs.EnsureIndex(mgo.Index{Key: []string{"jobID"}})
+}
+
+// Start records the start of a refresh, returning the run to pass to Checkpoint and Finish.  It is safe to call Start
+// on a nil RefreshHistory (it records nothing).
+func (h *RefreshHistory) Start(ctx context.Context, trigger RefreshTrigger, projects []client.REDCapProject, recordIDs []string, exclude []string) (*RefreshRun, error) {
+	run := &RefreshRun{
+		ID:       bson.NewObjectId(),
+		JobID:    logging.JobID(ctx),
+		Trigger:  trigger,
+		Started:  time.Now().UTC(),
+		Status:   RunRunning,
+		Records:  recordIDs,
+		Exclude:  exclude,
+		Projects: snapshotProjects(projects),
+	}
+	if h == nil {
+		return run, nil
+	}
+	return run, h.Runs.Insert(run)
+}
+
+// Checkpoint saves the results of the studies processed so far, so that the run can be resumed if it doesn't finish.
+// It is safe to call Checkpoint on a nil RefreshHistory (it records nothing).
+func (h *RefreshHistory) Checkpoint(run *RefreshRun, results []client.Result) error {
+	checkpointed := time.Now().UTC()
+	run.Checkpointed = &checkpointed
+	stored := storeResults(results)
+	run.Results = append(run.Results, stored...)
+	if h == nil {
+		return nil
+	}
+
+	summary := summarizeRefresh(results, nil)
+	return h.Runs.UpdateId(run.ID, bson.M{
+		"$push": bson.M{"results": bson.M{"$each": stored}},
+		"$inc": bson.M{
+			"patients":        summary.Patients,
+			"errors":          summary.Errors,
+			"riskAssessments": summary.RiskAssessments,
+		},
+		"$set": bson.M{"checkpointed": checkpointed},
+	})
+}
+
+// Finish records the outcome of the run and removes any runs past the retention period.  It is safe to call Finish
+// on a nil RefreshHistory (it records nothing).
+func (h *RefreshHistory) Finish(run *RefreshRun, results []client.Result, err error) error {
+	finished := time.Now().UTC()
+	run.Finished = &finished
+	summary := summarizeRefresh(results, err)
+	run.Patients, run.Errors, run.RiskAssessments, run.Error = summary.Patients, summary.Errors, summary.RiskAssessments, summary.Error
+	run.Status = runStatus(summary, err)
+	if interrupted, ok := err.(*client.InterruptedError); ok {
+		run.Pending = interrupted.Pending
+	}
+	run.Results = storeResults(results)
+	if h == nil {
+		return nil
+	}
+
+	if err := h.Runs.UpdateId(run.ID, run); err != nil {
+		return err
+	}
+	_, err = h.Purge(finished)
+	return err
+}
+
+// Abandon marks a run that was still running when the service stopped waiting for it as interrupted, so that it is
+// resumed from its checkpointed results on the next start.  Runs that finished in the meantime are left alone.  It is
+// safe to call Abandon on a nil RefreshHistory (it records nothing).
+func (h *RefreshHistory) Abandon(id bson.ObjectId) error {
+	if h == nil {
+		return nil
+	}
+	err := h.Runs.Update(bson.M{"_id": id, "status": RunRunning}, bson.M{"$set": bson.M{
+		"status":   RunInterrupted,
+		"finished": time.Now().UTC(),
+		"error":    ErrShutdownTimeout.Error(),
+	}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// storeResults converts the results to their stored form
+func storeResults(results []client.Result) []RunResult {
+	stored := make([]RunResult, len(results))
+	for i, r := range results {
+		stored[i] = RunResult{
+			StudyID:             r.StudyID,
+			Source:              r.Source,
+			FHIRPatientID:       r.FHIRPatientID,
+			RiskAssessmentCount: r.RiskAssessmentCount,
+			Skipped:             r.Skipped,
+			Invalid:             r.Invalid,
+		}
+		if r.Error != nil {
+			stored[i].Error = r.Error.Error()
+		}
+	}
+	return stored
+}
+
+// runStatus returns the status of a finished run
+func runStatus(summary RefreshCompletedEvent, err error) string {
+	if _, ok := err.(*client.InterruptedError); ok {
+		return RunInterrupted
+	}
+	switch {
+	case summary.Error != "":
+		return RunFailed
+	case summary.Errors > 0:
+		return RunPartial
+	default:
+		return RunSucceeded
+	}
+}
+
+// Purge removes the runs started before the retention period, as of the given time, returning the number removed
+func (h *RefreshHistory) Purge(now time.Time) (int, error) {
+	if h.Retention <= 0 {
+		return 0, nil
+	}
+	info, err := h.Runs.RemoveAll(bson.M{"started": bson.M{"$lt": now.Add(-h.Retention)}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// HistoryQuery filters the runs returned from the history.  Zero values don't filter.
+type HistoryQuery struct {
+	// From and To limit the runs to those started in the time range (inclusive)
+	From, To time.Time
+	// Statuses and Triggers limit the runs to those with one of the given statuses and trigger types
+	Statuses []string
+	Triggers []string
+	// Limit is the maximum number of runs to return
+	Limit int
+}
+
+// Default and maximum number of runs returned from the history
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// ParseHistoryQuery parses the history filters from the query parameters: from and to (RFC 3339 times, or dates,
+// where a "to" date includes the whole day), status and trigger (comma-separated), and limit
+func ParseHistoryQuery(params map[string][]string) (HistoryQuery, error) {
+	get := func(key string) string {
+		if values := params[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+	q := HistoryQuery{Limit: defaultHistoryLimit}
+	var err error
+	if from := get("from"); from != "" {
+		if q.From, err = parseHistoryTime(from, false); err != nil {
+			return q, err
+		}
+	}
+	if to := get("to"); to != "" {
+		if q.To, err = parseHistoryTime(to, true); err != nil {
+			return q, err
+		}
+	}
+	if status := get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			s = strings.TrimSpace(s)
+			switch s {
+			case RunRunning, RunSucceeded, RunPartial, RunFailed, RunInterrupted:
+				q.Statuses = append(q.Statuses, s)
+			default:
+				return q, fmt.Errorf("Invalid status %s (must be running, succeeded, partial, failed, or interrupted)", s)
+			}
+		}
+	}
+	if trigger := get("trigger"); trigger != "" {
+		for _, t := range strings.Split(trigger, ",") {
+			t = strings.TrimSpace(t)
+			switch t {
+			case TriggerCron, TriggerAPI, TriggerDET, TriggerResume, TriggerImport, TriggerCommand:
+				q.Triggers = append(q.Triggers, t)
+			default:
+				return q, fmt.Errorf("Invalid trigger %s (must be cron, api, det, resume, import, or command)", t)
+			}
+		}
+	}
+	if limit := get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 || q.Limit > maxHistoryLimit {
+			return q, fmt.Errorf("Invalid limit %s (must be 1 to %d)", limit, maxHistoryLimit)
+		}
+	}
+	return q, nil
+}
+
+// parseHistoryTime parses an RFC 3339 time or a date.  If endOfDay is true, a date refers to the last instant of
+// the day.
+func parseHistoryTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("Invalid time %s (must be an RFC 3339 time or a YYYY-MM-DD date)", s)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// selector returns the Mongo selector for the query
+func (q *HistoryQuery) selector() bson.M {
+	sel := bson.M{}
+	started := bson.M{}
+	if !q.From.IsZero() {
+		started["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		started["$lte"] = q.To
+	}
+	if len(started) > 0 {
+		sel["started"] = started
+	}
+	if len(q.Statuses) > 0 {
+		sel["status"] = bson.M{"$in": q.Statuses}
+	}
+	if len(q.Triggers) > 0 {
+		sel["trigger.type"] = bson.M{"$in": q.Triggers}
+	}
+	return sel
+}
+
+// Find returns the runs matching the query, most recent first.  The per-study results are omitted; use Get to
+// retrieve them.
+func (h *RefreshHistory) Find(q HistoryQuery) ([]RefreshRun, error) {
+	runs := []RefreshRun{}
+	err := h.Runs.Find(q.selector()).Select(bson.M{"results": 0}).Sort("-started").Limit(q.Limit).All(&runs)
+	return runs, err
+}
+
+// Get returns the run with the given ID, including its per-study results
+func (h *RefreshHistory) Get(id bson.ObjectId) (*RefreshRun, error) {
+	run := new(RefreshRun)
+	if err := h.Runs.FindId(id).One(run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// GetByJobID returns the most recent run with the given job ID, including its per-study results
+func (h *RefreshHistory) GetByJobID(jobID string) (*RefreshRun, error) {
+	run := new(RefreshRun)
+	if err := h.Runs.Find(bson.M{"jobID": jobID}).Sort("-started").One(run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// RegisterHistoryHandlers registers the handlers listing the refresh history and returning a single run
+func RegisterHistoryHandlers(e *gin.Engine, history *RefreshHistory) {
+	e.GET("/refresh/history", func(c *gin.Context) {
+		q, err := ParseHistoryQuery(c.Request.URL.Query())
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		runs, err := history.Find(q)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, runs)
+	})
+
+	e.GET("/refresh/history/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		if !bson.IsObjectIdHex(id) {
+			c.String(http.StatusBadRequest, "Bad ID format for requested run. Should be a BSON Id")
+			return
+		}
+		run, err := history.Get(bson.ObjectIdHex(id))
+		if err == mgo.ErrNotFound {
+			c.Status(http.StatusNotFound)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, run)
+	})
+}
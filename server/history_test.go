@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestHistorySuite(t *testing.T) {
+	suite.Run(t, new(HistorySuite))
+}
+
+type HistorySuite struct {
+	suite.Suite
+}
+
+func (suite *HistorySuite) TestParseHistoryQuery() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	q, err := ParseHistoryQuery(url.Values{})
+	require.NoError(err)
+	assert.Equal(HistoryQuery{Limit: defaultHistoryLimit}, q)
+	assert.Equal(bson.M{}, q.selector())
+
+	q, err = ParseHistoryQuery(url.Values{
+		"from":    {"2016-03-01"},
+		"to":      {"2016-03-31"},
+		"status":  {"failed, partial"},
+		"trigger": {"cron"},
+		"limit":   {"10"},
+	})
+	require.NoError(err)
+	assert.Equal(time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(time.Date(2016, 3, 31, 23, 59, 59, 999999999, time.UTC), q.To)
+	assert.Equal([]string{RunFailed, RunPartial}, q.Statuses)
+	assert.Equal([]string{TriggerCron}, q.Triggers)
+	assert.Equal(10, q.Limit)
+	assert.Equal(bson.M{
+		"started":      bson.M{"$gte": q.From, "$lte": q.To},
+		"status":       bson.M{"$in": q.Statuses},
+		"trigger.type": bson.M{"$in": q.Triggers},
+	}, q.selector())
+
+	q, err = ParseHistoryQuery(url.Values{"from": {"2016-03-01T12:00:00-05:00"}})
+	require.NoError(err)
+	assert.True(q.From.Equal(time.Date(2016, 3, 1, 17, 0, 0, 0, time.UTC)))
+}
+
+func (suite *HistorySuite) TestParseInvalidHistoryQuery() {
+	assert := suite.Assert()
+
+	for _, params := range []url.Values{
+		{"from": {"yesterday"}},
+		{"to": {"03/31/2016"}},
+		{"status": {"done"}},
+		{"trigger": {"manual"}},
+		{"limit": {"0"}},
+		{"limit": {"5000"}},
+		{"limit": {"ten"}},
+	} {
+		_, err := ParseHistoryQuery(params)
+		assert.Error(err, "%v", params)
+	}
+}
+
+func (suite *HistorySuite) TestSnapshotProjectsOmitsToken() {
+	assert := suite.Assert()
+
+	earliest := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	configs := snapshotProjects([]client.REDCapProject{{
+		Name:      "A",
+		ProjectID: "42",
+		Endpoint:  "http://redcap",
+		Token:     "F65EBA22DCB728FEC5ADFAD42378CA40",
+		Filter:    models.RecordFilter{Arms: []string{"1"}, MinFormStatus: models.FormComplete},
+		Rules:     models.ValidationRules{EarliestDate: earliest, FutureTolerance: 48 * time.Hour},
+	}})
+	assert.Equal([]ProjectConfig{{
+		Name:            "A",
+		ProjectID:       "42",
+		Endpoint:        "http://redcap",
+		Arms:            []string{"1"},
+		MinFormStatus:   models.FormComplete,
+		EarliestDate:    &earliest,
+		FutureTolerance: "48h0m0s",
+	}}, configs)
+}
+
+func (suite *HistorySuite) TestFinishWithoutHistory() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	var history *RefreshHistory
+	ctx := logging.WithJobID(context.Background(), "job1")
+	run, err := history.Start(ctx, RefreshTrigger{TriggerAPI, "API key frontend"}, nil, []string{"1"}, nil)
+	require.NoError(err)
+	assert.Equal("job1", run.JobID)
+	assert.Equal(RunRunning, run.Status)
+	assert.Equal([]string{"1"}, run.Records)
+
+	require.NoError(history.Finish(run, []client.Result{
+		{StudyID: "1", FHIRPatientID: "p1", RiskAssessmentCount: 2},
+		{StudyID: "2", Error: errors.New("No patient found")},
+	}, nil))
+	assert.Equal(RunPartial, run.Status)
+	assert.NotNil(run.Finished)
+	assert.Equal(2, run.Patients)
+	assert.Equal(1, run.Errors)
+	assert.Equal(2, run.RiskAssessments)
+	require.Len(run.Results, 2)
+	assert.Equal("No patient found", run.Results[1].Error)
+
+	require.NoError(history.Finish(run, nil, errors.New("REDCap is down")))
+	assert.Equal(RunFailed, run.Status)
+	assert.Equal("REDCap is down", run.Error)
+
+	require.NoError(history.Finish(run, []client.Result{{StudyID: "1"}}, nil))
+	assert.Equal(RunSucceeded, run.Status)
+}
+
+func (suite *HistorySuite) TestFinishInterrupted() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	var history *RefreshHistory
+	run, err := history.Start(context.Background(), RefreshTrigger{Type: TriggerCron}, nil, nil, nil)
+	require.NoError(err)
+	interrupted := &client.InterruptedError{Pending: []string{"2", "3"}, Err: context.Canceled}
+	require.NoError(history.Finish(run, []client.Result{{StudyID: "1", RiskAssessmentCount: 2}}, interrupted))
+	assert.Equal(RunInterrupted, run.Status)
+	assert.Equal([]string{"2", "3"}, run.Pending)
+	assert.Equal(1, run.Patients)
+
+	q, err := ParseHistoryQuery(url.Values{"status": {"interrupted"}, "trigger": {"resume,command"}})
+	require.NoError(err)
+	assert.Equal([]string{RunInterrupted}, q.Statuses)
+	assert.Equal([]string{TriggerResume, TriggerCommand}, q.Triggers)
+}
+
+func (suite *HistorySuite) TestCheckpointWithoutHistory() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	var history *RefreshHistory
+	run, err := history.Start(context.Background(), RefreshTrigger{Type: TriggerCron}, nil, nil, []string{"0"})
+	require.NoError(err)
+	assert.Equal([]string{"0"}, run.Exclude)
+	require.NoError(history.Checkpoint(run, []client.Result{{StudyID: "1", RiskAssessmentCount: 2}}))
+	require.NoError(history.Checkpoint(run, []client.Result{{StudyID: "2", Error: errors.New("No patient found")}}))
+	assert.NotNil(run.Checkpointed)
+	require.Len(run.Results, 2)
+	assert.Equal("1", run.Results[0].StudyID)
+	assert.Equal("No patient found", run.Results[1].Error)
+}
+
+func (suite *HistorySuite) TestResumeOptions() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	run := &RefreshRun{
+		Status:  RunRunning,
+		Records: []string{"1", "2", "3", "4"},
+		Exclude: []string{"0"},
+		Results: []RunResult{{StudyID: "1"}, {StudyID: "2", Error: "No patient found"}},
+	}
+	opts, err := run.resumeOptions(false)
+	require.NoError(err)
+	assert.Equal([]string{"1", "2", "3", "4"}, opts.RecordIDs)
+	assert.Equal([]string{"0", "1"}, opts.Exclude)
+
+	opts, err = run.resumeOptions(true)
+	require.NoError(err)
+	assert.Equal([]string{"2"}, opts.RecordIDs)
+	assert.Empty(opts.Exclude)
+
+	// Every study of a patient with a failed study is refreshed again
+	run = &RefreshRun{
+		Status: RunInterrupted,
+		Results: []RunResult{
+			{StudyID: "1", FHIRPatientID: "p1"},
+			{StudyID: "2", FHIRPatientID: "p2"},
+			{StudyID: "3", FHIRPatientID: "p1", Error: "Risk assessments did not post properly"},
+		},
+	}
+	opts, err = run.resumeOptions(false)
+	require.NoError(err)
+	assert.Equal([]string{"2"}, opts.Exclude)
+	opts, err = run.resumeOptions(true)
+	require.NoError(err)
+	assert.Equal([]string{"1", "3"}, opts.RecordIDs)
+
+	run = &RefreshRun{Status: RunSucceeded, Results: []RunResult{{StudyID: "1"}}}
+	_, err = run.resumeOptions(false)
+	assert.Equal(ErrNothingToResume, err)
+	_, err = run.resumeOptions(true)
+	assert.Equal(ErrNothingToResume, err)
+}
+
+func (suite *HistorySuite) TestInterruptedOptions() {
+	assert := suite.Assert()
+
+	// A run that stopped in time resumes the studies it didn't get to
+	run := RefreshRun{Status: RunInterrupted, Records: []string{"1", "2", "3"}, Pending: []string{"3"}, Results: []RunResult{{StudyID: "1"}, {StudyID: "2"}}}
+	assert.Equal(client.RefreshOptions{RecordIDs: []string{"3"}}, run.interruptedOptions())
+
+	// A run abandoned at the shutdown timeout resumes everything but the studies it checkpointed without errors
+	run = RefreshRun{Status: RunInterrupted, Records: []string{"1", "2", "3"}, Exclude: []string{"4"}, Results: []RunResult{
+		{StudyID: "1", FHIRPatientID: "p1"},
+		{StudyID: "2", FHIRPatientID: "p2", Error: "HTTP 500"},
+	}}
+	assert.Equal(client.RefreshOptions{RecordIDs: []string{"1", "2", "3"}, Exclude: []string{"4", "1"}}, run.interruptedOptions())
+
+	// A run abandoned before checkpointing anything resumes all of its records
+	run = RefreshRun{Status: RunInterrupted}
+	assert.Equal(client.RefreshOptions{}, run.interruptedOptions())
+}
+
+func (suite *HistorySuite) TestResumeSharedPatient() {
+	require := suite.Require()
+
+	// The interrupted run posted study 1 in project A, but not study 7 in project B, which belongs to the same patient
+	projects, fhirServer, transactions, closeServers := newSharedPatientServers(&suite.Suite)
+	defer closeServers()
+	run := &RefreshRun{
+		Status:  RunInterrupted,
+		Records: []string{"1", "7"},
+		Results: []RunResult{{StudyID: "1", Source: "A", FHIRPatientID: "p1", RiskAssessmentCount: 1}},
+	}
+	opts, err := run.resumeOptions(false)
+	require.NoError(err)
+	require.Equal([]string{"1"}, opts.Exclude)
+
+	// Resuming posts study 7 along with study 1, rather than replacing study 1's risk assessment
+	_, err = refreshRiskAssessmentsWithOptions(context.Background(), RefreshTrigger{Type: TriggerResume}, fhirServer.URL, projects, nil, "http://example.org/pies", nil, nil, opts)
+	require.NoError(err)
+	select {
+	case bundle := <-transactions:
+		assertPostedDates(&suite.Suite, bundle, "2016-01-01", "2016-02-01")
+	default:
+		require.FailNow("The resumed refresh didn't post the risk assessments")
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
+	"gopkg.in/mgo.v2"
+)
+
+// ImportRecords imports records exported from one of the REDCap projects (e.g., to a file), posting the risk
+// assessments just as a refresh pulling the records from the project would.  The other projects are queried for the
+// other studies of the imported patients, so that they keep their risk assessments from those projects.  The run is
+// recorded in the history with the import trigger, describing who or what imported the records.
+func ImportRecords(ctx context.Context, by string, fhirEndpoint string, projects []client.REDCapProject, project *client.REDCapProject, records []models.Record, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory) ([]client.Result, error) {
+	if records == nil {
+		// An export without records still imports nothing, rather than querying REDCap
+		records = []models.Record{}
+	}
+	opts := client.RefreshOptions{Records: records, Source: project.Name}
+	return refreshRiskAssessmentsWithOptions(ctx, RefreshTrigger{TriggerImport, by}, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history, opts)
+}
+
+// importFormat returns the format of the imported export: the requested format if any, or else the format matching
+// the file name's extension or the content type
+func importFormat(format, filename, contentType string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return models.FormatCSV
+	case ".json":
+		return models.FormatJSON
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return models.FormatCSV
+	case "application/json":
+		return models.FormatJSON
+	}
+	return ""
+}
+
+// RegisterImportHandler registers the handler importing a REDCap CSV or JSON export file into a project, uploaded as
+// the "file" field of a multipart form or sent as the request body.  The project is selected by the "project" query
+// parameter (its name or REDCap project ID), which may be left out if only one project is configured.  The format is
+// taken from the "format" query parameter (csv or json), or else from the file name or content type.  The response is
+// the same as for a refresh.
+func RegisterImportHandler(e *gin.Engine, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory) {
+	e.POST("/import", func(c *gin.Context) {
+		project, err := client.FindProject(projects, c.Query("project"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var r io.Reader = c.Request.Body
+		name := "request body"
+		contentType := c.Request.Header.Get("Content-Type")
+		if strings.HasPrefix(contentType, "multipart/form-data") {
+			file, header, err := c.Request.FormFile("file")
+			if err != nil {
+				c.String(http.StatusBadRequest, "The export must be uploaded as the file field")
+				return
+			}
+			defer file.Close()
+			r, name, contentType = file, header.Filename, header.Header.Get("Content-Type")
+		}
+		records, err := project.Fields.DecodeExport(r, importFormat(c.Query("format"), name, contentType))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Couldn't read the REDCap export: "+err.Error())
+			return
+		}
+
+		jobID := requestJobID(c)
+		ctx := logging.WithJobID(context.Background(), jobID)
+		results, err := ImportRecords(ctx, requestSubject(c)+" ("+name+")", fhirEndpoint, projects, project, records, pieCollection, basisPieURL, dispatcher, history)
+		respondRefresh(ctx, c, TriggerImport, jobID, results, err)
+	})
+}
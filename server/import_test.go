@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestImportSuite(t *testing.T) {
+	suite.Run(t, new(ImportSuite))
+}
+
+type ImportSuite struct {
+	suite.Suite
+	Server *httptest.Server
+}
+
+func (suite *ImportSuite) SetupTest() {
+	// Turn off debug mode since all of the logging gets in the way
+	gin.SetMode(gin.ReleaseMode)
+
+	e := gin.New()
+	projects := []client.REDCapProject{{Name: "A", Endpoint: "http://redcap-a"}, {Name: "B", Endpoint: "http://redcap-b"}}
+	RegisterImportHandler(e, "http://fhir", projects, nil, "http://example.org/pies", nil, nil)
+	suite.Server = httptest.NewServer(e)
+}
+
+func (suite *ImportSuite) TearDownTest() {
+	suite.Server.Close()
+}
+
+func (suite *ImportSuite) TestImportFormat() {
+	assert := suite.Assert()
+
+	assert.Equal(models.FormatJSON, importFormat("json", "export.csv", "text/csv"))
+	assert.Equal(models.FormatCSV, importFormat("", "Risk_DATA_2016-03-01.CSV", "application/octet-stream"))
+	assert.Equal(models.FormatJSON, importFormat("", "export.json", ""))
+	assert.Equal(models.FormatCSV, importFormat("", "request body", "text/csv; charset=utf-8"))
+	assert.Equal("", importFormat("", "export.txt", "text/plain"))
+}
+
+func (suite *ImportSuite) TestInvalidImports() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	post := func(query, contentType string, body []byte) int {
+		res, err := http.Post(suite.Server.URL+"/import"+query, contentType, bytes.NewReader(body))
+		require.NoError(err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// The project must be named since there's more than one
+	assert.Equal(http.StatusBadRequest, post("", "text/csv", []byte("study_id\n1\n")))
+	assert.Equal(http.StatusBadRequest, post("?project=C", "text/csv", []byte("study_id\n1\n")))
+	// The format can't be determined
+	assert.Equal(http.StatusBadRequest, post("?project=A", "text/plain", []byte("study_id\n1\n")))
+	// The export can't be parsed
+	assert.Equal(http.StatusBadRequest, post("?project=A", "application/json", []byte("study_id\n1\n")))
+
+	// The multipart form must have a file field
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	require.NoError(w.WriteField("notes", "March export"))
+	require.NoError(w.Close())
+	assert.Equal(http.StatusBadRequest, post("?project=A", w.FormDataContentType(), body.Bytes()))
+
+	// The uploaded file's format comes from its name
+	body.Reset()
+	w = multipart.NewWriter(&body)
+	f, err := w.CreateFormFile("file", "export.csv")
+	require.NoError(err)
+	_, err = f.Write([]byte(`[{"study_id": "1"}]`))
+	require.NoError(err)
+	require.NoError(w.Close())
+	assert.Equal(http.StatusBadRequest, post("?project=B", w.FormDataContentType(), body.Bytes()))
+}
+
+func (suite *ImportSuite) TestSharedPatient() {
+	require := suite.Require()
+
+	projects, fhirServer, transactions, closeServers := newSharedPatientServers(&suite.Suite)
+	defer closeServers()
+	e := gin.New()
+	RegisterImportHandler(e, fhirServer.URL, projects, nil, "http://example.org/pies", nil, nil)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	export := "study_id,redcap_event_name,rf_date,rf_cmc_risk_cat,rf_func_risk_cat,rf_sb_risk_cat,rf_util_risk_cat,rf_risk_predicted,risk_factors_complete\n" +
+		"1,visit1_arm_1,2016-03-01,1,1,1,1,1,2\n"
+	res, err := http.Post(server.URL+"/import?project=A", "text/csv", strings.NewReader(export))
+	require.NoError(err)
+	res.Body.Close()
+
+	// Replacing the patient's risk assessments keeps the one from project B
+	select {
+	case bundle := <-transactions:
+		assertPostedDates(&suite.Suite, bundle, "2016-02-01", "2016-03-01")
+	default:
+		require.FailNow("The import didn't post the risk assessments")
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultLeaseTTL is how long a lease is held without a heartbeat before another instance may take it over
+const DefaultLeaseTTL = 2 * time.Minute
+
+// RefreshLease ensures only one refresh runs at a time.  By default it only covers this process; main replaces it
+// with a lease stored in Mongo so that it covers every replica.
+var RefreshLease = NewLease(nil, "refresh", DefaultLeaseTTL)
+
+// LeaseHeldError is returned when trying to acquire a lease held by another job
+type LeaseHeldError struct {
+	Name    string
+	JobID   string
+	Owner   string
+	Expires time.Time
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("The %s lease is held by job %s on %s", e.Name, e.JobID, e.Owner)
+}
+
+// lease is the lease document stored in Mongo
+type lease struct {
+	Name     string    `bson:"_id"`
+	Owner    string    `bson:"owner"`
+	JobID    string    `bson:"jobID"`
+	Acquired time.Time `bson:"acquired"`
+	Expires  time.Time `bson:"expires"`
+}
+
+// Lease is a lock held by one job at a time.  If Leases is set, the lease is stored in Mongo so that it is shared by
+// every instance of the service: the holder renews it with heartbeats, and if the holder dies, the lease expires
+// after the TTL so another instance can take it over.  Instances' clocks are assumed to be roughly synchronized.
+type Lease struct {
+	Leases *mgo.Collection
+	Name   string
+	// Owner identifies this instance in the lease (default: the hostname and process ID)
+	Owner string
+	TTL   time.Duration
+	// Heartbeat is how often the holder renews the lease (default: a third of the TTL)
+	Heartbeat time.Duration
+	jobID     string
+	mutex     sync.Mutex
+}
+
+// NewLease creates a lease with the given name.  If leases is nil, the lease only covers this process.
+func NewLease(leases *mgo.Collection, name string, ttl time.Duration) *Lease {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &Lease{
+		Leases:    leases,
+		Name:      name,
+		Owner:     fmt.Sprintf("%s:%d", host, os.Getpid()),
+		TTL:       ttl,
+		Heartbeat: ttl / 3,
+	}
+}
+
+// Acquire acquires the lease for the refresh job ID in the context, returning a *LeaseHeldError if another job holds
+// it.  The returned context is cancelled if the lease is lost (e.g., because heartbeats failed for longer than the
+// TTL and another instance took it over), and the returned function releases the lease.
+func (l *Lease) Acquire(ctx context.Context) (context.Context, func(), error) {
+	jobID := logging.JobID(ctx)
+	l.mutex.Lock()
+	if l.jobID != "" {
+		err := &LeaseHeldError{Name: l.Name, JobID: l.jobID, Owner: l.Owner}
+		l.mutex.Unlock()
+		return ctx, nil, err
+	}
+	l.jobID = jobID
+	l.mutex.Unlock()
+
+	clear := func() {
+		l.mutex.Lock()
+		l.jobID = ""
+		l.mutex.Unlock()
+	}
+	if l.Leases == nil {
+		return ctx, clear, nil
+	}
+
+	if err := l.acquire(jobID); err != nil {
+		clear()
+		return ctx, nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go l.heartbeat(ctx, jobID, cancel, stop, done)
+	return ctx, func() {
+		close(stop)
+		<-done
+		cancel()
+		if err := l.Leases.Remove(bson.M{"_id": l.Name, "owner": l.Owner, "jobID": jobID}); err != nil && err != mgo.ErrNotFound {
+			slog.ErrorContext(ctx, "Couldn't release lease", "lease", l.Name, "error", err)
+		}
+		clear()
+	}, nil
+}
+
+// acquire inserts the lease document, or takes over an expired one
+func (l *Lease) acquire(jobID string) error {
+	now := time.Now().UTC()
+	doc := lease{Name: l.Name, Owner: l.Owner, JobID: jobID, Acquired: now, Expires: now.Add(l.TTL)}
+	err := l.Leases.Insert(&doc)
+	if err == nil || !mgo.IsDup(err) {
+		return err
+	}
+
+	err = l.Leases.Update(bson.M{"_id": l.Name, "expires": bson.M{"$lt": now}}, &doc)
+	if err != mgo.ErrNotFound {
+		return err
+	}
+	var held lease
+	if err := l.Leases.FindId(l.Name).One(&held); err == mgo.ErrNotFound {
+		// The holder released the lease in the meantime, so try again
+		return l.acquire(jobID)
+	} else if err != nil {
+		return err
+	}
+	return &LeaseHeldError{Name: l.Name, JobID: held.JobID, Owner: held.Owner, Expires: held.Expires}
+}
+
+// heartbeat renews the lease until stopped, cancelling the job's context if the lease was lost
+func (l *Lease) heartbeat(ctx context.Context, jobID string, cancel func(), stop, done chan struct{}) {
+	defer close(done)
+	interval := l.Heartbeat
+	if interval <= 0 {
+		interval = l.TTL / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			expires := time.Now().UTC().Add(l.TTL)
+			err := l.Leases.Update(bson.M{"_id": l.Name, "owner": l.Owner, "jobID": jobID}, bson.M{"$set": bson.M{"expires": expires}})
+			if err == mgo.ErrNotFound {
+				slog.ErrorContext(ctx, "Lost lease, cancelling the job", "lease", l.Name)
+				cancel()
+				return
+			} else if err != nil {
+				slog.WarnContext(ctx, "Couldn't renew lease", "lease", l.Name, "error", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestLeaseSuite(t *testing.T) {
+	suite.Run(t, new(LeaseSuite))
+}
+
+type LeaseSuite struct {
+	suite.Suite
+	RefreshLease *Lease
+}
+
+func (suite *LeaseSuite) SetupTest() {
+	// Turn off debug mode since all of the logging gets in the way
+	gin.SetMode(gin.ReleaseMode)
+
+	suite.RefreshLease = RefreshLease
+	RefreshLease = NewLease(nil, "refresh", DefaultLeaseTTL)
+}
+
+func (suite *LeaseSuite) TearDownTest() {
+	RefreshLease = suite.RefreshLease
+}
+
+func (suite *LeaseSuite) TestLocalLease() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	l := NewLease(nil, "test", DefaultLeaseTTL)
+	ctx, release, err := l.Acquire(logging.WithJobID(context.Background(), "job1"))
+	require.NoError(err)
+	assert.Equal("job1", logging.JobID(ctx))
+
+	_, _, err = l.Acquire(logging.WithJobID(context.Background(), "job2"))
+	require.IsType(&LeaseHeldError{}, err)
+	assert.Equal("job1", err.(*LeaseHeldError).JobID)
+	assert.Equal(l.Owner, err.(*LeaseHeldError).Owner)
+
+	release()
+	_, release, err = l.Acquire(logging.WithJobID(context.Background(), "job2"))
+	require.NoError(err)
+	release()
+}
+
+func (suite *LeaseSuite) TestRefreshConflict() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	_, release, err := RefreshLease.Acquire(logging.WithJobID(context.Background(), "running"))
+	require.NoError(err)
+	defer release()
+
+	e := gin.New()
+	RegisterRefreshHandler(e, "http://fhir", []client.REDCapProject{{Endpoint: "http://redcap", Token: "123abc"}}, nil, "http://example.org/pies", nil, nil)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/refresh", "application/json", nil)
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusConflict, res.StatusCode)
+	var body struct {
+		JobID string `json:"jobID"`
+	}
+	require.NoError(json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal("running", body.JobID)
+}
+
+func (suite *LeaseSuite) TestScheduledRefreshSkipped() {
+	require := suite.Require()
+
+	_, release, err := RefreshLease.Acquire(logging.WithJobID(context.Background(), "running"))
+	require.NoError(err)
+	defer release()
+
+	job := NewRefreshJob("http://fhir", []client.REDCapProject{{Endpoint: "http://redcap", Token: "123abc"}}, nil, "http://example.org/pies", nil, nil)
+	scheduler, err := NewScheduler(nil, "@every 1h", job)
+	require.NoError(err)
+	scheduler.run("@every 1h")
+	status := scheduler.Status()
+	require.NotNil(status.LastRun)
+	suite.Equal(RunSkipped, status.LastRun.Status)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/metrics"
+)
+
+var (
+	refreshDuration = metrics.NewHistogramVec("riskservice_refresh_duration_seconds",
+		"Duration of risk assessment refreshes, by result.", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}, "result")
+	cronLastRun = metrics.NewGaugeVec("riskservice_cron_last_run_timestamp_seconds",
+		"Unix time the scheduled refresh last ran.")
+	httpRequests = metrics.NewCounterVec("riskservice_http_requests_total",
+		"HTTP requests for pies, by method and status code.", "route", "method", "code")
+)
+
+// RegisterMetricsHandler registers the handler exposing the metrics in the Prometheus text format (GET /metrics)
+func RegisterMetricsHandler(e *gin.Engine) {
+	e.GET("/metrics", func(c *gin.Context) {
+		c.Header("Content-Type", metrics.ContentType)
+		c.Status(http.StatusOK)
+		metrics.DefaultRegistry.WritePrometheus(c.Writer)
+	})
+}
+
+// requestMetrics is Gin middleware counting the requests for pies
+func requestMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if strings.HasPrefix(c.Request.URL.Path, "/pies/") {
+			httpRequests.Inc("/pies/:id", c.Request.Method, strconv.Itoa(c.Writer.Status()))
+		}
+	}
+}
+
+// observeRefresh records the duration of a refresh started at the given time
+func observeRefresh(start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	refreshDuration.Observe(time.Since(start).Seconds(), result)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/metrics"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestMetricsHandlerSuite(t *testing.T) {
+	suite.Run(t, new(MetricsHandlerSuite))
+}
+
+type MetricsHandlerSuite struct {
+	suite.Suite
+}
+
+func (suite *MetricsHandlerSuite) TestMetrics() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	gin.SetMode(gin.ReleaseMode)
+	e := gin.New()
+	e.Use(requestMetrics())
+	RegisterMetricsHandler(e)
+	e.GET("/pies/:id", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	before := httpRequests.Value("/pies/:id", "GET", "404")
+	res, err := http.Get(server.URL + "/pies/123")
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(before+1, httpRequests.Value("/pies/:id", "GET", "404"))
+
+	res, err = http.Get(server.URL + "/metrics")
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal(metrics.ContentType, res.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	for _, name := range []string{
+		"riskservice_refresh_duration_seconds",
+		"riskservice_cron_last_run_timestamp_seconds",
+		"riskservice_http_requests_total",
+		"riskservice_redcap_request_duration_seconds",
+		"riskservice_fhir_request_errors_total",
+		"riskservice_patient_match_failures_total",
+		"riskservice_risk_assessments_posted_total",
+		"riskservice_pies_stored_total",
+		"riskservice_studies_processed_total",
+	} {
+		assert.Contains(string(body), "# TYPE "+name+" ")
+	}
+	assert.Contains(string(body), `riskservice_http_requests_total{route="/pies/:id",method="GET",code="404"}`)
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
+	"github.com/intervention-engine/riskservice/plugin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RefreshCompletedEvent is the data sent with a refresh.completed webhook event
+type RefreshCompletedEvent struct {
+	Patients        int             `json:"patients"`
+	Errors          int             `json:"errors"`
+	RiskAssessments int             `json:"riskAssessments"`
+	Error           string          `json:"error,omitempty"`
+	Results         []client.Result `json:"results,omitempty"`
+}
+
+// RiskChangedEvent is the data sent with a risk.changed webhook event
+type RiskChangedEvent struct {
+	Patient       string `json:"patient"`
+	PreviousPie   string `json:"previousPie,omitempty"`
+	PreviousScore *int   `json:"previousScore,omitempty"`
+	Pie           string `json:"pie"`
+	Score         int    `json:"score"`
+}
+
+// refreshRiskAssessments refreshes the risk assessments from REDCap, records the run in the refresh history, and
+// publishes the resulting webhook events.  If any records are passed in, only those REDCap records are refreshed.  The
+// context carries the refresh job ID.  If another refresh holds the refresh lease, a *LeaseHeldError is returned
+// without refreshing anything.  If the service shuts down during the refresh, it stops after the study being processed
+// and returns a *client.InterruptedError, recording the studies it didn't get to in the history so that they are
+// refreshed when the service restarts.
+func refreshRiskAssessments(ctx context.Context, trigger RefreshTrigger, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory, recordIDs ...string) ([]client.Result, error) {
+	return refreshRiskAssessmentsWithOptions(ctx, trigger, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history, client.RefreshOptions{RecordIDs: recordIDs})
+}
+
+// RefreshFromCommand refreshes the risk assessments like a refresh requested through the API, recording the run in the
+// history with the command trigger, describing who ran the command.  If any records are passed in, only those REDCap
+// records are refreshed.
+func RefreshFromCommand(ctx context.Context, by string, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory, recordIDs ...string) ([]client.Result, error) {
+	return refreshRiskAssessments(ctx, RefreshTrigger{TriggerCommand, by}, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history, recordIDs...)
+}
+
+// refreshRiskAssessmentsWithOptions refreshes the risk assessments like refreshRiskAssessments, using the options to
+// limit the studies refreshed.  The results are checkpointed in the history as each study is processed, so that the
+// run can be resumed from where it stopped.
+func refreshRiskAssessmentsWithOptions(ctx context.Context, trigger RefreshTrigger, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory, opts client.RefreshOptions) ([]client.Result, error) {
+	ctx, done, err := trackRefresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, release, err := RefreshLease.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// A refresh limited to a few records only needs the pies of their patients, not of every patient
+	var before map[string]latestPie
+	var patients []string
+	studyIDs := refreshedStudyIDs(opts)
+	if dispatcher != nil {
+		var err error
+		if studyIDs != nil {
+			patients, err = findStudyPatients(pieCollection, studyIDs)
+		}
+		if err == nil {
+			before, err = getLatestPies(pieCollection, patientSelector(studyIDs != nil, patients))
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't get latest pies before refresh", "error", err)
+		}
+	}
+
+	run, hErr := history.Start(ctx, trigger, projects, opts.RecordIDs, opts.Exclude)
+	if hErr != nil {
+		slog.ErrorContext(ctx, "Couldn't record refresh start in the history", "error", hErr)
+	} else {
+		trackRun(ctx, history, run)
+	}
+	opts.Checkpoint = func(results []client.Result) {
+		if hErr := history.Checkpoint(run, results); hErr != nil {
+			slog.ErrorContext(ctx, "Couldn't checkpoint refresh progress in the history", "error", hErr)
+		}
+	}
+	partial := len(opts.RecordIDs) > 0 || len(opts.Exclude) > 0 || opts.Records != nil || opts.Source != ""
+	start := time.Now()
+	results, err := client.RefreshRiskAssessmentsWithOptions(ctx, fhirEndpoint, projects, pieCollection, basisPieURL, opts)
+	observeRefresh(start, err)
+	if err == nil {
+		lastValidationReport.Update(results, !partial)
+	}
+	event := summarizeRefresh(results, err)
+	lastRefresh.Update(event, partial)
+	if hErr := history.Finish(run, results, err); hErr != nil {
+		slog.ErrorContext(ctx, "Couldn't record refresh outcome in the history", "error", hErr)
+	}
+	if dispatcher == nil {
+		return results, err
+	}
+
+	// Publish the changes for the studies refreshed before an interruption, since they won't change again on resuming
+	if _, interrupted := err.(*client.InterruptedError); (err == nil || interrupted) && before != nil {
+		if studyIDs != nil {
+			patients = append(patients, refreshedPatients(fhirEndpoint, results)...)
+		}
+		publishRiskChanges(ctx, before, pieCollection, patientSelector(studyIDs != nil, patients), basisPieURL, dispatcher)
+	}
+	event.Results = results
+	if pErr := dispatcher.Publish(webhook.RefreshCompleted, &event); pErr != nil {
+		slog.ErrorContext(ctx, "Couldn't publish refresh webhook event", "error", pErr)
+	}
+
+	return results, err
+}
+
+// summarizeRefresh counts the patients, errors, and risk assessments in the refresh results
+func summarizeRefresh(results []client.Result, err error) RefreshCompletedEvent {
+	var event RefreshCompletedEvent
+	if err != nil {
+		event.Error = err.Error()
+	}
+	for _, result := range results {
+		if result.Error != nil {
+			event.Errors++
+		}
+		event.RiskAssessments += result.RiskAssessmentCount
+	}
+	event.Patients = len(results)
+	return event
+}
+
+// refreshedStudyIDs returns the IDs of the studies a refresh is limited to by its record IDs or imported records, or nil
+// if the refresh isn't limited to particular studies
+func refreshedStudyIDs(opts client.RefreshOptions) []string {
+	if len(opts.RecordIDs) > 0 {
+		return opts.RecordIDs
+	}
+	if opts.Records == nil {
+		return nil
+	}
+	ids := []string{}
+	seen := make(map[string]bool)
+	for i := range opts.Records {
+		if id := opts.Records[i].StudyIDString(); !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// findStudyPatients returns the URLs of the patients that have pies from the given studies
+func findStudyPatients(pieCollection *mgo.Collection, studyIDs []string) ([]string, error) {
+	var patients []string
+	err := pieCollection.Find(bson.M{"studyID": bson.M{"$in": studyIDs}}).Distinct("patient", &patients)
+	return patients, err
+}
+
+// refreshedPatients returns the URLs of the patients the refresh results were posted for
+func refreshedPatients(fhirEndpoint string, results []client.Result) []string {
+	var patients []string
+	for i := range results {
+		if results[i].FHIRPatientID != "" {
+			patients = append(patients, fhirEndpoint+"/Patient/"+results[i].FHIRPatientID)
+		}
+	}
+	return patients
+}
+
+// patientSelector returns the pie selector limiting pies to the given patients, if limited, or nil to select the pies
+// of every patient
+func patientSelector(limited bool, patients []string) bson.M {
+	if !limited {
+		return nil
+	}
+	if patients == nil {
+		patients = []string{}
+	}
+	return bson.M{"patient": bson.M{"$in": patients}}
+}
+
+// publishRiskChanges publishes a risk change event for each patient whose latest pie, among the pies matching the
+// selector, differs from the one before the refresh
+func publishRiskChanges(ctx context.Context, before map[string]latestPie, pieCollection *mgo.Collection, sel bson.M, basisPieURL string, dispatcher *webhook.Dispatcher) {
+	after, err := getLatestPies(pieCollection, sel)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't get latest pies after refresh", "error", err)
+		return
+	}
+	// Use the same pie URLs that are referenced as the basis in the posted risk assessments
+	pieURL := basisPieURL + "/"
+	for patient, current := range after {
+		event := RiskChangedEvent{
+			Patient: patient,
+			Pie:     pieURL + current.ID.Hex(),
+			Score:   current.Score(),
+		}
+		if previous, ok := before[patient]; ok {
+			if previous.sameSlices(current) {
+				continue
+			}
+			score := previous.Score()
+			event.PreviousScore = &score
+			event.PreviousPie = pieURL + previous.ID.Hex()
+		}
+		if err := dispatcher.Publish(webhook.RiskChanged, &event); err != nil {
+			slog.ErrorContext(ctx, "Couldn't publish risk change webhook event", "patient", patient, "error", err)
+		}
+	}
+}
+
+// latestPie represents the most recent pie stored for a patient
+type latestPie struct {
+	Patient string         `bson:"_id"`
+	ID      bson.ObjectId  `bson:"pie"`
+	Slices  []plugin.Slice `bson:"slices"`
+}
+
+// Score returns the overall score for the pie, which is the highest slice value
+func (p *latestPie) Score() int {
+	var score int
+	for i := range p.Slices {
+		if p.Slices[i].Value > score {
+			score = p.Slices[i].Value
+		}
+	}
+	return score
+}
+
+func (p *latestPie) sameSlices(other latestPie) bool {
+	if len(p.Slices) != len(other.Slices) {
+		return false
+	}
+	for i := range p.Slices {
+		if p.Slices[i] != other.Slices[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getLatestPies returns the most recent multi-factor pie for each patient among the pies matching the selector, if not
+// nil, indexed by patient URL
+func getLatestPies(pieCollection *mgo.Collection, sel bson.M) (map[string]latestPie, error) {
+	pies, err := findLatestPies(pieCollection, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]latestPie, len(pies))
+	for _, pie := range pies {
+		m[pie.Patient] = pie
+	}
+	return m, nil
+}
+
+// findLatestPies returns the most recent multi-factor pie for each patient among the pies matching the selector, if
+// not nil.  Pies aren't necessarily inserted in order of their assessment date (they're created in REDCap record and
+// project order), so they're sorted by assessment date, using the insertion order to break ties.
+func findLatestPies(pieCollection *mgo.Collection, sel bson.M) ([]latestPie, error) {
+	method := client.REDCapRiskServiceConfig.Method.Coding[0]
+	match := bson.M{"method.coding": bson.M{"$elemMatch": bson.M{"system": method.System, "code": method.Code}}}
+	for k, v := range sel {
+		match[k] = v
+	}
+	var pies []latestPie
+	err := pieCollection.Pipe([]bson.M{
+		{"$match": match},
+		{"$sort": bson.D{{Name: "asOf", Value: 1}, {Name: "_id", Value: 1}}},
+		{"$group": bson.M{
+			"_id":    "$patient",
+			"pie":    bson.M{"$last": "$_id"},
+			"slices": bson.M{"$last": "$slices"},
+		}},
+	}).All(&pies)
+	return pies, err
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DistributionQuery filters the pies counted in the risk distribution report.  Zero values don't filter.
+type DistributionQuery struct {
+	// AsOf limits the pies to those for assessments on or before the time, so that the report shows the distribution
+	// as it was at the time
+	AsOf time.Time
+	// Events and Sources limit the pies to those from one of the given REDCap events and source projects
+	Events  []string
+	Sources []string
+}
+
+// ParseDistributionQuery parses the report filters from the query parameters: asOf (an RFC 3339 time, or a date,
+// which includes the whole day), and event and source (comma-separated)
+func ParseDistributionQuery(params map[string][]string) (DistributionQuery, error) {
+	get := func(key string) string {
+		if values := params[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+	var q DistributionQuery
+	if asOf := get("asOf"); asOf != "" {
+		var err error
+		if q.AsOf, err = parseHistoryTime(asOf, true); err != nil {
+			return q, err
+		}
+	}
+	q.Events = splitList(get("event"))
+	q.Sources = splitList(get("source"))
+	return q, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// selector returns the Mongo selector for the pies matching the query.  Pies stored before their assessment date,
+// event, and source were recorded only match a query without filters.
+func (q *DistributionQuery) selector() bson.M {
+	sel := bson.M{}
+	if !q.AsOf.IsZero() {
+		sel["asOf"] = bson.M{"$lte": q.AsOf}
+	}
+	if len(q.Events) > 0 {
+		sel["event"] = bson.M{"$in": q.Events}
+	}
+	if len(q.Sources) > 0 {
+		sel["source"] = bson.M{"$in": q.Sources}
+	}
+	return sel
+}
+
+// DistributionReport counts the patients by the categories of their latest pie: the overall category (the highest
+// slice value) and the category of each domain (slice).  Categories are keyed by their value.
+type DistributionReport struct {
+	AsOf     *time.Time                `json:"asOf,omitempty"`
+	Events   []string                  `json:"events,omitempty"`
+	Sources  []string                  `json:"sources,omitempty"`
+	Patients int                       `json:"patients"`
+	Overall  map[string]int            `json:"overall"`
+	Domains  map[string]map[string]int `json:"domains"`
+}
+
+// GetDistributionReport builds the risk distribution report from the latest pie for each patient matching the query
+func GetDistributionReport(pieCollection *mgo.Collection, q DistributionQuery) (*DistributionReport, error) {
+	pies, err := findLatestPies(pieCollection, q.selector())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DistributionReport{
+		Events:   q.Events,
+		Sources:  q.Sources,
+		Patients: len(pies),
+		Overall:  make(map[string]int),
+		Domains:  make(map[string]map[string]int),
+	}
+	if !q.AsOf.IsZero() {
+		report.AsOf = &q.AsOf
+	}
+	for i := range pies {
+		report.Overall[strconv.Itoa(pies[i].Score())]++
+		for _, slice := range pies[i].Slices {
+			domain, ok := report.Domains[slice.Name]
+			if !ok {
+				domain = make(map[string]int)
+				report.Domains[slice.Name] = domain
+			}
+			domain[strconv.Itoa(slice.Value)]++
+		}
+	}
+	return report, nil
+}
+
+// RegisterReportHandlers registers the handler returning the risk distribution report
+func RegisterReportHandlers(e *gin.Engine, pieCollection *mgo.Collection) {
+	e.GET("/reports/distribution", func(c *gin.Context) {
+		q, err := ParseDistributionQuery(c.Request.URL.Query())
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		report, err := GetDistributionReport(pieCollection, q)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+}
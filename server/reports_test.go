@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestReportsSuite(t *testing.T) {
+	suite.Run(t, new(ReportsSuite))
+}
+
+type ReportsSuite struct {
+	suite.Suite
+}
+
+func (suite *ReportsSuite) TestParseDistributionQuery() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	q, err := ParseDistributionQuery(url.Values{})
+	require.NoError(err)
+	assert.Equal(DistributionQuery{}, q)
+	assert.Equal(bson.M{}, q.selector())
+
+	q, err = ParseDistributionQuery(url.Values{
+		"asOf":   {"2016-03-31"},
+		"event":  {"initial_arm_1, visit1_arm_1"},
+		"source": {"Clinic A"},
+	})
+	require.NoError(err)
+	assert.Equal(time.Date(2016, 3, 31, 23, 59, 59, 999999999, time.UTC), q.AsOf)
+	assert.Equal([]string{"initial_arm_1", "visit1_arm_1"}, q.Events)
+	assert.Equal([]string{"Clinic A"}, q.Sources)
+	assert.Equal(bson.M{
+		"asOf":   bson.M{"$lte": q.AsOf},
+		"event":  bson.M{"$in": q.Events},
+		"source": bson.M{"$in": q.Sources},
+	}, q.selector())
+
+	_, err = ParseDistributionQuery(url.Values{"asOf": {"last month"}})
+	assert.Error(err)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNothingToResume is returned when resuming a run that has no unprocessed or failed studies left
+var ErrNothingToResume = errors.New("The run has no unprocessed or failed studies to refresh")
+
+// ErrImportNotResumable is returned when resuming an import, since the imported file isn't kept
+var ErrImportNotResumable = errors.New("Imports can't be resumed, so the file must be imported again")
+
+// resumeOptions returns the options to resume the run from its checkpointed results.  The resumed refresh covers the
+// same records as the run, leaving out the studies the run (or the runs it resumed) processed without errors.  If
+// failedOnly is true, only the studies whose results had errors are refreshed instead.  Since posting replaces all of a
+// patient's risk assessments, patients are resumed rather than studies: every study of a patient with a failed study
+// is refreshed again, and the refresh finds the other studies of the patients of the studies it didn't get to.
+func (run *RefreshRun) resumeOptions(failedOnly bool) (client.RefreshOptions, error) {
+	if run.Trigger.Type == TriggerImport {
+		return client.RefreshOptions{}, ErrImportNotResumable
+	}
+	succeeded, failed := run.processedStudies()
+	if failedOnly {
+		if len(failed) == 0 {
+			return client.RefreshOptions{}, ErrNothingToResume
+		}
+		return client.RefreshOptions{RecordIDs: failed}, nil
+	}
+	if run.Status == RunSucceeded {
+		return client.RefreshOptions{}, ErrNothingToResume
+	}
+	exclude := append(append([]string{}, run.Exclude...), succeeded...)
+	return client.RefreshOptions{RecordIDs: run.Records, Exclude: exclude}, nil
+}
+
+// interruptedOptions returns the options to resume a run interrupted by a shutdown.  A run that stopped in time lists
+// the studies it didn't get to; other runs (e.g., those still running at the shutdown timeout) are resumed from their
+// checkpointed results.
+func (run *RefreshRun) interruptedOptions() client.RefreshOptions {
+	if len(run.Pending) > 0 {
+		return client.RefreshOptions{RecordIDs: run.Pending}
+	}
+	var exclude []string
+	succeeded, _ := run.processedStudies()
+	exclude = append(append(exclude, run.Exclude...), succeeded...)
+	return client.RefreshOptions{RecordIDs: run.Records, Exclude: exclude}
+}
+
+// processedStudies splits the studies in the run's checkpointed results into those that succeeded and those that
+// failed.  Since posting replaces all of a patient's risk assessments, every study of a patient with a failed study
+// counts as failed.
+func (run *RefreshRun) processedStudies() (succeeded, failed []string) {
+	failedPatients := make(map[string]bool)
+	for _, r := range run.Results {
+		if r.Error != "" && r.FHIRPatientID != "" {
+			failedPatients[r.FHIRPatientID] = true
+		}
+	}
+	for _, r := range run.Results {
+		if r.Error != "" || failedPatients[r.FHIRPatientID] {
+			failed = append(failed, r.StudyID)
+		} else {
+			succeeded = append(succeeded, r.StudyID)
+		}
+	}
+	return succeeded, failed
+}
+
+// RegisterResumeHandler registers the handler to resume a refresh job from its checkpointed progress, refreshing the
+// studies it didn't get to or that failed.  With the "only=failed" query parameter, only the studies that failed are
+// refreshed.  The job is marked as resumed by the new job, which is recorded in the history with the resume trigger.
+func RegisterResumeHandler(e *gin.Engine, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory) {
+	e.POST("/refresh/jobs/:id/resume", func(c *gin.Context) {
+		var failedOnly bool
+		switch only := c.Query("only"); only {
+		case "":
+		case "failed":
+			failedOnly = true
+		default:
+			c.String(http.StatusBadRequest, fmt.Sprintf("Invalid only %s (must be failed)", only))
+			return
+		}
+		run, err := history.GetByJobID(c.Param("id"))
+		if err == mgo.ErrNotFound {
+			c.Status(http.StatusNotFound)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		opts, err := run.resumeOptions(failedOnly)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		jobID := requestJobID(c)
+		ctx := logging.WithJobID(context.Background(), jobID)
+		if err := history.Runs.UpdateId(run.ID, bson.M{"$set": bson.M{"resumedBy": jobID}}); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		trigger := RefreshTrigger{TriggerResume, "run " + run.ID.Hex()}
+		if failedOnly {
+			trigger.By += " (failed studies)"
+		}
+		results, err := refreshRiskAssessmentsWithOptions(ctx, trigger, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history, opts)
+		if _, ok := err.(*LeaseHeldError); ok || err == ErrShuttingDown {
+			// The job wasn't resumed, so leave it to be resumed later
+			if uErr := history.Runs.UpdateId(run.ID, bson.M{"$unset": bson.M{"resumedBy": ""}}); uErr != nil {
+				slog.ErrorContext(ctx, "Couldn't release resumed refresh", "run", run.ID.Hex(), "error", uErr)
+			}
+		}
+		respondRefresh(ctx, c, TriggerResume, jobID, results, err)
+	})
+}
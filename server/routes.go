@@ -1,19 +1,44 @@
 package server
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
 	"github.com/intervention-engine/riskservice/plugin"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-// RegisterRoutes sets up the http request handlers with Gin
-func RegisterRoutes(e *gin.Engine, fhirEndpoint, redcapEndpoint, redcapToken string, pieCollection *mgo.Collection, basisPieURL string) {
+// RegisterRoutes sets up the http request handlers with Gin.  If the dispatcher is nil, webhooks are disabled.  If the
+// history is nil, refreshes aren't recorded, and neither the refresh history nor resuming refreshes is available.  If the
+// authenticator is not nil, requests to these routes and any registered afterwards must present credentials granting
+// the scope they require.
+func RegisterRoutes(e *gin.Engine, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory, authenticator *Authenticator) {
+	e.Use(requestMetrics())
+	if authenticator != nil {
+		e.Use(authenticator.Middleware())
+	}
+	RegisterHealthHandlers(e, fhirEndpoint, projects, pieCollection)
+	RegisterMetricsHandler(e)
 	RegisterPieHandler(e, pieCollection)
-	RegisterRefreshHandler(e, fhirEndpoint, redcapEndpoint, redcapToken, pieCollection, basisPieURL)
+	RegisterValidationReportHandler(e)
+	RegisterReportHandlers(e, pieCollection)
+	RegisterExportHandler(e, fhirEndpoint, pieCollection)
+	RegisterRefreshHandler(e, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history)
+	RegisterImportHandler(e, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history)
+	if history != nil {
+		RegisterHistoryHandlers(e, history)
+		RegisterResumeHandler(e, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history)
+	}
+	RegisterAdminHandlers(e, projects)
+	if dispatcher != nil {
+		RegisterWebhookHandlers(e, dispatcher)
+	}
 }
 
 // RegisterPieHandler registers the handler to return pies from the database
@@ -35,15 +60,63 @@ func RegisterPieHandler(e *gin.Engine, pieCollection *mgo.Collection) {
 	})
 }
 
-// RegisterRefreshHandler registers the handler to refresh risk assessments from REDCap
-func RegisterRefreshHandler(e *gin.Engine, fhirEndpoint, redcapEndpoint, redcapToken string, pieCollection *mgo.Collection, basisPieURL string) {
+// PurgePies removes every pie stored by a refresh for the given FHIR patients, returning the number of pies removed.
+// The patients' risk assessments on the FHIR server are left alone, so their pie links are broken until the patients
+// are refreshed again.
+func PurgePies(fhirEndpoint string, pieCollection *mgo.Collection, patientIDs []string) (int, error) {
+	urls := make([]string, len(patientIDs))
+	for i, id := range patientIDs {
+		urls[i] = fhirEndpoint + "/Patient/" + id
+	}
+	method := client.REDCapRiskServiceConfig.Method.Coding[0]
+	info, err := pieCollection.RemoveAll(bson.M{
+		"patient":       bson.M{"$in": urls},
+		"method.coding": bson.M{"$elemMatch": bson.M{"system": method.System, "code": method.Code}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// RegisterRefreshHandler registers the handler to refresh risk assessments from REDCap.  The refresh job ID is taken
+// from the request's correlation ID header if present, and is returned in the response's correlation ID header.  The
+// run is recorded in the history, if not nil, as triggered by the authenticated subject or else the client's IP.  If a
+// refresh is already running on any instance, the request is rejected with the running job's ID.
+func RegisterRefreshHandler(e *gin.Engine, fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory) {
 	e.POST("/refresh", func(c *gin.Context) {
-		results, err := client.RefreshRiskAssessments(fhirEndpoint, redcapEndpoint, redcapToken, pieCollection, basisPieURL)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
-		client.LogResultSummary(results)
-		c.JSON(http.StatusOK, results)
+		jobID := requestJobID(c)
+		ctx := logging.WithJobID(context.Background(), jobID)
+		results, err := refreshRiskAssessments(ctx, RefreshTrigger{TriggerAPI, requestSubject(c)}, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history)
+		respondRefresh(ctx, c, TriggerAPI, jobID, results, err)
 	})
 }
+
+// requestJobID returns the refresh job ID from the request's correlation ID header, or a new job ID if the header is
+// missing, and returns it in the response's correlation ID header
+func requestJobID(c *gin.Context) string {
+	jobID := c.Request.Header.Get(logging.CorrelationIDHeader)
+	if jobID == "" {
+		jobID = logging.NewJobID()
+	}
+	c.Header(logging.CorrelationIDHeader, jobID)
+	return jobID
+}
+
+// respondRefresh responds with the results of a refresh requested through the API, or the reason it didn't finish
+func respondRefresh(ctx context.Context, c *gin.Context, trigger, jobID string, results []client.Result, err error) {
+	if held, ok := err.(*LeaseHeldError); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "A refresh is already running", "jobID": held.JobID})
+		return
+	} else if _, ok := err.(*client.InterruptedError); ok || err == ErrShuttingDown {
+		slog.WarnContext(ctx, "Refresh stopped for shutdown", "trigger", trigger, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "jobID": jobID})
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Couldn't refresh risk assessments", "trigger", trigger, "error", err)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	client.LogResultSummary(ctx, results)
+	c.JSON(http.StatusOK, results)
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,17 +10,22 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
 	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mgo.v2/dbtest"
 
 	"github.com/gin-gonic/gin"
+	fhir "github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/fhir/server"
 	"github.com/intervention-engine/riskservice/plugin"
 	"github.com/stretchr/testify/suite"
@@ -40,6 +47,8 @@ type RoutesSuite struct {
 	FHIRServer   *httptest.Server
 	REDCapServer *httptest.Server
 	Studies      models.StudyMap
+	Dispatcher   *webhook.Dispatcher
+	History      *RefreshHistory
 }
 
 func (suite *RoutesSuite) SetupSuite() {
@@ -57,11 +66,15 @@ func (suite *RoutesSuite) SetupSuite() {
 	suite.DBServer.SetPath(suite.DBServerPath)
 
 	// Setup the mock REDCap server
-	f, err := os.Open("../fixtures/example_records.json")
+	records, err := ioutil.ReadFile("../fixtures/example_records.json")
 	require.NoError(err)
 	suite.REDCapServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("content") == "version" {
+			w.Write([]byte("6.5.0"))
+			return
+		}
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		io.Copy(w, f)
+		w.Write(records)
 	}))
 }
 
@@ -73,9 +86,14 @@ func (suite *RoutesSuite) SetupTest() {
 	server.RegisterRoutes(fe, nil, server.NewMongoDataAccessLayer(suite.Database), server.Config{})
 	suite.FHIRServer = httptest.NewServer(fe)
 
+	suite.Dispatcher = webhook.NewDispatcher(suite.Database.C("webhooks"), suite.Database.C("webhookdeliveries"))
+	suite.Dispatcher.RetryDelay = 10 * time.Millisecond
+
+	suite.History = NewRefreshHistory(suite.Database.C("refreshruns"), 0)
+
 	e := gin.New()
 	suite.Server = httptest.NewServer(e)
-	RegisterRoutes(e, suite.FHIRServer.URL, suite.REDCapServer.URL, "123abc", suite.Database.C("pies"), suite.Server.URL+"/pies/")
+	RegisterRoutes(e, suite.FHIRServer.URL, []client.REDCapProject{{Endpoint: suite.REDCapServer.URL, Token: "123abc"}}, suite.Database.C("pies"), suite.Server.URL+"/pies/", suite.Dispatcher, suite.History, nil)
 }
 
 func (suite *RoutesSuite) TearDownTest() {
@@ -145,6 +163,312 @@ func (suite *RoutesSuite) TestRefresh() {
 	assert.Equal(count, 3)
 }
 
+func (suite *RoutesSuite) TestRefreshHistory() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	res, err := http.Post(suite.Server.URL+"/refresh", "application/json", nil)
+	require.NoError(err)
+	res.Body.Close()
+	jobID := res.Header.Get("X-Correlation-ID")
+	assert.NotEmpty(jobID)
+
+	res, err = http.Get(suite.Server.URL + "/refresh/history?trigger=api&from=2016-01-01")
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	var runs []RefreshRun
+	require.NoError(json.NewDecoder(res.Body).Decode(&runs))
+	require.Len(runs, 1)
+	assert.Equal(jobID, runs[0].JobID)
+	assert.Equal(TriggerAPI, runs[0].Trigger.Type)
+	assert.Equal(RunPartial, runs[0].Status)
+	assert.Equal(2, runs[0].Patients)
+	assert.Equal(2, runs[0].Errors)
+	require.Len(runs[0].Projects, 1)
+	assert.Equal(suite.REDCapServer.URL, runs[0].Projects[0].Endpoint)
+	assert.Empty(runs[0].Results)
+
+	res, err = http.Get(suite.Server.URL + "/refresh/history/" + runs[0].ID.Hex())
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	var run RefreshRun
+	require.NoError(json.NewDecoder(res.Body).Decode(&run))
+	assert.Len(run.Results, 2)
+	assert.NotEmpty(run.Results[0].Error)
+
+	res, err = http.Get(suite.Server.URL + "/refresh/history?status=succeeded")
+	require.NoError(err)
+	defer res.Body.Close()
+	require.NoError(json.NewDecoder(res.Body).Decode(&runs))
+	assert.Empty(runs)
+
+	res, err = http.Get(suite.Server.URL + "/refresh/history?status=bogus")
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (suite *RoutesSuite) TestRefreshHistoryRetention() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	suite.History.Retention = 24 * time.Hour
+	defer func() { suite.History.Retention = 0 }()
+	old := RefreshRun{ID: bson.NewObjectId(), Started: time.Now().Add(-48 * time.Hour), Status: RunSucceeded}
+	require.NoError(suite.History.Runs.Insert(&old))
+
+	run, err := suite.History.Start(context.Background(), RefreshTrigger{Type: TriggerCron}, nil, nil, nil)
+	require.NoError(err)
+	require.NoError(suite.History.Finish(run, nil, nil))
+
+	runs, err := suite.History.Find(HistoryQuery{Limit: 10})
+	require.NoError(err)
+	require.Len(runs, 1)
+	assert.Equal(run.ID, runs[0].ID)
+	assert.Equal(RunSucceeded, runs[0].Status)
+}
+
+func (suite *RoutesSuite) TestLeaseAcrossInstances() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	a := NewLease(suite.Database.C("leases"), "refresh", DefaultLeaseTTL)
+	a.Owner = "a"
+	b := NewLease(suite.Database.C("leases"), "refresh", DefaultLeaseTTL)
+	b.Owner = "b"
+
+	_, releaseA, err := a.Acquire(logging.WithJobID(context.Background(), "job1"))
+	require.NoError(err)
+	_, _, err = b.Acquire(logging.WithJobID(context.Background(), "job2"))
+	require.IsType(&LeaseHeldError{}, err)
+	assert.Equal("job1", err.(*LeaseHeldError).JobID)
+	assert.Equal("a", err.(*LeaseHeldError).Owner)
+
+	releaseA()
+	_, releaseB, err := b.Acquire(logging.WithJobID(context.Background(), "job2"))
+	require.NoError(err)
+	releaseB()
+}
+
+func (suite *RoutesSuite) TestExpiredLeaseTakeover() {
+	require := suite.Require()
+
+	require.NoError(suite.Database.C("leases").Insert(bson.M{"_id": "refresh", "owner": "dead", "jobID": "job1", "expires": time.Now().Add(-time.Second)}))
+	l := NewLease(suite.Database.C("leases"), "refresh", DefaultLeaseTTL)
+	_, release, err := l.Acquire(logging.WithJobID(context.Background(), "job2"))
+	require.NoError(err)
+	defer release()
+
+	var doc lease
+	require.NoError(suite.Database.C("leases").FindId("refresh").One(&doc))
+	suite.Equal("job2", doc.JobID)
+	suite.Equal(l.Owner, doc.Owner)
+}
+
+func (suite *RoutesSuite) TestLostLeaseCancelsJob() {
+	require := suite.Require()
+
+	l := NewLease(suite.Database.C("leases"), "refresh", time.Second)
+	l.Heartbeat = 50 * time.Millisecond
+	ctx, release, err := l.Acquire(logging.WithJobID(context.Background(), "job1"))
+	require.NoError(err)
+	defer release()
+
+	// Another instance took over the lease
+	require.NoError(suite.Database.C("leases").UpdateId("refresh", bson.M{"$set": bson.M{"owner": "other"}}))
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		suite.Fail("Job wasn't cancelled after losing the lease")
+	}
+}
+
+func (suite *RoutesSuite) TestScheduleSharedByReplicas() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	newScheduler := func(runs chan string) *Scheduler {
+		s, err := NewScheduler(suite.Database.C("schedule"), "0 0 22 * * *", func(ctx context.Context, spec string) ([]client.Result, error) {
+			runs <- spec
+			return nil, nil
+		})
+		require.NoError(err)
+		s.SyncInterval = 50 * time.Millisecond
+		s.Start()
+		return s
+	}
+	aRuns, bRuns := make(chan string, 10), make(chan string, 10)
+	a, b := newScheduler(aRuns), newScheduler(bRuns)
+	defer a.Stop()
+	defer b.Stop()
+
+	// A new spec saved through one replica is followed by the other
+	require.NoError(a.SetSpec("@every 1s", "ops"))
+	select {
+	case spec := <-bRuns:
+		assert.Equal("@every 1s", spec)
+	case <-time.After(5 * time.Second):
+		require.Fail("The other replica didn't run on the new schedule")
+	}
+
+	// Pausing through one replica pauses the other
+	require.NoError(a.Pause("ops"))
+	time.Sleep(200 * time.Millisecond)
+	for len(bRuns) > 0 {
+		<-bRuns
+	}
+	select {
+	case <-bRuns:
+		suite.Fail("The other replica ran while the schedule was paused")
+	case <-time.After(1500 * time.Millisecond):
+	}
+	status := b.Status()
+	assert.True(status.Paused)
+	assert.Equal("ops", status.UpdatedBy)
+
+	// Resuming through the other replica resumes the first
+	require.NoError(b.Resume("ops"))
+	for len(aRuns) > 0 {
+		<-aRuns
+	}
+	select {
+	case <-aRuns:
+	case <-time.After(5 * time.Second):
+		suite.Fail("The first replica didn't run after resuming")
+	}
+}
+
+func (suite *RoutesSuite) TestResumeInterruptedRefreshes() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Add the patients to the database
+	data, err := os.Open("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	defer data.Close()
+	res, err := http.Post(suite.FHIRServer.URL+"/", "application/json", data)
+	require.NoError(err)
+	res.Body.Close()
+
+	interrupted := RefreshRun{ID: bson.NewObjectId(), JobID: "job1", Started: time.Now(), Status: RunInterrupted, Pending: []string{"a"}}
+	require.NoError(suite.History.Runs.Insert(&interrupted))
+	ResumeInterruptedRefreshes(suite.FHIRServer.URL, []client.REDCapProject{{Endpoint: suite.REDCapServer.URL, Token: "123abc"}}, suite.Database.C("pies"), suite.Server.URL+"/pies/", nil, suite.History)
+
+	run, err := suite.History.Get(interrupted.ID)
+	require.NoError(err)
+	assert.NotEmpty(run.ResumedBy)
+
+	runs, err := suite.History.Find(HistoryQuery{Triggers: []string{TriggerResume}, Limit: 10})
+	require.NoError(err)
+	require.Len(runs, 1)
+	assert.Equal(run.ResumedBy, runs[0].JobID)
+	assert.Equal("run "+interrupted.ID.Hex(), runs[0].Trigger.By)
+	assert.Equal([]string{"a"}, runs[0].Records)
+	assert.Equal(RunSucceeded, runs[0].Status)
+	assert.Equal(1, runs[0].Patients)
+
+	// The run isn't resumed again
+	ResumeInterruptedRefreshes(suite.FHIRServer.URL, []client.REDCapProject{{Endpoint: suite.REDCapServer.URL, Token: "123abc"}}, suite.Database.C("pies"), suite.Server.URL+"/pies/", nil, suite.History)
+	runs, err = suite.History.Find(HistoryQuery{Triggers: []string{TriggerResume}, Limit: 10})
+	require.NoError(err)
+	assert.Len(runs, 1)
+}
+
+func (suite *RoutesSuite) TestAbandonRefreshesAtShutdownTimeout() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	defer func() {
+		running.Lock()
+		running.stopping = false
+		running.Unlock()
+	}()
+	ctx, done, err := trackRefresh(logging.WithJobID(context.Background(), "job1"))
+	require.NoError(err)
+	defer done()
+	run, err := suite.History.Start(ctx, RefreshTrigger{TriggerAPI, ""}, nil, nil, nil)
+	require.NoError(err)
+	trackRun(ctx, suite.History, run)
+	require.NoError(suite.History.Checkpoint(run, []client.Result{{StudyID: "1", FHIRPatientID: "p1"}}))
+
+	// The refresh never stops, so its run is marked interrupted at the timeout
+	stopCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, StopRefreshes(stopCtx))
+	stored, err := suite.History.Get(run.ID)
+	require.NoError(err)
+	assert.Equal(RunInterrupted, stored.Status)
+	assert.Equal(ErrShutdownTimeout.Error(), stored.Error)
+	assert.NotNil(stored.Finished)
+	assert.Equal(client.RefreshOptions{Exclude: []string{"1"}}, stored.interruptedOptions())
+
+	// Runs that finished aren't changed
+	finished, err := suite.History.Start(ctx, RefreshTrigger{TriggerAPI, ""}, nil, nil, nil)
+	require.NoError(err)
+	require.NoError(suite.History.Finish(finished, nil, nil))
+	require.NoError(suite.History.Abandon(finished.ID))
+	stored, err = suite.History.Get(finished.ID)
+	require.NoError(err)
+	assert.Equal(RunSucceeded, stored.Status)
+}
+
+func (suite *RoutesSuite) TestResumeRefreshJob() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Add the patients to the database
+	data, err := os.Open("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	defer data.Close()
+	res, err := http.Post(suite.FHIRServer.URL+"/", "application/json", data)
+	require.NoError(err)
+	res.Body.Close()
+
+	// A run that stopped without finishing, after checkpointing a failed study
+	stopped := RefreshRun{ID: bson.NewObjectId(), JobID: "job1", Started: time.Now(), Status: RunRunning, Records: []string{"a"},
+		Results: []RunResult{{StudyID: "a", Error: "Couldn't reach the FHIR server"}}}
+	require.NoError(suite.History.Runs.Insert(&stopped))
+
+	res, err = http.Post(suite.Server.URL+"/refresh/jobs/job1/resume?only=bogus", "application/json", nil)
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Post(suite.Server.URL+"/refresh/jobs/job0/resume", "application/json", nil)
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Post(suite.Server.URL+"/refresh/jobs/job1/resume?only=failed", "application/json", nil)
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	jobID := res.Header.Get(logging.CorrelationIDHeader)
+	assert.NotEmpty(jobID)
+
+	run, err := suite.History.Get(stopped.ID)
+	require.NoError(err)
+	assert.Equal(jobID, run.ResumedBy)
+
+	resumed, err := suite.History.GetByJobID(jobID)
+	require.NoError(err)
+	assert.Equal(TriggerResume, resumed.Trigger.Type)
+	assert.Equal("run "+stopped.ID.Hex()+" (failed studies)", resumed.Trigger.By)
+	assert.Equal([]string{"a"}, resumed.Records)
+	assert.Equal(RunSucceeded, resumed.Status)
+	assert.NotNil(resumed.Checkpointed)
+	require.Len(resumed.Results, 1)
+	assert.Empty(resumed.Results[0].Error)
+
+	// Nothing is left to resume
+	res, err = http.Post(suite.Server.URL+"/refresh/jobs/"+jobID+"/resume", "application/json", nil)
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
 func (suite *RoutesSuite) TestGetPie() {
 	require := suite.Require()
 	assert := suite.Assert()
@@ -184,6 +508,288 @@ func (suite *RoutesSuite) TestGetPie() {
 	assert.Equal(pie, pie2)
 }
 
+func (suite *RoutesSuite) TestDistributionReport() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	method := client.REDCapRiskServiceConfig.Method
+	pie := func(patient string, asOf time.Time, event, source string, values ...int) bson.M {
+		slices := make([]bson.M, len(values))
+		for i, v := range values {
+			slices[i] = bson.M{"name": client.REDCapRiskServiceConfig.DefaultPieSlices[i].Name, "value": v}
+		}
+		return bson.M{"_id": bson.NewObjectId(), "patient": patient, "slices": slices, "method": method, "asOf": asOf, "event": event, "source": source}
+	}
+	jan := time.Date(2016, 1, 15, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2016, 2, 15, 0, 0, 0, 0, time.UTC)
+	piesCollection := suite.Database.C("pies")
+	require.NoError(piesCollection.Insert(
+		pie("Patient/1", jan, "initial_arm_1", "A", 1, 1, 2, 1),
+		pie("Patient/1", feb, "visit1_arm_1", "A", 3, 1, 2, 1),
+		pie("Patient/2", jan, "initial_arm_1", "B", 4, 2, 2, 1),
+	))
+
+	get := func(query string) DistributionReport {
+		res, err := http.Get(suite.Server.URL + "/reports/distribution" + query)
+		require.NoError(err)
+		defer res.Body.Close()
+		require.Equal(http.StatusOK, res.StatusCode)
+		var report DistributionReport
+		require.NoError(json.NewDecoder(res.Body).Decode(&report))
+		return report
+	}
+
+	report := get("")
+	assert.Equal(2, report.Patients)
+	assert.Equal(map[string]int{"3": 1, "4": 1}, report.Overall)
+	assert.Equal(map[string]int{"3": 1, "4": 1}, report.Domains["Clinical Risk"])
+	assert.Equal(map[string]int{"2": 2}, report.Domains["Psychosocial and Mental Health Risk"])
+
+	report = get("?asOf=2016-01-31")
+	assert.Equal(2, report.Patients)
+	assert.Equal(map[string]int{"2": 1, "4": 1}, report.Overall)
+
+	report = get("?event=initial_arm_1&source=A")
+	assert.Equal(1, report.Patients)
+	assert.Equal(map[string]int{"2": 1}, report.Overall)
+
+	res, err := http.Get(suite.Server.URL + "/reports/distribution?asOf=someday")
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+	// A pie inserted later for an earlier assessment date shouldn't be reported as the latest
+	febPie := pie("Patient/3", feb, "visit1_arm_1", "C", 4, 1, 1, 1)
+	janPie := pie("Patient/3", jan, "initial_arm_1", "C", 1, 1, 1, 1)
+	require.NoError(piesCollection.Insert(febPie, janPie))
+
+	report = get("?source=C")
+	assert.Equal(1, report.Patients)
+	assert.Equal(map[string]int{"4": 1}, report.Overall)
+}
+
+func (suite *RoutesSuite) TestExport() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Refresh to store the pies
+	res, err := http.Post(suite.Server.URL+"/refresh", "application/json", nil)
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+
+	res, err = http.Get(suite.Server.URL + "/export?format=csv")
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("text/csv; charset=utf-8", res.Header.Get("Content-Type"))
+	rows, err := csv.NewReader(res.Body).ReadAll()
+	require.NoError(err)
+	require.Len(rows, 4)
+	assert.Equal(ExportHeader, rows[0])
+
+	res, err = http.Get(suite.Server.URL + "/export?format=ndjson&study=1&from=2016-01-01")
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	decoder := json.NewDecoder(res.Body)
+	var row ExportRow
+	require.NoError(decoder.Decode(&row))
+	assert.Equal("1", row.StudyID)
+	assert.Equal("visit1_arm_1", row.Event)
+	require.NotNil(row.UtilizationRisk)
+	assert.Equal(4, *row.UtilizationRisk)
+	require.NotNil(row.PerceivedRisk)
+	assert.Equal(4, *row.PerceivedRisk)
+	assert.Equal(4, row.Score)
+	assert.Equal(io.EOF, decoder.Decode(&row))
+
+	res, err = http.Get(suite.Server.URL + "/export?format=xml")
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (suite *RoutesSuite) TestBulkExport() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Refresh to store the pies
+	res, err := http.Post(suite.Server.URL+"/refresh", "application/json", nil)
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+
+	e := gin.New()
+	exporter := NewBulkExporter(suite.T().TempDir(), "", suite.FHIRServer.URL, suite.Database.C("pies"), suite.Server.URL+"/pies")
+	RegisterBulkExportHandlers(e, exporter)
+	bulkServer := httptest.NewServer(e)
+	defer bulkServer.Close()
+	exporter.BaseURL = bulkServer.URL
+
+	req, err := http.NewRequest("GET", bulkServer.URL+"/$export?_type=RiskAssessment", nil)
+	require.NoError(err)
+	req.Header.Set("Accept", "application/fhir+json")
+	req.Header.Set("Prefer", "respond-async")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(http.StatusAccepted, res.StatusCode)
+	status := res.Header.Get("Content-Location")
+	require.True(strings.HasPrefix(status, bulkServer.URL+"/bulkstatus/"))
+
+	// Poll until the export is complete
+	var manifest BulkManifest
+	for i := 0; ; i++ {
+		res, err = http.Get(status)
+		require.NoError(err)
+		if res.StatusCode == http.StatusOK {
+			require.NoError(json.NewDecoder(res.Body).Decode(&manifest))
+			res.Body.Close()
+			break
+		}
+		res.Body.Close()
+		require.Equal(http.StatusAccepted, res.StatusCode)
+		require.True(i < 100, "Export didn't complete")
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Len(manifest.Output, 1)
+	assert.Equal(3, manifest.Output[0].Count)
+
+	res, err = http.Get(manifest.Output[0].URL)
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("application/fhir+ndjson", res.Header.Get("Content-Type"))
+	decoder := json.NewDecoder(res.Body)
+	var ras []fhir.RiskAssessment
+	for decoder.More() {
+		var ra fhir.RiskAssessment
+		require.NoError(decoder.Decode(&ra))
+		ras = append(ras, ra)
+	}
+	assert.Len(ras, 3)
+
+	req, err = http.NewRequest("DELETE", status, nil)
+	require.NoError(err)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+}
+
+func (suite *RoutesSuite) TestImport() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Add the patients to the database
+	data, err := os.Open("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	defer data.Close()
+	res, err := http.Post(suite.FHIRServer.URL+"/", "application/json", data)
+	require.NoError(err)
+	res.Body.Close()
+
+	export := "study_id,redcap_event_name,rf_date,rf_cmc_risk_cat,rf_func_risk_cat,rf_sb_risk_cat,rf_util_risk_cat,rf_risk_predicted,risk_factors_complete\n" +
+		"a,initial_arm_1,2016-02-21,1,1,2,1,2,2\n" +
+		"a,visit1_arm_1,2016-03-21,1,1,9,1,2,2\n"
+	res, err = http.Post(suite.Server.URL+"/import", "text/csv", strings.NewReader(export))
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	var results []map[string]interface{}
+	require.NoError(json.NewDecoder(res.Body).Decode(&results))
+	require.Len(results, 1)
+	assert.Equal("a", results[0]["studyID"])
+	assert.Equal(float64(1), results[0]["riskAssessmentCount"])
+	assert.Len(results[0]["invalid"], 1)
+
+	runs, err := suite.History.Find(HistoryQuery{Triggers: []string{TriggerImport}, Limit: 10})
+	require.NoError(err)
+	require.Len(runs, 1)
+	assert.Equal("127.0.0.1 (request body)", runs[0].Trigger.By)
+	assert.Equal(RunSucceeded, runs[0].Status)
+
+	// Imports can't be resumed
+	res, err = http.Post(suite.Server.URL+"/refresh/jobs/"+runs[0].JobID+"/resume", "application/json", nil)
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (suite *RoutesSuite) TestPurgePies() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	piesCollection := suite.Database.C("pies")
+	store := func(patientID string, method *fhir.CodeableConcept) bson.ObjectId {
+		pie := struct {
+			plugin.Pie `bson:",inline"`
+			Method     *fhir.CodeableConcept `bson:"method"`
+		}{Method: method}
+		pie.Id = bson.NewObjectId()
+		pie.Patient = suite.FHIRServer.URL + "/Patient/" + patientID
+		require.NoError(piesCollection.Insert(&pie))
+		return pie.Id
+	}
+	other := &fhir.CodeableConcept{Coding: []fhir.Coding{{System: "http://example.org/risk", Code: "other"}}}
+	store("a", &client.REDCapRiskServiceConfig.Method)
+	store("a", &client.REDCapRiskServiceConfig.Method)
+	store("b", &client.REDCapRiskServiceConfig.Method)
+	kept := []bson.ObjectId{store("a", other), store("c", &client.REDCapRiskServiceConfig.Method)}
+
+	removed, err := PurgePies(suite.FHIRServer.URL, piesCollection, []string{"a", "b"})
+	require.NoError(err)
+	assert.Equal(3, removed)
+	var remaining []plugin.Pie
+	require.NoError(piesCollection.Find(nil).Sort("_id").All(&remaining))
+	require.Len(remaining, 2)
+	assert.Equal(kept[0], remaining[0].Id)
+	assert.Equal(kept[1], remaining[1].Id)
+}
+
+func (suite *RoutesSuite) TestGetLatestPiesForStudies() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	piesCollection := suite.Database.C("pies")
+	store := func(patientID, studyID string) bson.ObjectId {
+		pie := struct {
+			plugin.Pie       `bson:",inline"`
+			Method           *fhir.CodeableConcept `bson:"method"`
+			client.PieSource `bson:",inline"`
+		}{Method: &client.REDCapRiskServiceConfig.Method, PieSource: client.PieSource{StudyID: studyID}}
+		pie.Id = bson.NewObjectId()
+		pie.Patient = suite.FHIRServer.URL + "/Patient/" + patientID
+		require.NoError(piesCollection.Insert(&pie))
+		return pie.Id
+	}
+	store("a", "1")
+	latestA := store("a", "2")
+	store("b", "3")
+
+	// Only the pies of the patients with pies from the studies are looked up, including their other studies' pies
+	opts := client.RefreshOptions{RecordIDs: []string{"1"}}
+	patients, err := findStudyPatients(piesCollection, refreshedStudyIDs(opts))
+	require.NoError(err)
+	assert.Equal([]string{suite.FHIRServer.URL + "/Patient/a"}, patients)
+	pies, err := getLatestPies(piesCollection, patientSelector(true, patients))
+	require.NoError(err)
+	require.Len(pies, 1)
+	assert.Equal(latestA, pies[suite.FHIRServer.URL+"/Patient/a"].ID)
+
+	// Studies without pies select no pies at all, while unlimited refreshes select every patient's pies
+	patients, err = findStudyPatients(piesCollection, []string{"4"})
+	require.NoError(err)
+	pies, err = getLatestPies(piesCollection, patientSelector(true, patients))
+	require.NoError(err)
+	assert.Empty(pies)
+	assert.Nil(refreshedStudyIDs(client.RefreshOptions{}))
+	pies, err = getLatestPies(piesCollection, patientSelector(false, nil))
+	require.NoError(err)
+	assert.Len(pies, 2)
+}
+
 func (suite *RoutesSuite) TestGetInvalidPie() {
 	require := suite.Require()
 	assert := suite.Assert()
@@ -194,3 +800,96 @@ func (suite *RoutesSuite) TestGetInvalidPie() {
 	defer res.Body.Close()
 	assert.Equal(http.StatusNotFound, res.StatusCode)
 }
+
+func (suite *RoutesSuite) TestWebhookNotifications() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Add the patients to the database
+	data, err := os.Open("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	defer data.Close()
+	res, err := http.Post(suite.FHIRServer.URL+"/", "application/json", data)
+	require.NoError(err)
+	defer res.Body.Close()
+
+	// Setup the subscriber
+	var events []webhook.Event
+	var mu sync.Mutex
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		assert.NoError(json.NewDecoder(r.Body).Decode(&event))
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer subscriber.Close()
+
+	// Register the webhook
+	body := strings.NewReader(`{"url": "` + subscriber.URL + `", "secret": "shh"}`)
+	res, err = http.DefaultClient.Post(suite.Server.URL+"/webhooks", "application/json", body)
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusCreated, res.StatusCode)
+	var sub webhook.Subscription
+	require.NoError(json.NewDecoder(res.Body).Decode(&sub))
+	assert.Equal(subscriber.URL, sub.URL)
+	assert.Empty(sub.Secret, "Secrets should never be returned")
+
+	// Trigger the refresh and wait for the deliveries
+	res, err = http.DefaultClient.Post(suite.Server.URL+"/refresh", "application/json", nil)
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	suite.Dispatcher.Wait()
+
+	// Two patients got new scores, followed by the refresh completion
+	require.Len(events, 3)
+	var changed, completed int
+	for _, event := range events {
+		switch event.Type {
+		case webhook.RiskChanged:
+			changed++
+		case webhook.RefreshCompleted:
+			completed++
+		}
+	}
+	assert.Equal(2, changed)
+	assert.Equal(1, completed)
+
+	// Check the delivery log
+	res, err = http.DefaultClient.Get(suite.Server.URL + "/webhooks/" + sub.ID.Hex() + "/deliveries")
+	require.NoError(err)
+	defer res.Body.Close()
+	var deliveries []webhook.Delivery
+	require.NoError(json.NewDecoder(res.Body).Decode(&deliveries))
+	assert.Len(deliveries, 3)
+	for _, delivery := range deliveries {
+		assert.True(delivery.Success)
+	}
+}
+
+func (suite *RoutesSuite) TestReadyz() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	res, err := http.DefaultClient.Get(suite.Server.URL + "/readyz")
+	require.NoError(err)
+	defer res.Body.Close()
+
+	// The test FHIR server doesn't support /metadata, so it is reported as down
+	assert.Equal(http.StatusServiceUnavailable, res.StatusCode)
+	var body struct {
+		Status string            `json:"status"`
+		Checks []DependencyCheck `json:"checks"`
+	}
+	require.NoError(json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(StatusUnavailable, body.Status)
+	require.Len(body.Checks, 3)
+	assert.Equal("mongo", body.Checks[0].Name)
+	assert.Equal(StatusOK, body.Checks[0].Status)
+	assert.Equal("fhir", body.Checks[1].Name)
+	assert.Equal(StatusUnavailable, body.Checks[1].Status)
+	assert.Equal("redcap", body.Checks[2].Name)
+	assert.Equal(StatusOK, body.Checks[2].Status)
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/robfig/cron"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// scheduleID is the ID of the saved refresh schedule
+const scheduleID = "refresh"
+
+// nextRunCount is the number of upcoming run times reported in the schedule status
+const nextRunCount = 5
+
+// DefaultScheduleSyncInterval is how often the schedule saved by other replicas is reloaded
+const DefaultScheduleSyncInterval = 30 * time.Second
+
+// RunSkipped indicates a scheduled run was skipped because another refresh was running
+const RunSkipped = "skipped"
+
+// ScheduledRun is the outcome of the most recent scheduled run
+type ScheduledRun struct {
+	JobID           string    `bson:"jobID" json:"jobID"`
+	Spec            string    `bson:"spec" json:"spec"`
+	Started         time.Time `bson:"started" json:"started"`
+	Finished        time.Time `bson:"finished" json:"finished"`
+	Status          string    `bson:"status" json:"status"`
+	Patients        int       `bson:"patients" json:"patients"`
+	Errors          int       `bson:"errors" json:"errors"`
+	RiskAssessments int       `bson:"riskAssessments" json:"riskAssessments"`
+	Error           string    `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// ScheduleStatus is the current schedule, reported by GET /schedule.  NextRuns is empty while the schedule is paused.
+type ScheduleStatus struct {
+	Spec      string        `bson:"spec" json:"spec"`
+	Paused    bool          `bson:"paused" json:"paused"`
+	NextRuns  []time.Time   `bson:"-" json:"nextRuns"`
+	LastRun   *ScheduledRun `bson:"lastRun,omitempty" json:"lastRun,omitempty"`
+	Updated   *time.Time    `bson:"updated,omitempty" json:"updated,omitempty"`
+	UpdatedBy string        `bson:"updatedBy,omitempty" json:"updatedBy,omitempty"`
+}
+
+// Scheduler runs a job on a cron schedule that can be changed, paused, and resumed without restarting the service.
+// The schedule, whether it is paused, and the outcome of the last run are saved in Mongo, so they survive restarts.
+// Every replica sharing the settings collection follows the saved schedule: it is reloaded before each scheduled run
+// and every SyncInterval, so a change made through one replica applies to all of them.
+type Scheduler struct {
+	// Settings is the collection the schedule is saved in.  If nil, the schedule isn't saved.
+	Settings *mgo.Collection
+	// SyncInterval is how often the saved schedule is reloaded (default: DefaultScheduleSyncInterval)
+	SyncInterval time.Duration
+	job          ScheduledJob
+	status       ScheduleStatus
+	schedule     cron.Schedule
+	cron         *cron.Cron
+	started      bool
+	stopSync     chan struct{}
+	mutex        sync.Mutex
+}
+
+// NewScheduler creates a scheduler running the job.  If a schedule was saved in the settings collection, it is used
+// instead of the default spec.
+func NewScheduler(settings *mgo.Collection, defaultSpec string, job ScheduledJob) (*Scheduler, error) {
+	s := &Scheduler{Settings: settings, SyncInterval: DefaultScheduleSyncInterval, job: job}
+	if settings != nil {
+		var saved ScheduleStatus
+		if err := settings.FindId(scheduleID).One(&saved); err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		} else if err == nil {
+			if schedule, err := cron.Parse(saved.Spec); err != nil {
+				slog.Warn("Ignoring invalid saved refresh schedule", "spec", saved.Spec, "error", err)
+			} else {
+				if saved.Spec != defaultSpec {
+					slog.Info("Using the saved refresh schedule instead of the configured one", "spec", saved.Spec, "configured", defaultSpec)
+				}
+				s.status, s.schedule = saved, schedule
+				return s, nil
+			}
+		}
+	}
+
+	schedule, err := cron.Parse(defaultSpec)
+	if err != nil {
+		return nil, err
+	}
+	s.status.Spec, s.schedule = defaultSpec, schedule
+	return s, nil
+}
+
+// Start starts running the job on the schedule, unless the schedule is paused
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	s.startCron()
+	if s.Settings != nil && s.SyncInterval > 0 {
+		s.stopSync = make(chan struct{})
+		go s.sync(s.stopSync)
+	}
+}
+
+// Stop stops running the job.  Runs in progress are not interrupted.
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.started = false
+	s.stopCron()
+	if s.stopSync != nil {
+		close(s.stopSync)
+		s.stopSync = nil
+	}
+}
+
+// sync reloads the saved schedule every SyncInterval until stop is closed
+func (s *Scheduler) sync(stop chan struct{}) {
+	ticker := time.NewTicker(s.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mutex.Lock()
+			if _, err := s.reload(); err != nil {
+				slog.Error("Couldn't reload the saved refresh schedule", "error", err)
+			}
+			s.mutex.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reload applies the saved schedule, which another replica may have changed, returning whether the spec or whether it
+// is paused changed.  An invalid saved spec is ignored.  The mutex must be held.
+func (s *Scheduler) reload() (bool, error) {
+	if s.Settings == nil {
+		return false, nil
+	}
+	var saved ScheduleStatus
+	if err := s.Settings.FindId(scheduleID).One(&saved); err == mgo.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if saved.Spec == s.status.Spec && saved.Paused == s.status.Paused {
+		s.status = saved
+		return false, nil
+	}
+	schedule, err := cron.Parse(saved.Spec)
+	if err != nil {
+		// NewScheduler already warned about the invalid saved spec, and saving a new one replaces it
+		return false, nil
+	}
+	s.status, s.schedule = saved, schedule
+	s.stopCron()
+	s.startCron()
+	slog.Info("Applied the refresh schedule saved by another replica", "spec", saved.Spec, "paused", saved.Paused, "by", saved.UpdatedBy)
+	return true, nil
+}
+
+// startCron starts a new cron running the job on the current schedule.  The mutex must be held.
+func (s *Scheduler) startCron() {
+	if !s.started || s.status.Paused || s.cron != nil {
+		return
+	}
+	s.cron = cron.New()
+	s.cron.Schedule(s.schedule, cron.FuncJob(s.tick))
+	s.cron.Start()
+}
+
+// tick runs the job when the schedule fires, unless the saved schedule changed since it was last loaded, in which case
+// the job runs on the saved schedule instead
+func (s *Scheduler) tick() {
+	s.mutex.Lock()
+	changed, err := s.reload()
+	if err != nil {
+		slog.Error("Couldn't reload the saved refresh schedule", "error", err)
+	}
+	spec := s.status.Spec
+	s.mutex.Unlock()
+	if !changed {
+		s.run(spec)
+	}
+}
+
+// stopCron stops the running cron, if any.  The mutex must be held.
+func (s *Scheduler) stopCron() {
+	if s.cron != nil {
+		s.cron.Stop()
+		s.cron = nil
+	}
+}
+
+// run runs the job, recording its outcome as the last run
+func (s *Scheduler) run(spec string) {
+	ctx := logging.WithJobID(context.Background(), logging.NewJobID())
+	run := ScheduledRun{JobID: logging.JobID(ctx), Spec: spec, Started: time.Now().UTC()}
+	results, err := s.job(ctx, spec)
+	run.Finished = time.Now().UTC()
+	summary := summarizeRefresh(results, err)
+	run.Status = runStatus(summary, err)
+	if _, ok := err.(*LeaseHeldError); ok {
+		run.Status = RunSkipped
+	}
+	run.Patients, run.Errors, run.RiskAssessments, run.Error = summary.Patients, summary.Errors, summary.RiskAssessments, summary.Error
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.saveLastRun(&run); err != nil {
+		slog.ErrorContext(ctx, "Couldn't save the outcome of the scheduled run", "error", err)
+	}
+	s.status.LastRun = &run
+}
+
+// saveLastRun saves the outcome of the last run, leaving the rest of the saved schedule (which another replica may
+// have changed) alone.  The mutex must be held.
+func (s *Scheduler) saveLastRun(run *ScheduledRun) error {
+	if s.Settings == nil {
+		return nil
+	}
+	err := s.Settings.UpdateId(scheduleID, bson.M{"$set": bson.M{"lastRun": run}})
+	if err == mgo.ErrNotFound {
+		status := s.status
+		status.LastRun = run
+		return s.save(status)
+	}
+	return err
+}
+
+// save saves the schedule status in the settings collection, if set.  The mutex must be held.
+func (s *Scheduler) save(status ScheduleStatus) error {
+	if s.Settings == nil {
+		return nil
+	}
+	_, err := s.Settings.UpsertId(scheduleID, &status)
+	return err
+}
+
+// update saves the schedule status and, if that succeeds, applies it.  The mutex must be held.
+func (s *Scheduler) update(status ScheduleStatus, by string) error {
+	updated := time.Now().UTC()
+	status.Updated, status.UpdatedBy = &updated, by
+	if err := s.save(status); err != nil {
+		return err
+	}
+	s.status = status
+	return nil
+}
+
+// Status returns the current schedule and its next run times
+func (s *Scheduler) Status() ScheduleStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.reload(); err != nil {
+		slog.Error("Couldn't reload the saved refresh schedule", "error", err)
+	}
+	status := s.status
+	status.NextRuns = []time.Time{}
+	if !status.Paused {
+		next := time.Now()
+		for i := 0; i < nextRunCount; i++ {
+			if next = s.schedule.Next(next); next.IsZero() {
+				break
+			}
+			status.NextRuns = append(status.NextRuns, next)
+		}
+	}
+	return status
+}
+
+// SetSpec validates the cron spec and replaces the schedule with it, recording who changed it.  Runs in progress are
+// not interrupted.
+func (s *Scheduler) SetSpec(spec, by string) error {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.reload(); err != nil {
+		return err
+	}
+	status := s.status
+	status.Spec = spec
+	if err := s.update(status, by); err != nil {
+		return err
+	}
+	s.schedule = schedule
+	s.stopCron()
+	s.startCron()
+	slog.Info("Changed the refresh schedule", "spec", spec, "by", by)
+	return nil
+}
+
+// Pause stops running the job on the schedule until Resume is called, recording who paused it
+func (s *Scheduler) Pause(by string) error {
+	return s.setPaused(true, by)
+}
+
+// Resume restarts running the job on the schedule after Pause, recording who resumed it
+func (s *Scheduler) Resume(by string) error {
+	return s.setPaused(false, by)
+}
+
+func (s *Scheduler) setPaused(paused bool, by string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.reload(); err != nil {
+		return err
+	}
+	if s.status.Paused == paused {
+		return nil
+	}
+	status := s.status
+	status.Paused = paused
+	if err := s.update(status, by); err != nil {
+		return err
+	}
+	if paused {
+		s.stopCron()
+		slog.Info("Paused the refresh schedule", "by", by)
+	} else {
+		s.startCron()
+		slog.Info("Resumed the refresh schedule", "by", by)
+	}
+	return nil
+}
+
+// RegisterScheduleHandlers registers the handlers to view and change the refresh schedule, and to pause and resume it
+func RegisterScheduleHandlers(e *gin.Engine, scheduler *Scheduler) {
+	e.GET("/schedule", func(c *gin.Context) {
+		c.JSON(http.StatusOK, scheduler.Status())
+	})
+
+	e.PUT("/schedule", func(c *gin.Context) {
+		var body struct {
+			Spec string `json:"spec"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			return
+		}
+		if _, err := cron.Parse(body.Spec); err != nil {
+			c.String(http.StatusBadRequest, "Invalid cron spec: %s", body.Spec)
+			return
+		}
+		if err := scheduler.SetSpec(body.Spec, requestSubject(c)); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, scheduler.Status())
+	})
+
+	e.POST("/schedule/pause", func(c *gin.Context) {
+		if err := scheduler.Pause(requestSubject(c)); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, scheduler.Status())
+	})
+
+	e.POST("/schedule/resume", func(c *gin.Context) {
+		if err := scheduler.Resume(requestSubject(c)); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, scheduler.Status())
+	})
+}
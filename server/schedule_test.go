@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestScheduleSuite(t *testing.T) {
+	suite.Run(t, new(ScheduleSuite))
+}
+
+type ScheduleSuite struct {
+	suite.Suite
+	Scheduler *Scheduler
+	Server    *httptest.Server
+	Runs      chan string
+}
+
+func (suite *ScheduleSuite) SetupTest() {
+	require := suite.Require()
+
+	// Turn off debug mode since all of the logging gets in the way
+	gin.SetMode(gin.ReleaseMode)
+
+	suite.Runs = make(chan string, 10)
+	var err error
+	suite.Scheduler, err = NewScheduler(nil, "0 0 22 * * *", func(ctx context.Context, spec string) ([]client.Result, error) {
+		suite.Runs <- logging.JobID(ctx)
+		return []client.Result{{StudyID: "1", RiskAssessmentCount: 2}, {StudyID: "2", Error: errors.New("No patient found")}}, nil
+	})
+	require.NoError(err)
+	suite.Scheduler.Start()
+
+	e := gin.New()
+	RegisterScheduleHandlers(e, suite.Scheduler)
+	suite.Server = httptest.NewServer(e)
+}
+
+func (suite *ScheduleSuite) TearDownTest() {
+	suite.Scheduler.Stop()
+	suite.Server.Close()
+}
+
+func (suite *ScheduleSuite) do(method, path, body string) (int, ScheduleStatus) {
+	require := suite.Require()
+
+	req, err := http.NewRequest(method, suite.Server.URL+path, bytes.NewBufferString(body))
+	require.NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+	var status ScheduleStatus
+	if res.StatusCode == http.StatusOK {
+		require.NoError(json.NewDecoder(res.Body).Decode(&status))
+	}
+	return res.StatusCode, status
+}
+
+func (suite *ScheduleSuite) TestInvalidDefaultSpec() {
+	_, err := NewScheduler(nil, "every night", nil)
+	suite.Error(err)
+}
+
+func (suite *ScheduleSuite) TestGetSchedule() {
+	assert := suite.Assert()
+
+	code, status := suite.do("GET", "/schedule", "")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("0 0 22 * * *", status.Spec)
+	assert.False(status.Paused)
+	assert.Nil(status.LastRun)
+	if assert.Len(status.NextRuns, nextRunCount) {
+		for i, next := range status.NextRuns {
+			assert.Equal(22, next.Local().Hour())
+			if i > 0 {
+				assert.Equal(24*time.Hour, next.Sub(status.NextRuns[i-1]))
+			}
+		}
+	}
+}
+
+func (suite *ScheduleSuite) TestPutSchedule() {
+	assert := suite.Assert()
+
+	code, _ := suite.do("PUT", "/schedule", `{"spec": "0 0 25 * * *"}`)
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = suite.do("PUT", "/schedule", `{}`)
+	assert.Equal(http.StatusBadRequest, code)
+
+	code, status := suite.do("PUT", "/schedule", `{"spec": "0 30 6 * * *"}`)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("0 30 6 * * *", status.Spec)
+	assert.NotNil(status.Updated)
+	assert.NotEmpty(status.UpdatedBy)
+	if assert.NotEmpty(status.NextRuns) {
+		assert.Equal(6, status.NextRuns[0].Local().Hour())
+		assert.Equal(30, status.NextRuns[0].Local().Minute())
+	}
+}
+
+func (suite *ScheduleSuite) TestPauseAndResume() {
+	assert := suite.Assert()
+
+	code, status := suite.do("POST", "/schedule/pause", "")
+	assert.Equal(http.StatusOK, code)
+	assert.True(status.Paused)
+	assert.Empty(status.NextRuns)
+
+	// Changing the spec while paused doesn't resume the schedule
+	_, status = suite.do("PUT", "/schedule", `{"spec": "@every 1s"}`)
+	assert.True(status.Paused)
+	select {
+	case <-suite.Runs:
+		suite.Fail("Scheduled job ran while paused")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	code, status = suite.do("POST", "/schedule/resume", "")
+	assert.Equal(http.StatusOK, code)
+	assert.False(status.Paused)
+	assert.NotEmpty(status.NextRuns)
+	select {
+	case <-suite.Runs:
+	case <-time.After(5 * time.Second):
+		suite.Fail("Scheduled job didn't run after resuming")
+	}
+}
+
+func (suite *ScheduleSuite) TestLastRun() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	require.NoError(suite.Scheduler.SetSpec("@every 1s", "test"))
+	var jobID string
+	select {
+	case jobID = <-suite.Runs:
+	case <-time.After(5 * time.Second):
+		require.Fail("Scheduled job didn't run")
+	}
+	suite.Scheduler.Stop()
+
+	// Wait for the outcome to be recorded after the job returns
+	var status ScheduleStatus
+	for i := 0; i < 20; i++ {
+		if status = suite.Scheduler.Status(); status.LastRun != nil && status.LastRun.JobID == jobID {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.NotNil(status.LastRun)
+	assert.NotEmpty(jobID)
+	assert.Equal(jobID, status.LastRun.JobID)
+	assert.Equal("@every 1s", status.LastRun.Spec)
+	assert.Equal(RunPartial, status.LastRun.Status)
+	assert.Equal(2, status.LastRun.Patients)
+	assert.Equal(1, status.LastRun.Errors)
+	assert.Equal(2, status.LastRun.RiskAssessments)
+	assert.Equal("test", status.UpdatedBy)
+}
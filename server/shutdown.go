@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrShuttingDown is returned when a refresh is requested after the service started shutting down
+var ErrShuttingDown = errors.New("The service is shutting down")
+
+// ErrShutdownTimeout is recorded for refreshes that were still running when the shutdown timeout passed
+var ErrShutdownTimeout = errors.New("The service shut down before the refresh stopped")
+
+// trackedRun is the history run of a running refresh
+type trackedRun struct {
+	history *RefreshHistory
+	id      bson.ObjectId
+}
+
+// running tracks the refreshes in progress so that they can be stopped at shutdown
+var running = struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	cancels  map[string]context.CancelFunc
+	runs     map[string]trackedRun
+	stopping bool
+}{cancels: make(map[string]context.CancelFunc), runs: make(map[string]trackedRun)}
+
+// trackRefresh registers a refresh as running, returning its context (cancelled when the service shuts down) and the
+// function to call when it is done.  If the service is shutting down, ErrShuttingDown is returned instead.
+func trackRefresh(ctx context.Context) (context.Context, func(), error) {
+	running.Lock()
+	defer running.Unlock()
+	if running.stopping {
+		return ctx, nil, ErrShuttingDown
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	jobID := logging.JobID(ctx)
+	running.cancels[jobID] = cancel
+	running.wg.Add(1)
+	return ctx, func() {
+		running.Lock()
+		delete(running.cancels, jobID)
+		delete(running.runs, jobID)
+		running.Unlock()
+		cancel()
+		running.wg.Done()
+	}, nil
+}
+
+// trackRun records the history run of the running refresh with the job ID in the context, so that the run can be
+// marked interrupted if the refresh doesn't stop before the shutdown timeout
+func trackRun(ctx context.Context, history *RefreshHistory, run *RefreshRun) {
+	running.Lock()
+	defer running.Unlock()
+	if _, ok := running.cancels[logging.JobID(ctx)]; ok {
+		running.runs[logging.JobID(ctx)] = trackedRun{history: history, id: run.ID}
+	}
+}
+
+// StopRefreshes refuses any new refreshes and asks the running refreshes to stop once they finish the study they are
+// processing.  Interrupted refreshes save their progress in the refresh history, to be resumed by
+// ResumeInterruptedRefreshes on the next start.  StopRefreshes waits for the refreshes to stop until the context is
+// done.  If they didn't stop in time, their runs are marked interrupted, to be resumed from their checkpointed
+// results, and the context's error is returned.
+func StopRefreshes(ctx context.Context) error {
+	running.Lock()
+	running.stopping = true
+	for jobID, cancel := range running.cancels {
+		slog.InfoContext(logging.WithJobID(ctx, jobID), "Stopping refresh for shutdown")
+		cancel()
+	}
+	running.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		running.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		abandonRefreshes(ctx)
+		return ctx.Err()
+	}
+}
+
+// abandonRefreshes marks the runs of the refreshes that are still running as interrupted
+func abandonRefreshes(ctx context.Context) {
+	running.Lock()
+	defer running.Unlock()
+	for jobID, tracked := range running.runs {
+		slog.WarnContext(logging.WithJobID(ctx, jobID), "Refresh didn't stop before the shutdown timeout", "run", tracked.id.Hex())
+		if err := tracked.history.Abandon(tracked.id); err != nil {
+			slog.ErrorContext(logging.WithJobID(ctx, jobID), "Couldn't mark refresh interrupted in the history", "run", tracked.id.Hex(), "error", err)
+		}
+	}
+}
+
+// ResumeInterruptedRefreshes resumes the refreshes interrupted by a shutdown, refreshing the studies they didn't get
+// to.  Each interrupted run is claimed before it is resumed, so it is only resumed by one instance.
+func ResumeInterruptedRefreshes(fhirEndpoint string, projects []client.REDCapProject, pieCollection *mgo.Collection, basisPieURL string, dispatcher *webhook.Dispatcher, history *RefreshHistory) {
+	if history == nil {
+		return
+	}
+	var runs []RefreshRun
+	// Imports can't be resumed since the imported file isn't kept
+	sel := bson.M{"status": RunInterrupted, "resumedBy": bson.M{"$exists": false}, "trigger.type": bson.M{"$ne": TriggerImport}}
+	if err := history.Runs.Find(sel).Sort("started").All(&runs); err != nil {
+		slog.Error("Couldn't find interrupted refreshes", "error", err)
+		return
+	}
+
+	for _, run := range runs {
+		ctx := logging.WithJobID(context.Background(), logging.NewJobID())
+		claimed := bson.M{"_id": run.ID, "resumedBy": bson.M{"$exists": false}}
+		if err := history.Runs.Update(claimed, bson.M{"$set": bson.M{"resumedBy": logging.JobID(ctx)}}); err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Couldn't claim interrupted refresh", "run", run.ID.Hex(), "error", err)
+			continue
+		}
+
+		opts := run.interruptedOptions()
+		slog.InfoContext(ctx, "Resuming interrupted refresh", "run", run.ID.Hex(), "interrupted_job_id", run.JobID, "records", len(opts.RecordIDs), "excluded", len(opts.Exclude))
+		results, err := refreshRiskAssessmentsWithOptions(ctx, RefreshTrigger{TriggerResume, "run " + run.ID.Hex()}, fhirEndpoint, projects, pieCollection, basisPieURL, dispatcher, history, opts)
+		if _, ok := err.(*LeaseHeldError); ok || err == ErrShuttingDown {
+			// Leave the run to be resumed later
+			if uErr := history.Runs.UpdateId(run.ID, bson.M{"$unset": bson.M{"resumedBy": ""}}); uErr != nil {
+				slog.ErrorContext(ctx, "Couldn't release interrupted refresh", "run", run.ID.Hex(), "error", uErr)
+			}
+			slog.InfoContext(ctx, "Couldn't resume interrupted refresh yet", "run", run.ID.Hex(), "error", err)
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Couldn't resume interrupted refresh", "run", run.ID.Hex(), "error", err)
+		} else {
+			client.LogResultSummary(ctx, results)
+		}
+	}
+}
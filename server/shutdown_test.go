@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/logging"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestShutdownSuite(t *testing.T) {
+	suite.Run(t, new(ShutdownSuite))
+}
+
+type ShutdownSuite struct {
+	suite.Suite
+}
+
+func (suite *ShutdownSuite) SetupTest() {
+	// Turn off debug mode since all of the logging gets in the way
+	gin.SetMode(gin.ReleaseMode)
+}
+
+func (suite *ShutdownSuite) TearDownTest() {
+	running.Lock()
+	running.stopping = false
+	running.Unlock()
+}
+
+func (suite *ShutdownSuite) TestStopRefreshes() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	ctx, done, err := trackRefresh(logging.WithJobID(context.Background(), "job1"))
+	require.NoError(err)
+	stopped := make(chan struct{})
+	go func() {
+		// Simulate a refresh finishing its current study after being asked to stop
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		done()
+		close(stopped)
+	}()
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(StopRefreshes(stopCtx))
+	select {
+	case <-stopped:
+	default:
+		assert.Fail("StopRefreshes returned before the refresh stopped")
+	}
+
+	_, _, err = trackRefresh(logging.WithJobID(context.Background(), "job2"))
+	assert.Equal(ErrShuttingDown, err)
+}
+
+func (suite *ShutdownSuite) TestStopRefreshesTimeout() {
+	require := suite.Require()
+
+	_, done, err := trackRefresh(logging.WithJobID(context.Background(), "job1"))
+	require.NoError(err)
+	defer done()
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	suite.Equal(context.DeadlineExceeded, StopRefreshes(stopCtx))
+}
+
+func (suite *ShutdownSuite) TestTrackRun() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	ctx, done, err := trackRefresh(logging.WithJobID(context.Background(), "job1"))
+	require.NoError(err)
+	trackRun(ctx, nil, &RefreshRun{ID: bson.NewObjectId()})
+	running.Lock()
+	assert.Contains(running.runs, "job1")
+	running.Unlock()
+
+	// Runs of refreshes that aren't running anymore aren't tracked
+	done()
+	trackRun(ctx, nil, &RefreshRun{ID: bson.NewObjectId()})
+	running.Lock()
+	assert.NotContains(running.runs, "job1")
+	running.Unlock()
+}
+
+func (suite *ShutdownSuite) TestRefreshRejectedWhileShuttingDown() {
+	require := suite.Require()
+
+	require.NoError(StopRefreshes(context.Background()))
+
+	e := gin.New()
+	RegisterRefreshHandler(e, "http://fhir", []client.REDCapProject{{Endpoint: "http://redcap", Token: "123abc"}}, nil, "http://example.org/pies", nil, nil)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/refresh", "application/json", nil)
+	require.NoError(err)
+	defer res.Body.Close()
+	suite.Equal(http.StatusServiceUnavailable, res.StatusCode)
+}
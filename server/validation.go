@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+)
+
+// validationReport keeps the most recent result for each study (indexed by source and study ID) so the validation
+// problems can be downloaded
+type validationReport struct {
+	results map[string]client.Result
+	mutex   sync.RWMutex
+}
+
+var lastValidationReport = &validationReport{results: make(map[string]client.Result)}
+
+// Update stores the results from a refresh.  A full refresh replaces all stored results, while a partial refresh
+// only replaces the results for the refreshed studies.
+func (v *validationReport) Update(results []client.Result, full bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if full {
+		v.results = make(map[string]client.Result, len(results))
+	}
+	for _, result := range results {
+		v.results[result.Source+"|"+result.StudyID] = result
+	}
+}
+
+// Results returns the stored results, sorted by source and study ID
+func (v *validationReport) Results() []client.Result {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	ids := make([]string, 0, len(v.results))
+	for id := range v.results {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	results := make([]client.Result, len(ids))
+	for i, id := range ids {
+		results[i] = v.results[id]
+	}
+	return results
+}
+
+// RegisterValidationReportHandler registers the handler to download the validation problems from the most recent
+// refreshes as a CSV
+func RegisterValidationReportHandler(e *gin.Engine) {
+	e.GET("/validation.csv", func(c *gin.Context) {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="validation.csv"`)
+		c.Status(http.StatusOK)
+		if err := client.WriteValidationReportCSV(c.Writer, lastValidationReport.Results()); err != nil {
+			c.Error(err)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/webhook"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RegisterWebhookHandlers registers the handlers to manage webhook subscriptions and view their delivery logs
+func RegisterWebhookHandlers(e *gin.Engine, dispatcher *webhook.Dispatcher) {
+	e.POST("/webhooks", func(c *gin.Context) {
+		var sub webhook.Subscription
+		if err := c.BindJSON(&sub); err != nil {
+			return
+		}
+		if u, err := url.Parse(sub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.String(http.StatusBadRequest, "Webhook URL must be an absolute http or https URL")
+			return
+		}
+		sub.ID = bson.NewObjectId()
+		sub.Created = time.Now()
+		if err := dispatcher.Subscriptions.Insert(&sub); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		sub.Secret = ""
+		c.Header("Location", "/webhooks/"+sub.ID.Hex())
+		c.JSON(http.StatusCreated, sub)
+	})
+
+	e.GET("/webhooks", func(c *gin.Context) {
+		subs := []webhook.Subscription{}
+		if err := dispatcher.Subscriptions.Find(nil).Sort("_id").All(&subs); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		for i := range subs {
+			subs[i].Secret = ""
+		}
+		c.JSON(http.StatusOK, subs)
+	})
+
+	e.GET("/webhooks/:id", func(c *gin.Context) {
+		id, ok := webhookID(c)
+		if !ok {
+			return
+		}
+		var sub webhook.Subscription
+		if err := dispatcher.Subscriptions.FindId(id).One(&sub); err == mgo.ErrNotFound {
+			c.Status(http.StatusNotFound)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		sub.Secret = ""
+		c.JSON(http.StatusOK, sub)
+	})
+
+	e.DELETE("/webhooks/:id", func(c *gin.Context) {
+		id, ok := webhookID(c)
+		if !ok {
+			return
+		}
+		if err := dispatcher.Subscriptions.RemoveId(id); err == mgo.ErrNotFound {
+			c.Status(http.StatusNotFound)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	e.GET("/webhooks/:id/deliveries", func(c *gin.Context) {
+		id, ok := webhookID(c)
+		if !ok {
+			return
+		}
+		deliveries := []webhook.Delivery{}
+		if err := dispatcher.Deliveries.Find(bson.M{"subscriptionID": id}).Sort("-_id").Limit(500).All(&deliveries); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, deliveries)
+	})
+}
+
+func webhookID(c *gin.Context) (bson.ObjectId, bool) {
+	id := c.Param("id")
+	if !bson.IsObjectIdHex(id) {
+		c.String(http.StatusBadRequest, "Bad ID format for requested webhook. Should be a BSON Id")
+		return "", false
+	}
+	return bson.ObjectIdHex(id), true
+}
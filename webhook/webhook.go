@@ -0,0 +1,215 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Event types published by the risk service
+const (
+	RefreshCompleted = "refresh.completed"
+	RiskChanged      = "risk.changed"
+)
+
+// Headers sent along with every webhook delivery
+const (
+	EventHeader     = "X-Risk-Service-Event"
+	DeliveryHeader  = "X-Risk-Service-Delivery"
+	SignatureHeader = "X-Risk-Service-Signature"
+)
+
+// Subscription represents a registered webhook.  If Events is empty, the subscription receives all events.
+type Subscription struct {
+	ID      bson.ObjectId `bson:"_id" json:"id"`
+	URL     string        `bson:"url" json:"url"`
+	Secret  string        `bson:"secret" json:"secret,omitempty"`
+	Events  []string      `bson:"events" json:"events,omitempty"`
+	Created time.Time     `bson:"created" json:"created"`
+}
+
+// Matches indicates if the subscription should receive events of the given type
+func (s *Subscription) Matches(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Event represents the JSON body posted to webhook subscribers
+type Event struct {
+	ID      bson.ObjectId `json:"id"`
+	Type    string        `json:"type"`
+	Created time.Time     `json:"created"`
+	Data    interface{}   `json:"data"`
+}
+
+// Delivery represents a single attempt to deliver an event to a subscriber
+type Delivery struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	SubscriptionID bson.ObjectId `bson:"subscriptionID" json:"subscriptionID"`
+	EventID        bson.ObjectId `bson:"eventID" json:"eventID"`
+	EventType      string        `bson:"eventType" json:"eventType"`
+	URL            string        `bson:"url" json:"url"`
+	Attempt        int           `bson:"attempt" json:"attempt"`
+	StatusCode     int           `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	Error          string        `bson:"error,omitempty" json:"error,omitempty"`
+	Success        bool          `bson:"success" json:"success"`
+	Created        time.Time     `bson:"created" json:"created"`
+}
+
+// Sign returns the signature for the body using the given secret.  The signature is a hex-encoded HMAC-SHA256,
+// prefixed with "sha256=".
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers events to the subscriptions stored in Mongo, retrying failed deliveries and recording every
+// attempt in the delivery log
+type Dispatcher struct {
+	Subscriptions *mgo.Collection
+	Deliveries    *mgo.Collection
+	Client        *http.Client
+	MaxAttempts   int
+	RetryDelay    time.Duration
+	wg            sync.WaitGroup
+}
+
+// NewDispatcher creates a new dispatcher backed by the given subscription and delivery log collections
+func NewDispatcher(subscriptions, deliveries *mgo.Collection) *Dispatcher {
+	return &Dispatcher{
+		Subscriptions: subscriptions,
+		Deliveries:    deliveries,
+		Client:        &http.Client{Timeout: 30 * time.Second},
+		MaxAttempts:   5,
+		RetryDelay:    30 * time.Second,
+	}
+}
+
+// Publish sends the event to every matching subscription.  Deliveries happen in the background; use Wait to block
+// until they are done.  It is safe to call Publish on a nil Dispatcher (it does nothing).
+func (d *Dispatcher) Publish(eventType string, data interface{}) error {
+	if d == nil {
+		return nil
+	}
+
+	var subs []Subscription
+	if err := d.Subscriptions.Find(nil).All(&subs); err != nil {
+		return err
+	}
+
+	event := Event{
+		ID:      bson.NewObjectId(),
+		Type:    eventType,
+		Created: time.Now(),
+		Data:    data,
+	}
+	body, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+
+	for i := range subs {
+		if subs[i].Matches(eventType) {
+			d.wg.Add(1)
+			go d.deliver(subs[i], event, body)
+		}
+	}
+	return nil
+}
+
+// Wait blocks until all in-progress deliveries (including retries) have finished
+func (d *Dispatcher) Wait() {
+	if d != nil {
+		d.wg.Wait()
+	}
+}
+
+// WaitContext blocks until all in-progress deliveries (including retries) have finished or the context is done.  It
+// returns the context's error if deliveries were still in progress.
+func (d *Dispatcher) WaitContext(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) deliver(sub Subscription, event Event, body []byte) {
+	defer d.wg.Done()
+
+	delay := d.RetryDelay
+	for attempt := 1; attempt <= d.MaxAttempts; attempt++ {
+		delivery := Delivery{
+			ID:             bson.NewObjectId(),
+			SubscriptionID: sub.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			URL:            sub.URL,
+			Attempt:        attempt,
+			Created:        time.Now(),
+		}
+		delivery.StatusCode, delivery.Error = d.post(sub, event, delivery.ID, body)
+		delivery.Success = delivery.Error == ""
+		if err := d.Deliveries.Insert(&delivery); err != nil {
+			slog.Error("Couldn't record webhook delivery", "error", err)
+		}
+		if delivery.Success {
+			return
+		}
+		if attempt < d.MaxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	slog.Warn("Giving up on delivering webhook event", "event_type", event.Type, "event_id", event.ID.Hex(), "url", sub.URL, "attempts", d.MaxAttempts)
+}
+
+func (d *Dispatcher) post(sub Subscription, event Event, deliveryID bson.ObjectId, body []byte) (int, string) {
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(DeliveryHeader, deliveryID.Hex())
+	if sub.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(sub.Secret, body))
+	}
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Sprintf("Received HTTP %d from webhook subscriber", res.StatusCode)
+	}
+	return res.StatusCode, ""
+}
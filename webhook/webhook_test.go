@@ -0,0 +1,110 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestWebhookSuite(t *testing.T) {
+	suite.Run(t, new(WebhookSuite))
+}
+
+type WebhookSuite struct {
+	suite.Suite
+}
+
+func (suite *WebhookSuite) TestSign() {
+	assert := suite.Assert()
+
+	// Expected value computed independently with: echo -n '{"a":1}' | openssl dgst -sha256 -hmac secret
+	assert.Equal("sha256=aa9e2e3575f5d7098b6caccd790888c36d5fdb63342a73bada2d6a51747a8494", Sign("secret", []byte(`{"a":1}`)))
+	assert.NotEqual(Sign("secret", []byte(`{"a":1}`)), Sign("other", []byte(`{"a":1}`)))
+}
+
+func (suite *WebhookSuite) TestMatches() {
+	assert := suite.Assert()
+
+	sub := Subscription{}
+	assert.True(sub.Matches(RefreshCompleted), "Subscriptions without events should match everything")
+	assert.True(sub.Matches(RiskChanged), "Subscriptions without events should match everything")
+
+	sub.Events = []string{RiskChanged}
+	assert.False(sub.Matches(RefreshCompleted))
+	assert.True(sub.Matches(RiskChanged))
+}
+
+func (suite *WebhookSuite) TestPost() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var received *http.Request
+	var body []byte
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	d := NewDispatcher(nil, nil)
+	sub := Subscription{ID: bson.NewObjectId(), URL: s.URL, Secret: "shh"}
+	event := Event{ID: bson.NewObjectId(), Type: RefreshCompleted, Created: time.Now(), Data: map[string]int{"patients": 2}}
+	data, err := json.Marshal(&event)
+	require.NoError(err)
+	deliveryID := bson.NewObjectId()
+
+	status, errString := d.post(sub, event, deliveryID, data)
+	assert.Equal(http.StatusNoContent, status)
+	assert.Empty(errString)
+	require.NotNil(received)
+	assert.Equal(RefreshCompleted, received.Header.Get(EventHeader))
+	assert.Equal(deliveryID.Hex(), received.Header.Get(DeliveryHeader))
+	assert.Equal(Sign("shh", data), received.Header.Get(SignatureHeader))
+	assert.Equal(data, body)
+}
+
+func (suite *WebhookSuite) TestPostFailure() {
+	assert := suite.Assert()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	d := NewDispatcher(nil, nil)
+	sub := Subscription{ID: bson.NewObjectId(), URL: s.URL}
+	event := Event{ID: bson.NewObjectId(), Type: RiskChanged}
+	status, errString := d.post(sub, event, bson.NewObjectId(), []byte("{}"))
+	assert.Equal(http.StatusInternalServerError, status)
+	assert.NotEmpty(errString)
+}
+
+func (suite *WebhookSuite) TestWaitContext() {
+	assert := suite.Assert()
+
+	var d *Dispatcher
+	assert.NoError(d.WaitContext(context.Background()))
+
+	d = NewDispatcher(nil, nil)
+	assert.NoError(d.WaitContext(context.Background()))
+
+	// A delivery still being retried holds up the wait until the context is done
+	d.wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, d.WaitContext(ctx))
+
+	d.wg.Done()
+	assert.NoError(d.WaitContext(context.Background()))
+}